@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+// compile writes an image of src as compiled by env.
+func compile(t *testing.T, env *glisp.Glisp, src string) []byte {
+	t.Helper()
+	if err := env.LoadString(src); err != nil {
+		t.Fatal(err)
+	}
+	var image bytes.Buffer
+	if err := env.WriteCompiled(&image); err != nil {
+		t.Fatal(err)
+	}
+	return image.Bytes()
+}
+
+func TestCompiledRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "shapes"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "shapes", "util.glisp"), []byte(`
+		(ns shapes.util)
+		(defn- square [x] (* x x))
+		(defn area [r] (* 3 (square r)))`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"functions", `
+			(defn add [a b] (+ a b))
+			(defn rest-of [x & more] more)
+			(list (add 1 2) (rest-of 1 2 3) (apply add [3 4]))`,
+			`(3 (2 3) 7)`},
+		{"closures", `
+			(defn adder [n] (fn [x] (+ x n)))
+			(defn make-counter [] (let [n 0] (fn [] (set! n (+ n 1)) n)))
+			(def counter (make-counter))
+			(counter)
+			(list ((adder 2) 3) (counter))`,
+			`(5 2)`},
+		{"control flow", `
+			(def out [])
+			(dotimes [i 3] (set! out (append out i)))
+			(list out (try (throw "oops") (catch e e))
+			      (and true 1) (or false 2)
+			      (with-output-to-string
+			        (doseq [x '(a b c)] (cond (= x 'b) (continue) (print x)))))`,
+			`([0 1 2] "oops" 1 2 "ac")`},
+		{"literals", `
+			(list 12345678901234567890123 1/3 12.50M 1.5 #a "str" 'sym
+			      [1 [2]] {'a 1} '(1 . 2))`,
+			`(12345678901234567890123 1/3 12.50M 1.5 #a "str" sym ` +
+				`[1 [2]] {a 1} (1 . 2))`},
+		{"macros", `
+			(defmac twice [x] ` + "`" + `(* 2 ~x))
+			(defmac swap [a b] ` + "`" + `(let [tmp# ~a] (list ~b tmp#)))
+			(list (twice 4) (eval '(twice 5)) (let [tmp 1] (swap tmp 2)))`,
+			`(8 10 (2 1))`},
+		{"structs", `
+			(defstruct Point x (y 0))
+			(def p (Point x: 1))
+			(list p (Point? p) (Point-y p))`,
+			`((Point x: 1 y: 0) true 0)`},
+		{"protocols", `
+			(defstruct Circle r)
+			(defprotocol Shape (area [s]))
+			(extend-type Circle Shape (area [c] (* 3 (Circle-r c) (Circle-r c))))
+			(extend-type int Shape (area [n] n))
+			(list (area (Circle r: 2)) (area 5) (satisfies? Shape "x"))`,
+			`(12 5 false)`},
+		{"require", `
+			(require shapes.util :as u)
+			(list (u/area 2) (shapes.util/area 1))`,
+			`(12 3)`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := newEnvironment()
+			env.SetModulePath(dir)
+			image := compile(t, env, c.src)
+
+			loaded := newEnvironment()
+			loaded.SetModulePath(dir)
+			if err := loaded.LoadCompiled(bytes.NewReader(image)); err != nil {
+				t.Fatal(err)
+			}
+			res, err := loaded.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.SexpString(); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompiledPersistent(t *testing.T) {
+	env := newEnvironment()
+	env.SetPersistentLiterals(true)
+	image := compile(t, env, `
+		(defmac pair [a b] `+"`"+`[~a ~b])
+		(def x 1)
+		(list (pair x 2) `+"`"+`[~x] `+"`"+`{'a ~x})`)
+
+	loaded := newEnvironment()
+	if err := loaded.LoadCompiled(bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := loaded.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the loading environment's literals aren't persistent, but the
+	// image's still are
+	arr, _ := glisp.ListToArray(res)
+	if len(arr) != 3 {
+		t.Fatalf("got %s", res.SexpString())
+	}
+	_, pair := arr[0].(glisp.SexpVector)
+	_, vec := arr[1].(glisp.SexpVector)
+	_, m := arr[2].(glisp.SexpMap)
+	if !pair || !vec || !m {
+		t.Errorf("got %s, want two vectors and a map", res.SexpString())
+	}
+}
+
+func TestCompiledErrors(t *testing.T) {
+	image := compile(t, newEnvironment(), `
+		(defn f [x & more] (try (* x 2) (catch e e) (finally 0)))
+		(defmac m [x] `+"`"+`(let [y# ~x] (f y#)))
+		(defstruct S a (b 1/2))
+		(list (m 1) 1.5 2.50M "s" #c [1 {'k 'v}])`)
+
+	load := func(data []byte) error {
+		return newEnvironment().LoadCompiled(bytes.NewReader(data))
+	}
+	if err := load(image); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := load([]byte("GLX\x02")); err == nil ||
+		err.Error() != "not a compiled glisp image" {
+		t.Errorf("bad magic: got %v", err)
+	}
+	if err := load(nil); err == nil {
+		t.Error("an empty image should be rejected")
+	}
+
+	var wrongVersion []byte
+	wrongVersion = append(wrongVersion, "GLC"...)
+	wrongVersion = binary.AppendUvarint(wrongVersion, glisp.CompiledVersion+1)
+	wrongVersion = append(wrongVersion, image[4:]...)
+	want := "unsupported compiled image version " +
+		strconv.Itoa(glisp.CompiledVersion+1)
+	if err := load(wrongVersion); err == nil || err.Error() != want {
+		t.Errorf("wrong version: got %v, want %q", err, want)
+	}
+
+	// a varint longer than any uint64
+	overflow := append([]byte("GLC"), bytes.Repeat([]byte{0xff}, 11)...)
+	if err := load(overflow); err == nil {
+		t.Error("an overlong varint should be rejected")
+	}
+	corrupt := append([]byte("GLC\x02"), bytes.Repeat([]byte{0xff}, 11)...)
+	if err := load(corrupt); err == nil ||
+		!strings.HasPrefix(err.Error(), "reading compiled image") {
+		t.Errorf("corrupt varint: got %v", err)
+	}
+
+	for n := 0; n < len(image); n++ {
+		if err := load(image[:n]); err == nil {
+			t.Errorf("image truncated to %d bytes loaded", n)
+		}
+	}
+
+	// corrupt images must fail cleanly, if they fail at all, so only
+	// loading is tested; the bytes after the magic and version vary
+	for i := 4; i < len(image); i++ {
+		for _, b := range []byte{0x00, 0x07, 0x80, 0xff} {
+			data := append([]byte(nil), image...)
+			data[i] = b
+			load(data)
+		}
+	}
+}
+
+func TestCompiledGensyms(t *testing.T) {
+	env := newEnvironment()
+	// make the compiling environment's gensym numbers higher than the
+	// loading environment's
+	for i := 0; i < 100; i++ {
+		env.MakeSymbol("padding-" + strconv.Itoa(i))
+	}
+	image := compile(t, env, `
+		(defmac hidden [] `+"`"+`(let [v# 1] 'v#))
+		(hidden)`)
+
+	loaded := newEnvironment()
+	if err := loaded.LoadCompiled(bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := loaded.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sym, ok := res.(glisp.SexpSymbol)
+	if !ok || !strings.HasPrefix(sym.Name(), "v__") {
+		t.Fatalf("got %s, want a gensym", res.SexpString())
+	}
+
+	for i := 0; i < 200; i++ {
+		fresh := loaded.GenSymbol("v__")
+		if fresh.Name() == sym.Name() {
+			t.Fatalf("gensym %s collides with the image", fresh.Name())
+		}
+	}
+}
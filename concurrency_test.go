@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentGoBlocks runs go blocks that share a closure, globals,
+// the symbol table and the macro table. Run it with -race.
+func TestConcurrentGoBlocks(t *testing.T) {
+	env := newEnvironment()
+	err := env.LoadString(`
+		(def done (make-chan 4))
+		(def counter (let [n 0] (fn [] (set! n (+ n 1)) n)))
+		(def total 0)
+		(defn work [id]
+		  (dotimes [i 2000]
+		    (counter)
+		    (set! total (+ total 1))
+		    (eval (list 'def 'last-worker id))
+		    (gensym "w")
+		    (cond (= 0 (mod i 200))
+		      (eval '(begin (defmac twice [x] (list '* 2 x)) (twice 21)))
+		      '()))
+		  (send! done id))
+		(go (work 1))
+		(go (work 2))
+		(go (work 3))
+		(go (work 4))
+		(dotimes [i 4] (<! done))
+		(list (number? (counter)) (<= total 8000) (number? last-worker)
+		      (eval '(twice 2)))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host may intern symbols while scripts run
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			env.MakeSymbol("host-" + strconv.Itoa(i))
+		}
+	}()
+	res, err := env.Run()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.SexpString(), "(true true true 4)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// lineWriter sends everything written to it over a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestCoroutineErrors(t *testing.T) {
+	env := newEnvironment()
+	stderr := make(lineWriter, 1)
+	env.SetStderr(stderr)
+	err := env.LoadString(`(go (undefined-function 1)) 'started`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-stderr:
+		if !strings.HasPrefix(msg, "coroutine failed: ") ||
+			!strings.Contains(msg, "undefined-function") {
+			t.Errorf("got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the coroutine's error was not reported")
+	}
+}
@@ -29,6 +29,9 @@ func MakeChanFunction(env *glisp.Glisp, name string,
 		}
 	}
 
+	if err := env.CheckCollectionSize(size); err != nil {
+		return glisp.SexpNull, err
+	}
 	return SexpChannel(make(chan glisp.Sexp, size)), nil
 }
 
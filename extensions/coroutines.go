@@ -2,43 +2,52 @@ package glispext
 
 import (
 	"errors"
+	"fmt"
 	"github.com/zhemao/glisp/interpreter"
 )
 
-type SexpCoroutine struct {
-	env *glisp.Glisp
-}
-
-func (coro SexpCoroutine) SexpString() string {
-	return "[coroutine]"
-}
-
 func StartCoroutineFunction(env *glisp.Glisp, name string,
 	args []glisp.Sexp) (glisp.Sexp, error) {
-	switch t := args[0].(type) {
-	case SexpCoroutine:
-		go t.env.Run()
-	default:
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	// a coroutine would have a budget of its own and outlive the run
+	// that started it, so it could escape the limits
+	if env.Limited() {
+		return glisp.SexpNull,
+			errors.New("coroutines cannot be started in a limited environment")
+	}
+	body, err := glisp.ListToArray(args[0])
+	if err != nil {
 		return glisp.SexpNull, errors.New("not a coroutine")
 	}
-	return glisp.SexpNull, nil
-}
 
-func CreateCoroutineMacro(env *glisp.Glisp, name string,
-	args []glisp.Sexp) (glisp.Sexp, error) {
+	// each start gets its own environment, since the same go block
+	// may be started again while an earlier run is still going
 	coroenv := env.Duplicate()
-	err := coroenv.LoadExpressions(args)
+	err = coroenv.LoadExpressions(body)
 	if err != nil {
-		return glisp.SexpNull, nil
+		return glisp.SexpNull, err
 	}
-	coro := SexpCoroutine{coroenv}
+	go func() {
+		// nothing waits for the coroutine, so report its errors
+		if _, err := coroenv.Run(); err != nil {
+			fmt.Fprintf(coroenv.Stderr(), "coroutine failed: %s",
+				coroenv.GetStackTrace(err))
+		}
+	}()
+	return glisp.SexpNull, nil
+}
 
-	// (apply StartCoroutineFunction [coro])
-	return glisp.MakeList([]glisp.Sexp{env.MakeSymbol("apply"),
-		glisp.MakeUserFunction("__start", StartCoroutineFunction),
-		glisp.SexpArray([]glisp.Sexp{coro})}), nil
+func CreateCoroutineMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	// (__start-coroutine (quote (body ...)))
+	return glisp.MakeList([]glisp.Sexp{env.MakeSymbol("__start-coroutine"),
+		glisp.MakeList([]glisp.Sexp{env.MakeSymbol("quote"),
+			glisp.MakeList(args)})}), nil
 }
 
 func ImportCoroutines(env *glisp.Glisp) {
 	env.AddMacro("go", CreateCoroutineMacro)
+	env.AddFunction("__start-coroutine", StartCoroutineFunction)
 }
@@ -0,0 +1,428 @@
+package glispext
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+// SexpPort is a stream scripts can read from or write to. Reading
+// expressions with read goes through the port's own lexer, so mixing read
+// with read-line may lose the whitespace that ended the last expression.
+type SexpPort struct {
+	name   string
+	reader *bufio.Reader
+	writer io.Writer
+	closer io.Closer
+	lexer  *glisp.Lexer
+	closed bool
+	std    stdStream
+	source io.Reader // the stdin reader is reading from
+}
+
+// the standard ports use whichever streams the environment using them
+// has been given
+type stdStream int
+
+const (
+	notStd stdStream = iota
+	stdinStream
+	stdoutStream
+	stderrStream
+)
+
+// NewInputPort wraps r so scripts can read from it. Closing the port
+// doesn't close r.
+func NewInputPort(name string, r io.Reader) *SexpPort {
+	return &SexpPort{name: name, reader: bufio.NewReader(r)}
+}
+
+// NewOutputPort wraps w so scripts can write to it. Closing the port
+// doesn't close w.
+func NewOutputPort(name string, w io.Writer) *SexpPort {
+	return &SexpPort{name: name, writer: w}
+}
+
+func (p *SexpPort) SexpString() string {
+	return fmt.Sprintf("[port %s]", p.name)
+}
+
+// Close closes the file the port was opened on, if any. Closing a port
+// more than once does nothing.
+func (p *SexpPort) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+func (p *SexpPort) input(env *glisp.Glisp) (*bufio.Reader, error) {
+	if p.closed {
+		return nil, fmt.Errorf("port %s is closed", p.name)
+	}
+	if p.std == stdinStream && p.source != env.Stdin() {
+		p.source = env.Stdin()
+		p.reader = bufio.NewReader(p.source)
+		p.lexer = nil
+	}
+	if p.reader == nil {
+		return nil, fmt.Errorf("port %s is not open for reading", p.name)
+	}
+	return p.reader, nil
+}
+
+func (p *SexpPort) output(env *glisp.Glisp) (io.Writer, error) {
+	if p.closed {
+		return nil, fmt.Errorf("port %s is closed", p.name)
+	}
+	switch p.std {
+	case stdoutStream:
+		return env.Stdout(), nil
+	case stderrStream:
+		return env.Stderr(), nil
+	}
+	if p.writer == nil {
+		return nil, fmt.Errorf("port %s is not open for writing", p.name)
+	}
+	return p.writer, nil
+}
+
+// SexpEOF is what reading from a port gives once there is nothing left.
+type SexpEOF struct{}
+
+var EOF = SexpEOF{}
+
+func (e SexpEOF) SexpString() string {
+	return "[eof]"
+}
+
+func portArg(name string, args []glisp.Sexp, i int) (*SexpPort, error) {
+	if p, ok := args[i].(*SexpPort); ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("argument %d of %s must be a port", i+1, name)
+}
+
+// OpenFunction implements (open path) and (open path mode), where mode
+// is "r" to read, the default, "w" to write from scratch, or "a" to
+// append. Files are read through the environment's FS if it has one, and
+// can't be written at all then.
+func OpenFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	filename, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	mode := "r"
+	if len(args) == 2 {
+		switch t := args[1].(type) {
+		case glisp.SexpStr:
+			mode = string(t)
+		case glisp.SexpSymbol:
+			mode = t.Name()
+		default:
+			return glisp.SexpNull, errors.New("file mode must be a string")
+		}
+	}
+
+	if mode == "r" {
+		file, err := env.OpenFile(filename)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		port := NewInputPort(filename, file)
+		port.closer = file
+		return port, nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch mode {
+	case "w":
+		flags |= os.O_TRUNC
+	case "a":
+		flags |= os.O_APPEND
+	default:
+		return glisp.SexpNull, fmt.Errorf("unknown file mode %q", mode)
+	}
+	if env.FileSystem() != nil {
+		return glisp.SexpNull, errors.New("files cannot be written here")
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	port := NewOutputPort(filename, file)
+	port.closer = file
+	return port, nil
+}
+
+func CloseFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	port, err := portArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpNull, port.Close()
+}
+
+// inputPort returns the port a reading function was given, or stdin.
+func inputPort(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (*SexpPort, error) {
+	if len(args) > 1 {
+		return nil, glisp.WrongNargs
+	}
+	if len(args) == 1 {
+		return portArg(name, args, 0)
+	}
+	stdin, ok := env.FindObject("stdin")
+	if !ok {
+		return nil, errors.New("stdin is not defined")
+	}
+	return portArg(name, []glisp.Sexp{stdin}, 0)
+}
+
+// ReadLineFunction implements (read-line port), which gives the next
+// line without its line ending, and (read-all port), which gives
+// everything left. Both read stdin when not given a port.
+func ReadLineFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	port, err := inputPort(env, name, args)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	reader, err := port.input(env)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	if name == "read-all" {
+		var r io.Reader = reader
+		if max := env.Limits().MaxCollectionSize; max > 0 {
+			// one byte more than allowed shows that there's too much
+			r = io.LimitReader(reader, int64(max)+1)
+		}
+		all, err := io.ReadAll(r)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		if err := env.CheckCollectionSize(len(all)); err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.SexpStr(all), nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err == io.EOF {
+		if line == "" {
+			return EOF, nil
+		}
+	} else if err != nil {
+		return glisp.SexpNull, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if err := env.CheckCollectionSize(len(line)); err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpStr(line), nil
+}
+
+// ReadExpression lets read take the next expression from the port, or
+// eof if there are none.
+func (p *SexpPort) ReadExpression(env *glisp.Glisp) (glisp.Sexp, error) {
+	reader, err := p.input(env)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if p.lexer == nil {
+		p.lexer = glisp.NewLexerFromNamedStream(reader, p.name)
+	}
+	expr, err := glisp.ParseExpression(glisp.NewParser(env, p.lexer))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if expr == glisp.SexpEnd {
+		return EOF, nil
+	}
+	return expr, nil
+}
+
+// WriteFunction implements (write port args...), which writes args as
+// join would, and write-line, which ends them with a newline.
+func WriteFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	port, err := portArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	writer, err := port.output(env)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	var buf strings.Builder
+	for _, arg := range args[1:] {
+		buf.WriteString(displayString(arg))
+	}
+	if name == "write-line" {
+		buf.WriteByte('\n')
+	}
+	_, err = io.WriteString(writer, buf.String())
+	return glisp.SexpNull, err
+}
+
+// WithOpenFileMacro expands (with-open-file [f path mode] body...) into
+// code that closes f however body finishes.
+func WithOpenFileMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	binding, ok := args[0].(glisp.SexpArray)
+	if !ok || len(binding) < 2 || len(binding) > 3 {
+		return glisp.SexpNull,
+			errors.New("with-open-file needs a binding like [f path]")
+	}
+	if _, ok := binding[0].(glisp.SexpSymbol); !ok {
+		return glisp.SexpNull,
+			errors.New("with-open-file must bind a symbol")
+	}
+
+	// (let [f (open path mode)]
+	//   (try (begin body...) (finally (close f))))
+	open := glisp.MakeList(append([]glisp.Sexp{env.MakeSymbol("open")},
+		binding[1:]...))
+	body := glisp.MakeList(append([]glisp.Sexp{env.MakeSymbol("begin")},
+		args[1:]...))
+	finally := glisp.MakeList([]glisp.Sexp{env.MakeSymbol("finally"),
+		glisp.MakeList([]glisp.Sexp{env.MakeSymbol("close"), binding[0]})})
+	return glisp.MakeList([]glisp.Sexp{env.MakeSymbol("let"),
+		glisp.SexpArray([]glisp.Sexp{binding[0], open}),
+		glisp.MakeList([]glisp.Sexp{env.MakeSymbol("try"), body, finally}),
+	}), nil
+}
+
+// statFile and readDir go through the environment's FS if it has one.
+
+func statFile(env *glisp.Glisp, name string) (fs.FileInfo, error) {
+	if fsys := env.FileSystem(); fsys != nil {
+		return fs.Stat(fsys, path.Clean(name))
+	}
+	return os.Stat(name)
+}
+
+func readDir(env *glisp.Glisp, name string) ([]fs.DirEntry, error) {
+	if fsys := env.FileSystem(); fsys != nil {
+		return fs.ReadDir(fsys, path.Clean(name))
+	}
+	return os.ReadDir(name)
+}
+
+// FileFunction implements (list-dir path), giving the sorted names in a
+// directory, (stat path), giving a hash describing a file,
+// (file-exists? path) and (delete-file path).
+func FileFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	filename, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	switch name {
+	case "list-dir":
+		entries, err := readDir(env, filename)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		if err := env.CheckCollectionSize(len(entries)); err != nil {
+			return glisp.SexpNull, err
+		}
+		names := make([]glisp.Sexp, len(entries))
+		for i, entry := range entries {
+			names[i] = glisp.SexpStr(entry.Name())
+		}
+		return glisp.SexpArray(names), nil
+	case "file-exists?":
+		_, err := statFile(env, filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			return glisp.SexpBool(false), nil
+		}
+		return glisp.SexpBool(err == nil), err
+	case "delete-file":
+		if env.FileSystem() != nil {
+			return glisp.SexpNull, errors.New("files cannot be deleted here")
+		}
+		return glisp.SexpNull, os.Remove(filename)
+	case "stat":
+		info, err := statFile(env, filename)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.MakeHash([]glisp.Sexp{
+			env.MakeSymbol("name"), glisp.SexpStr(info.Name()),
+			env.MakeSymbol("size"), glisp.SexpInt(info.Size()),
+			env.MakeSymbol("dir?"), glisp.SexpBool(info.IsDir()),
+			env.MakeSymbol("mode"), glisp.SexpStr(info.Mode().String()),
+			env.MakeSymbol("modified"), SexpTime(info.ModTime()),
+		}, "hash")
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+func IOPredicateFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	switch name {
+	case "port?":
+		_, ok := args[0].(*SexpPort)
+		return glisp.SexpBool(ok), nil
+	case "eof?":
+		return glisp.SexpBool(args[0] == EOF), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+func ImportIO(env *glisp.Glisp) {
+	env.AddGlobal("stdin", &SexpPort{name: "stdin", std: stdinStream})
+	env.AddGlobal("stdout", &SexpPort{name: "stdout", std: stdoutStream})
+	env.AddGlobal("stderr", &SexpPort{name: "stderr", std: stderrStream})
+
+	env.AddFunction("open", OpenFunction)
+	env.AddFunction("close", CloseFunction)
+	env.AddFunction("read-line", ReadLineFunction)
+	env.AddFunction("read-all", ReadLineFunction)
+	env.AddFunction("write", WriteFunction)
+	env.AddFunction("write-line", WriteFunction)
+	env.AddMacro("with-open-file", WithOpenFileMacro)
+	env.AddFunction("list-dir", FileFunction)
+	env.AddFunction("stat", FileFunction)
+	env.AddFunction("file-exists?", FileFunction)
+	env.AddFunction("delete-file", FileFunction)
+	env.AddFunction("port?", IOPredicateFunction)
+	env.AddFunction("eof?", IOPredicateFunction)
+}
@@ -0,0 +1,330 @@
+package glispext
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+var floatFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"cbrt":  math.Cbrt,
+	"exp":   math.Exp,
+	"log":   math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"asin":  math.Asin,
+	"acos":  math.Acos,
+	"atan":  math.Atan,
+	"sinh":  math.Sinh,
+	"cosh":  math.Cosh,
+	"tanh":  math.Tanh,
+}
+
+var floatFunctions2 = map[string]func(float64, float64) float64{
+	"atan2": math.Atan2,
+	"hypot": math.Hypot,
+}
+
+func floatArg(name string, arg glisp.Sexp) (float64, error) {
+	f, ok := glisp.ToFloat(arg)
+	if !ok {
+		return 0, fmt.Errorf("argument to %s must be a number", name)
+	}
+	return float64(f), nil
+}
+
+// FloatMathFunction applies one of the functions in the Go math package,
+// which always give floats.
+func FloatMathFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if fn, ok := floatFunctions[name]; ok {
+		if len(args) != 1 {
+			return glisp.SexpNull, glisp.WrongNargs
+		}
+		x, err := floatArg(name, args[0])
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.SexpFloat(fn(x)), nil
+	}
+
+	fn, ok := floatFunctions2[name]
+	if !ok {
+		return glisp.SexpNull, errors.New("unknown function")
+	}
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	x, err := floatArg(name, args[0])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	y, err := floatArg(name, args[1])
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpFloat(fn(x, y)), nil
+}
+
+// the most bits pow will produce for an exact result
+const maxPowBits = 1 << 24
+
+// PowFunction raises exact numbers to integer powers exactly, giving a
+// ratio for negative powers, and anything else as floats.
+func PowFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if !glisp.IsNumber(args[0]) || !glisp.IsNumber(args[1]) {
+		return glisp.SexpNull, errors.New("arguments to pow must be numbers")
+	}
+
+	base, exact := glisp.ToRat(args[0])
+	power, ok := args[1].(glisp.SexpInt)
+	if !exact || !ok {
+		x, _ := glisp.ToFloat(args[0])
+		y, _ := glisp.ToFloat(args[1])
+		return glisp.SexpFloat(math.Pow(float64(x), float64(y))), nil
+	}
+
+	n := int64(power)
+	if n < 0 {
+		if base.Sign() == 0 {
+			return glisp.SexpNull, glisp.DivideByZero
+		}
+		n = -n
+	}
+	bits := int64(base.Num().BitLen() + base.Denom().BitLen())
+	if bits > 2 && n > maxPowBits/bits {
+		return glisp.SexpNull, errors.New("result of pow too large")
+	}
+
+	e := big.NewInt(n)
+	num := new(big.Int).Exp(base.Num(), e, nil)
+	den := new(big.Int).Exp(base.Denom(), e, nil)
+	if power < 0 {
+		num, den = den, num
+	}
+	res := new(big.Rat).SetFrac(num, den)
+	if d, ok := args[0].(glisp.SexpDecimal); ok && power >= 0 {
+		// keep decimals decimal, with the scale a product would have
+		return glisp.RoundRat(res, d.Scale()*int(power),
+			glisp.RoundHalfEven), nil
+	}
+	return glisp.MakeRatio(res), nil
+}
+
+// AbsFunction keeps the type of its argument, except that the most
+// negative int becomes a big integer.
+func AbsFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if f, ok := args[0].(glisp.SexpFloat); ok {
+		return glisp.SexpFloat(math.Abs(float64(f))), nil
+	}
+	if !glisp.IsNumber(args[0]) {
+		return glisp.SexpNull, errors.New("argument to abs must be a number")
+	}
+	sign, err := glisp.Compare(args[0], glisp.SexpInt(0))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if sign < 0 {
+		return glisp.NumericDo(glisp.Sub, glisp.SexpInt(0), args[0])
+	}
+	return args[0], nil
+}
+
+var roundFloat = map[string]func(float64) float64{
+	"floor":    math.Floor,
+	"ceiling":  math.Ceil,
+	"round":    math.Round,
+	"truncate": math.Trunc,
+}
+
+var roundExact = map[string]glisp.RoundingMode{
+	"floor":    glisp.RoundFloor,
+	"ceiling":  glisp.RoundCeiling,
+	"round":    glisp.RoundHalfUp,
+	"truncate": glisp.RoundDown,
+}
+
+// RoundFunction rounds floats to whole floats, and exact numbers to
+// integers. round takes halves away from zero.
+func RoundFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if f, ok := args[0].(glisp.SexpFloat); ok {
+		return glisp.SexpFloat(roundFloat[name](float64(f))), nil
+	}
+	r, ok := glisp.ToRat(args[0])
+	if !ok {
+		return glisp.SexpNull,
+			fmt.Errorf("argument to %s must be a number", name)
+	}
+	d := glisp.RoundRat(r, 0, roundExact[name])
+	return glisp.MakeRatio(d.Rat()), nil
+}
+
+// MinMaxFunction returns whichever argument is smallest or largest.
+func MinMaxFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	best := args[0]
+	for _, arg := range args {
+		if !glisp.IsNumber(arg) {
+			return glisp.SexpNull,
+				fmt.Errorf("arguments to %s must be numbers", name)
+		}
+		cmp, err := glisp.Compare(arg, best)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		if (name == "min" && cmp < 0) || (name == "max" && cmp > 0) {
+			best = arg
+		}
+	}
+	return best, nil
+}
+
+// IntDivFunction implements quot and rem, which truncate toward zero so
+// rem has the sign of the dividend, and modulo, which floors so its
+// result has the sign of the divisor.
+func IntDivFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	a, ok := glisp.ToBigInt(args[0])
+	if !ok {
+		return glisp.SexpNull,
+			fmt.Errorf("arguments to %s must be integers", name)
+	}
+	b, ok := glisp.ToBigInt(args[1])
+	if !ok {
+		return glisp.SexpNull,
+			fmt.Errorf("arguments to %s must be integers", name)
+	}
+	if b.Sign() == 0 {
+		return glisp.SexpNull, glisp.DivideByZero
+	}
+
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	switch name {
+	case "quot":
+		return glisp.MakeBigInt(q), nil
+	case "modulo":
+		if r.Sign() != 0 && r.Sign() != b.Sign() {
+			r.Add(r, b)
+		}
+	}
+	return glisp.MakeBigInt(r), nil
+}
+
+// ExactnessFunction converts between exact numbers and floats.
+// inexact->exact gives the exact value of the float, as an integer or
+// ratio.
+func ExactnessFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	switch name {
+	case "exact->inexact":
+		f, ok := glisp.ToFloat(args[0])
+		if !ok {
+			return glisp.SexpNull,
+				fmt.Errorf("argument to %s must be a number", name)
+		}
+		return f, nil
+	case "inexact->exact":
+		f, ok := args[0].(glisp.SexpFloat)
+		if !ok {
+			if glisp.IsNumber(args[0]) {
+				return args[0], nil
+			}
+			return glisp.SexpNull,
+				fmt.Errorf("argument to %s must be a number", name)
+		}
+		r := new(big.Rat).SetFloat64(float64(f))
+		if r == nil {
+			return glisp.SexpNull,
+				fmt.Errorf("%s has no exact value", f.SexpString())
+		}
+		return glisp.MakeRatio(r), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+func MathPredicateFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	switch name {
+	case "nan?", "inf?":
+		f, ok := args[0].(glisp.SexpFloat)
+		if !ok {
+			return glisp.SexpBool(false), nil
+		}
+		if name == "nan?" {
+			return glisp.SexpBool(math.IsNaN(float64(f))), nil
+		}
+		return glisp.SexpBool(math.IsInf(float64(f), 0)), nil
+	case "even?", "odd?":
+		i, ok := glisp.ToBigInt(args[0])
+		if !ok {
+			return glisp.SexpNull,
+				fmt.Errorf("argument to %s must be an integer", name)
+		}
+		return glisp.SexpBool((i.Bit(0) == 0) == (name == "even?")), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+func ImportMath(env *glisp.Glisp) {
+	env.AddGlobal("pi", glisp.SexpFloat(math.Pi))
+	env.AddGlobal("e", glisp.SexpFloat(math.E))
+	env.AddGlobal("inf", glisp.SexpFloat(math.Inf(1)))
+	env.AddGlobal("nan", glisp.SexpFloat(math.NaN()))
+
+	for name := range floatFunctions {
+		env.AddFunction(name, FloatMathFunction)
+	}
+	for name := range floatFunctions2 {
+		env.AddFunction(name, FloatMathFunction)
+	}
+	for name := range roundFloat {
+		env.AddFunction(name, RoundFunction)
+	}
+	env.AddFunction("pow", PowFunction)
+	env.AddFunction("abs", AbsFunction)
+	env.AddFunction("min", MinMaxFunction)
+	env.AddFunction("max", MinMaxFunction)
+	env.AddFunction("quot", IntDivFunction)
+	env.AddFunction("rem", IntDivFunction)
+	env.AddFunction("modulo", IntDivFunction)
+	env.AddFunction("exact->inexact", ExactnessFunction)
+	env.AddFunction("inexact->exact", ExactnessFunction)
+	env.AddFunction("nan?", MathPredicateFunction)
+	env.AddFunction("inf?", MathPredicateFunction)
+	env.AddFunction("even?", MathPredicateFunction)
+	env.AddFunction("odd?", MathPredicateFunction)
+}
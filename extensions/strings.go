@@ -0,0 +1,669 @@
+package glispext
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+func stringArg(name string, args []glisp.Sexp, i int) (string, error) {
+	switch t := args[i].(type) {
+	case glisp.SexpStr:
+		return string(t), nil
+	case glisp.SexpChar:
+		return string(t), nil
+	}
+	return "", fmt.Errorf("argument %d of %s must be a string", i+1, name)
+}
+
+func intArg(name string, args []glisp.Sexp, i int) (int, error) {
+	switch t := args[i].(type) {
+	case glisp.SexpInt:
+		return int(t), nil
+	case glisp.SexpChar:
+		return int(t), nil
+	}
+	return 0, fmt.Errorf("argument %d of %s must be an integer", i+1, name)
+}
+
+func stringArgs(name string, args []glisp.Sexp, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, glisp.WrongNargs
+	}
+	strs := make([]string, n)
+	for i := range args {
+		str, err := stringArg(name, args, i)
+		if err != nil {
+			return nil, err
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+// displayString is how join and builders show values, which is like str
+// except that strings and chars go in as they are.
+func displayString(expr glisp.Sexp) string {
+	switch t := expr.(type) {
+	case glisp.SexpStr:
+		return string(t)
+	case glisp.SexpChar:
+		return string(t)
+	case glisp.SexpDecimal:
+		return t.String()
+	}
+	return expr.SexpString()
+}
+
+// StringTransformFunction implements the functions that take a string
+// and give back a string.
+func StringTransformFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	str, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	// the trim functions take an optional set of chars to trim, and the
+	// others take nothing else
+	cutset := ""
+	if len(args) == 2 {
+		if !strings.HasPrefix(name, "trim") {
+			return glisp.SexpNull, glisp.WrongNargs
+		}
+		if cutset, err = stringArg(name, args, 1); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
+	switch name {
+	case "upper":
+		return glisp.SexpStr(strings.ToUpper(str)), nil
+	case "lower":
+		return glisp.SexpStr(strings.ToLower(str)), nil
+	case "trim":
+		if len(args) == 1 {
+			return glisp.SexpStr(strings.TrimSpace(str)), nil
+		}
+		return glisp.SexpStr(strings.Trim(str, cutset)), nil
+	case "trim-left":
+		if len(args) == 1 {
+			cutset = " \t\n\r\v\f"
+		}
+		return glisp.SexpStr(strings.TrimLeft(str, cutset)), nil
+	case "trim-right":
+		if len(args) == 1 {
+			cutset = " \t\n\r\v\f"
+		}
+		return glisp.SexpStr(strings.TrimRight(str, cutset)), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+// StringSearchFunction implements the functions that look for one
+// string in another. Indexes are in bytes, like sget and slice, and are
+// -1 if nothing is found.
+func StringSearchFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	strs, err := stringArgs(name, args, 2)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	str, sub := strs[0], strs[1]
+
+	switch name {
+	case "contains?":
+		return glisp.SexpBool(strings.Contains(str, sub)), nil
+	case "starts-with?":
+		return glisp.SexpBool(strings.HasPrefix(str, sub)), nil
+	case "ends-with?":
+		return glisp.SexpBool(strings.HasSuffix(str, sub)), nil
+	case "index-of":
+		return glisp.SexpInt(strings.Index(str, sub)), nil
+	case "last-index-of":
+		return glisp.SexpInt(strings.LastIndex(str, sub)), nil
+	case "trim-prefix":
+		return glisp.SexpStr(strings.TrimPrefix(str, sub)), nil
+	case "trim-suffix":
+		return glisp.SexpStr(strings.TrimSuffix(str, sub)), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+// SplitFunction implements (split str sep) and (split str sep n), which
+// gives at most n pieces.
+func SplitFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	strs, err := stringArgs(name, args[:2], 2)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	n := -1
+	if len(args) == 3 {
+		if n, err = intArg(name, args, 2); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
+	pieces := strings.SplitN(strs[0], strs[1], n)
+	arr := make([]glisp.Sexp, len(pieces))
+	for i, piece := range pieces {
+		arr[i] = glisp.SexpStr(piece)
+	}
+	return glisp.SexpArray(arr), nil
+}
+
+// JoinFunction joins the items of an array or list, with an optional
+// separator. Items that aren't strings are shown as str would.
+func JoinFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	var items []glisp.Sexp
+	switch t := args[0].(type) {
+	case glisp.SexpArray:
+		items = t
+	default:
+		var err error
+		if items, err = glisp.ListToArray(args[0]); err != nil {
+			return glisp.SexpNull,
+				errors.New("argument 1 of join must be an array or list")
+		}
+	}
+	sep := ""
+	if len(args) == 2 {
+		var err error
+		if sep, err = stringArg(name, args, 1); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
+	strs := make([]string, len(items))
+	size := 0
+	for i, item := range items {
+		strs[i] = displayString(item)
+		size += len(strs[i])
+		if i > 0 {
+			size += len(sep)
+		}
+		if err := env.CheckCollectionSize(size); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+	return glisp.SexpStr(strings.Join(strs, sep)), nil
+}
+
+// ReplaceFunction implements (replace str old new) and
+// (replace str old new n), which replaces only the first n.
+func ReplaceFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 3 || len(args) > 4 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	strs, err := stringArgs(name, args[:3], 3)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	n := -1
+	if len(args) == 4 {
+		if n, err = intArg(name, args, 3); err != nil {
+			return glisp.SexpNull, err
+		}
+	}
+
+	count := strings.Count(strs[0], strs[1])
+	if n >= 0 && n < count {
+		count = n
+	}
+	size := len(strs[0]) + count*(len(strs[2])-len(strs[1]))
+	if err := env.CheckCollectionSize(size); err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpStr(strings.Replace(strs[0], strs[1], strs[2], n)), nil
+}
+
+// checkRepeat fails if n copies of a string of the given length in bytes,
+// plus extra bytes, would be larger than env allows.
+func checkRepeat(env *glisp.Glisp, length int, n int, extra int) error {
+	if length > 0 && n > (math.MaxInt-extra)/length {
+		return errors.New("repeated string too long")
+	}
+	return env.CheckCollectionSize(length*n + extra)
+}
+
+// RepeatFunction implements (repeat str n).
+func RepeatFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	str, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	n, err := intArg(name, args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	if n < 0 {
+		return glisp.SexpNull, errors.New("repeat count must not be negative")
+	}
+	if err := checkRepeat(env, len(str), n, 0); err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpStr(strings.Repeat(str, n)), nil
+}
+
+// PadFunction implements (pad-left str width) and (pad-right str width),
+// which pad with spaces, or with the char or string given as a third
+// argument, until str is width chars long.
+func PadFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	str, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	width, err := intArg(name, args, 1)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	pad := " "
+	if len(args) == 3 {
+		if pad, err = stringArg(name, args, 2); err != nil {
+			return glisp.SexpNull, err
+		}
+		if pad == "" {
+			return glisp.SexpNull, errors.New("padding must not be empty")
+		}
+	}
+
+	missing := width - utf8.RuneCountInString(str)
+	if missing <= 0 {
+		return glisp.SexpStr(str), nil
+	}
+	// whole copies of pad, then as much of it as still fits
+	padlen := utf8.RuneCountInString(pad)
+	tail := string([]rune(pad)[:missing%padlen])
+	err = checkRepeat(env, len(pad), missing/padlen, len(str)+len(tail))
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	padding := strings.Repeat(pad, missing/padlen) + tail
+	if name == "pad-left" {
+		return glisp.SexpStr(padding + str), nil
+	}
+	return glisp.SexpStr(str + padding), nil
+}
+
+// formatArg lets fmt format glisp values, choosing a Go value that
+// suits the verb. %s shows any value as join would, and decimals given a precision with %f are rounded exactly,
+// half to even.
+type formatArg struct {
+	expr glisp.Sexp
+}
+
+func isFloatVerb(verb rune) bool {
+	return strings.ContainsRune("eEfFgG", verb)
+}
+
+func (a formatArg) Format(f fmt.State, verb rune) {
+	spec := fmt.FormatString(f, verb)
+	if verb == 's' {
+		fmt.Fprintf(f, spec, displayString(a.expr))
+		return
+	}
+
+	var value interface{}
+
+	switch t := a.expr.(type) {
+	case glisp.SexpInt:
+		value = int64(t)
+		if isFloatVerb(verb) {
+			value = float64(t)
+		}
+	case glisp.SexpChar:
+		switch verb {
+		case 'c', 'q', 'U':
+			value = rune(t)
+		case 'v':
+			value = string(t)
+		default:
+			value = int64(t)
+		}
+	case glisp.SexpFloat:
+		value = float64(t)
+	case glisp.SexpBigInt:
+		value = t.BigInt()
+		if isFloatVerb(verb) {
+			value = new(big.Float).SetInt(t.BigInt())
+		}
+	case glisp.SexpRatio:
+		value = t.SexpString()
+		if isFloatVerb(verb) {
+			value = new(big.Float).SetPrec(256).SetRat(t.Rat())
+		}
+	case glisp.SexpDecimal:
+		value = t.String()
+		if verb == 'f' || verb == 'F' {
+			if prec, ok := f.Precision(); ok {
+				t = glisp.RoundRat(t.Rat(), prec, glisp.RoundHalfEven)
+			}
+			str := t.String()
+			if f.Flag('+') && !strings.HasPrefix(str, "-") {
+				str = "+" + str
+			}
+			if width, ok := f.Width(); ok && f.Flag('-') {
+				str = fmt.Sprintf("%-*s", width, str)
+			} else if ok {
+				str = fmt.Sprintf("%*s", width, str)
+			}
+			fmt.Fprint(f, str)
+			return
+		} else if isFloatVerb(verb) {
+			value = new(big.Float).SetPrec(256).SetRat(t.Rat())
+		}
+	case glisp.SexpStr:
+		value = string(t)
+	case glisp.SexpBool:
+		value = bool(t)
+	default:
+		value = a.expr.SexpString()
+	}
+	fmt.Fprintf(f, spec, value)
+}
+
+// FormatFunction implements (format fmt args...) with the directives of
+// Go's fmt package.
+func FormatFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	format, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	values := make([]interface{}, len(args)-1)
+	for i, arg := range args[1:] {
+		values[i] = formatArg{arg}
+	}
+	// fmt caps widths and precisions, so the string can only be checked
+	// once it is built
+	str := fmt.Sprintf(format, values...)
+	if err := env.CheckCollectionSize(len(str)); err != nil {
+		return glisp.SexpNull, err
+	}
+	return glisp.SexpStr(str), nil
+}
+
+func radixArg(name string, args []glisp.Sexp) (int, error) {
+	if len(args) < 2 {
+		return 10, nil
+	}
+	radix, err := intArg(name, args, 1)
+	if err != nil {
+		return 0, err
+	}
+	if radix < 2 || radix > 36 {
+		return 0, fmt.Errorf("radix must be between 2 and 36, not %d", radix)
+	}
+	return radix, nil
+}
+
+// StringToNumberFunction implements (string->number str) and
+// (string->number str radix). Base ten strings may be written as any
+// kind of number literal; other radixes only allow integers.
+func StringToNumberFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	str, err := stringArg(name, args, 0)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+	radix, err := radixArg(name, args)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	invalid := fmt.Errorf("invalid number %q", str)
+	if i, ok := new(big.Int).SetString(str, radix); ok {
+		return glisp.MakeBigInt(i), nil
+	}
+	if radix != 10 {
+		return glisp.SexpNull, invalid
+	}
+	if strings.HasSuffix(str, "M") {
+		d, err := glisp.ParseDecimal(str[:len(str)-1])
+		if err != nil {
+			return glisp.SexpNull, invalid
+		}
+		return d, nil
+	}
+	if strings.Contains(str, "/") {
+		r, ok := new(big.Rat).SetString(str)
+		if !ok {
+			return glisp.SexpNull, invalid
+		}
+		return glisp.MakeRatio(r), nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return glisp.SexpNull, invalid
+	}
+	return glisp.SexpFloat(f), nil
+}
+
+// NumberToStringFunction implements (number->string n) and
+// (number->string n radix), where only integers may have a radix other
+// than ten.
+func NumberToStringFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if !glisp.IsNumber(args[0]) {
+		return glisp.SexpNull,
+			fmt.Errorf("argument 1 of %s must be a number", name)
+	}
+	radix, err := radixArg(name, args)
+	if err != nil {
+		return glisp.SexpNull, err
+	}
+
+	if i, ok := glisp.ToBigInt(args[0]); ok {
+		return glisp.SexpStr(i.Text(radix)), nil
+	}
+	if radix != 10 {
+		return glisp.SexpNull,
+			fmt.Errorf("only integers can be shown in radix %d", radix)
+	}
+	return glisp.SexpStr(displayString(args[0])), nil
+}
+
+// RuneFunction converts between strings, chars and their code points or
+// bytes.
+func RuneFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	switch name {
+	case "char->int":
+		if c, ok := args[0].(glisp.SexpChar); ok {
+			return glisp.SexpInt(c), nil
+		}
+		return glisp.SexpNull, errors.New("argument of char->int must be a char")
+	case "int->char":
+		if i, ok := args[0].(glisp.SexpInt); ok {
+			return glisp.SexpChar(i), nil
+		}
+		return glisp.SexpNull, errors.New("argument of int->char must be an int")
+	case "rune-count":
+		str, err := stringArg(name, args, 0)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		return glisp.SexpInt(utf8.RuneCountInString(str)), nil
+	case "string->runes", "string->bytes":
+		str, err := stringArg(name, args, 0)
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		var arr []glisp.Sexp
+		if name == "string->runes" {
+			for _, r := range str {
+				arr = append(arr, glisp.SexpChar(r))
+			}
+		} else {
+			for _, b := range []byte(str) {
+				arr = append(arr, glisp.SexpInt(b))
+			}
+		}
+		return glisp.SexpArray(arr), nil
+	case "runes->string", "bytes->string":
+		items, ok := args[0].(glisp.SexpArray)
+		if !ok {
+			return glisp.SexpNull,
+				fmt.Errorf("argument of %s must be an array", name)
+		}
+		buf := make([]byte, 0, len(items))
+		for _, item := range items {
+			var n int
+			switch t := item.(type) {
+			case glisp.SexpChar:
+				n = int(t)
+			case glisp.SexpInt:
+				n = int(t)
+			default:
+				return glisp.SexpNull,
+					fmt.Errorf("%s needs chars or ints", name)
+			}
+			if name == "runes->string" {
+				buf = utf8.AppendRune(buf, rune(n))
+			} else if n < 0 || n > 255 {
+				return glisp.SexpNull, fmt.Errorf("%d is not a byte", n)
+			} else {
+				buf = append(buf, byte(n))
+			}
+		}
+		return glisp.SexpStr(buf), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+// SexpBuilder builds up a string piece by piece without copying it each
+// time, as repeated concat would.
+type SexpBuilder struct {
+	builder *strings.Builder
+}
+
+func (b SexpBuilder) SexpString() string {
+	return "[string-builder]"
+}
+
+func MakeBuilderFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	builder := SexpBuilder{&strings.Builder{}}
+	if err := builder.append(env, args); err != nil {
+		return glisp.SexpNull, err
+	}
+	return builder, nil
+}
+
+// append writes each of args to the builder as join would, failing
+// before the builder grows larger than env allows.
+func (b SexpBuilder) append(env *glisp.Glisp, args []glisp.Sexp) error {
+	for _, arg := range args {
+		str := displayString(arg)
+		if err := env.CheckCollectionSize(b.builder.Len() + len(str)); err != nil {
+			return err
+		}
+		b.builder.WriteString(str)
+	}
+	return nil
+}
+
+// BuilderFunction implements (builder-append! b args...), which appends
+// each of args as join would and returns b, (builder-string b) and
+// (builder-len b), which is in bytes.
+func BuilderFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	b, ok := args[0].(SexpBuilder)
+	if !ok {
+		return glisp.SexpNull,
+			fmt.Errorf("argument 1 of %s must be a string builder", name)
+	}
+
+	switch name {
+	case "builder-append!":
+		if err := b.append(env, args[1:]); err != nil {
+			return glisp.SexpNull, err
+		}
+		return b, nil
+	case "builder-string":
+		if len(args) != 1 {
+			return glisp.SexpNull, glisp.WrongNargs
+		}
+		return glisp.SexpStr(b.builder.String()), nil
+	case "builder-len":
+		if len(args) != 1 {
+			return glisp.SexpNull, glisp.WrongNargs
+		}
+		return glisp.SexpInt(b.builder.Len()), nil
+	}
+	return glisp.SexpNull, errors.New("unknown function")
+}
+
+func ImportStrings(env *glisp.Glisp) {
+	for _, name := range []string{"upper", "lower",
+		"trim", "trim-left", "trim-right"} {
+		env.AddFunction(name, StringTransformFunction)
+	}
+	for _, name := range []string{"contains?", "starts-with?",
+		"ends-with?", "index-of", "last-index-of",
+		"trim-prefix", "trim-suffix"} {
+		env.AddFunction(name, StringSearchFunction)
+	}
+	env.AddFunction("split", SplitFunction)
+	env.AddFunction("join", JoinFunction)
+	env.AddFunction("replace", ReplaceFunction)
+	env.AddFunction("repeat", RepeatFunction)
+	env.AddFunction("pad-left", PadFunction)
+	env.AddFunction("pad-right", PadFunction)
+	env.AddFunction("format", FormatFunction)
+	env.AddFunction("string->number", StringToNumberFunction)
+	env.AddFunction("number->string", NumberToStringFunction)
+	for _, name := range []string{"char->int", "int->char", "rune-count",
+		"string->runes", "string->bytes",
+		"runes->string", "bytes->string"} {
+		env.AddFunction(name, RuneFunction)
+	}
+	env.AddFunction("make-builder", MakeBuilderFunction)
+	env.AddFunction("builder-append!", BuilderFunction)
+	env.AddFunction("builder-string", BuilderFunction)
+	env.AddFunction("builder-len", BuilderFunction)
+}
@@ -49,9 +49,9 @@ func TimeitFunction(env *glisp.Glisp, name string,
 		}
 	}
 
-	fmt.Printf("ran %d iterations in %f seconds\n",
+	fmt.Fprintf(env.Stdout(), "ran %d iterations in %f seconds\n",
 		iterations, elapsed.Seconds())
-	fmt.Printf("average %f seconds per run\n",
+	fmt.Fprintf(env.Stdout(), "average %f seconds per run\n",
 		elapsed.Seconds()/float64(iterations))
 
 	return glisp.SexpNull, nil
@@ -0,0 +1,356 @@
+// Package glisptest runs glisp scripts as tests. Scripts can define named
+// tests with deftest and check values with is, and the results are
+// reported either through the testing package or as plain values.
+package glisptest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+// Failure describes an is assertion that did not hold.
+type Failure struct {
+	Form     string
+	Message  string
+	Expected string // set when the form was (= expected actual)
+	Actual   string
+	Position *glisp.Position
+}
+
+func (f Failure) String() string {
+	str := "(is " + f.Form + ") failed"
+	if f.Position != nil {
+		str = f.Position.String() + ": " + str
+	}
+	if f.Message != "" {
+		str += ": " + f.Message
+	}
+	if f.Expected != "" {
+		str += "\n  expected: " + f.Expected
+	}
+	str += "\n    actual: " + f.Actual
+	return str
+}
+
+// TestResult is the outcome of running one deftest.
+type TestResult struct {
+	Name     string
+	Failures []Failure
+	Err      error
+	Trace    string // stack trace for Err
+}
+
+func (r TestResult) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+// FileResult is the outcome of running one script and its tests.
+type FileResult struct {
+	File     string
+	Err      error     // from loading or running the script itself
+	Trace    string    // stack trace for Err, if it happened at run time
+	Failures []Failure // from is forms outside any deftest
+	Tests    []TestResult
+}
+
+func (r FileResult) Passed() bool {
+	if r.Err != nil || len(r.Failures) > 0 {
+		return false
+	}
+	for _, test := range r.Tests {
+		if !test.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Suite collects the tests a script defines and the failed assertions
+// reported while it runs.
+type Suite struct {
+	mu       sync.Mutex
+	tests    []test
+	current  *TestResult
+	toplevel []Failure
+}
+
+type test struct {
+	name string
+	fun  glisp.SexpFunction
+}
+
+// comparisons whose operands is reports as expected and actual values
+var comparisons = map[string]bool{
+	"=": true, "not=": true, "<": true, ">": true, "<=": true, ">=": true,
+}
+
+// Import adds deftest and is to env, returning the suite they report to.
+func Import(env *glisp.Glisp) *Suite {
+	suite := &Suite{}
+	env.AddMacro("deftest", DeftestMacro)
+	env.AddMacro("is", IsMacro)
+	env.AddFunction("__deftest", suite.deftestFunction)
+	env.AddFunction("__is", suite.isFunction)
+	return suite
+}
+
+// (deftest name body...) => (__deftest (quote name) (fn [] body...))
+func DeftestMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	if !glisp.IsSymbol(args[0]) {
+		return glisp.SexpNull, errors.New("test name must be a symbol")
+	}
+
+	fn := append([]glisp.Sexp{env.MakeSymbol("fn"), glisp.SexpArray{}},
+		args[1:]...)
+	return glisp.MakeList([]glisp.Sexp{
+		env.MakeSymbol("__deftest"),
+		quote(env, args[0]),
+		glisp.MakeList(fn),
+	}), nil
+}
+
+// (is form message?) checks that form is true. If form is a comparison
+// like (= expected actual) or (< a b), the values of its operands are
+// reported when it fails.
+func IsMacro(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	form := args[0]
+	var message glisp.Sexp = glisp.SexpNull
+	if len(args) == 2 {
+		message = args[1]
+	}
+
+	call := []glisp.Sexp{env.MakeSymbol("__is"), quote(env, form), message}
+	items, err := glisp.ListToArray(form)
+	if err == nil && len(items) == 3 && glisp.IsSymbol(items[0]) &&
+		comparisons[items[0].(glisp.SexpSymbol).Name()] {
+		call = append(call, items...)
+	} else {
+		call = append(call, form)
+	}
+	return glisp.MakeList(call), nil
+}
+
+// comparisonName returns the name of the comparison in a form that
+// IsMacro passed the operands of.
+func comparisonName(form glisp.Sexp) string {
+	items, err := glisp.ListToArray(form)
+	if err != nil || len(items) == 0 {
+		return ""
+	}
+	return items[0].SexpString()
+}
+
+func quote(env *glisp.Glisp, expr glisp.Sexp) glisp.Sexp {
+	return glisp.MakeList([]glisp.Sexp{env.MakeSymbol("quote"), expr})
+}
+
+func (suite *Suite) deftestFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 2 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+	fun, ok := args[1].(glisp.SexpFunction)
+	if !ok {
+		return glisp.SexpNull, errors.New("test body must be a function")
+	}
+
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	suite.tests = append(suite.tests, test{args[0].SexpString(), fun})
+	return glisp.SexpNull, nil
+}
+
+// __is takes the quoted form and message, followed by either the form's
+// value or the comparison function and its two operands.
+func (suite *Suite) isFunction(env *glisp.Glisp, name string,
+	args []glisp.Sexp) (glisp.Sexp, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return glisp.SexpNull, glisp.WrongNargs
+	}
+
+	failure := Failure{
+		Form:     args[0].SexpString(),
+		Position: glisp.SexpPosition(args[0]),
+	}
+	switch msg := args[1].(type) {
+	case glisp.SexpStr:
+		failure.Message = string(msg)
+	default:
+		if msg != glisp.SexpNull {
+			failure.Message = msg.SexpString()
+		}
+	}
+
+	if len(args) == 3 {
+		if glisp.IsTruthy(args[2]) {
+			return glisp.SexpBool(true), nil
+		}
+		failure.Actual = args[2].SexpString()
+	} else {
+		compare, ok := args[2].(glisp.SexpFunction)
+		if !ok {
+			return glisp.SexpNull, errors.New("not a function")
+		}
+		result, err := env.Apply(compare, args[3:])
+		if err != nil {
+			return glisp.SexpNull, err
+		}
+		if glisp.IsTruthy(result) {
+			return glisp.SexpBool(true), nil
+		}
+		a, b := args[3].SexpString(), args[4].SexpString()
+		if op := comparisonName(args[0]); op == "=" {
+			failure.Expected, failure.Actual = a, b
+		} else {
+			// only = has an expected value, so show what was compared
+			failure.Actual = "(" + op + " " + a + " " + b + ")"
+		}
+	}
+
+	suite.mu.Lock()
+	defer suite.mu.Unlock()
+	if suite.current != nil {
+		suite.current.Failures = append(suite.current.Failures, failure)
+	} else {
+		suite.toplevel = append(suite.toplevel, failure)
+	}
+	return glisp.SexpBool(false), nil
+}
+
+// RunFile runs the script at path in an environment made by newEnv, or
+// by glisp.NewGlisp if newEnv is nil, and then each test it defined.
+func RunFile(path string, newEnv func() *glisp.Glisp) FileResult {
+	if newEnv == nil {
+		newEnv = glisp.NewGlisp
+	}
+	env := newEnv()
+	suite := Import(env)
+	result := FileResult{File: path}
+
+	file, err := os.Open(path)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer file.Close()
+
+	if err = env.LoadFile(file); err != nil {
+		result.Err = err
+		return result
+	}
+	_, err = env.Run()
+
+	suite.mu.Lock()
+	result.Failures = suite.toplevel
+	tests := suite.tests
+	suite.mu.Unlock()
+
+	if err != nil {
+		result.Err = err
+		result.Trace = env.GetStackTrace(err)
+		return result
+	}
+
+	for _, test := range tests {
+		testresult := TestResult{Name: test.name}
+		suite.mu.Lock()
+		suite.current = &testresult
+		suite.mu.Unlock()
+
+		_, err = env.Apply(test.fun, nil)
+		if err != nil {
+			testresult.Err = err
+			testresult.Trace = env.GetStackTrace(err)
+			env.Clear()
+		}
+
+		suite.mu.Lock()
+		suite.current = nil
+		result.Tests = append(result.Tests, testresult)
+		suite.mu.Unlock()
+	}
+	return result
+}
+
+// Scripts lists the .glisp files in dir in name order.
+func Scripts(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.glisp"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no glisp scripts in %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// RunDir runs every script in dir with RunFile.
+func RunDir(dir string, newEnv func() *glisp.Glisp) ([]FileResult, error) {
+	files, err := Scripts(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]FileResult, len(files))
+	for i, path := range files {
+		results[i] = RunFile(path, newEnv)
+	}
+	return results, nil
+}
+
+// Test runs every script in dir as a subtest of t, with each deftest as
+// a subtest of its script.
+func Test(t *testing.T, dir string, newEnv func() *glisp.Glisp) {
+	files, err := Scripts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range files {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".glisp")
+		t.Run(name, func(t *testing.T) {
+			result := RunFile(path, newEnv)
+			for _, failure := range result.Failures {
+				t.Error(failure)
+			}
+			if result.Err != nil {
+				t.Fatal(errorReport(result.Err, result.Trace))
+			}
+			for _, test := range result.Tests {
+				test := test
+				t.Run(test.Name, func(t *testing.T) {
+					for _, failure := range test.Failures {
+						t.Error(failure)
+					}
+					if test.Err != nil {
+						t.Error(errorReport(test.Err, test.Trace))
+					}
+				})
+			}
+		})
+	}
+}
+
+func errorReport(err error, trace string) string {
+	if trace != "" {
+		return strings.TrimSuffix(trace, "\n")
+	}
+	return err.Error()
+}
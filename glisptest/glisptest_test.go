@@ -0,0 +1,76 @@
+package glisptest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunFileFailures(t *testing.T) {
+	result := RunFile("testdata/failing.glisp", nil)
+	if result.Passed() {
+		t.Fatal("the failing script passed")
+	}
+	if result.Err != nil {
+		t.Fatalf("the script itself failed: %v", result.Err)
+	}
+
+	check := func(failure Failure, form string, line int,
+		expected string, actual string) {
+		t.Helper()
+		if failure.Form != form || failure.Expected != expected ||
+			failure.Actual != actual {
+			t.Errorf("got %+v, want %s with expected %q and actual %q",
+				failure, form, expected, actual)
+		}
+		pos := failure.Position
+		if pos == nil || pos.File != "testdata/failing.glisp" ||
+			pos.Line != line {
+			t.Errorf("%s: got position %v, want line %d", form, pos, line)
+		}
+	}
+
+	if len(result.Failures) != 1 {
+		t.Fatalf("got %d top-level failures, want 1", len(result.Failures))
+	}
+	check(result.Failures[0], "(= (quote a) (quote b))", 14, "a", "b")
+
+	if len(result.Tests) != 3 {
+		t.Fatalf("got %d tests, want 3", len(result.Tests))
+	}
+	passing, failing, erroring := result.Tests[0], result.Tests[1],
+		result.Tests[2]
+
+	if passing.Name != "passing" || !passing.Passed() {
+		t.Errorf("passing: got %+v", passing)
+	}
+
+	if failing.Name != "failing" || failing.Err != nil ||
+		len(failing.Failures) != 3 {
+		t.Fatalf("failing: got %+v", failing)
+	}
+	check(failing.Failures[0], "(= 2 (+ 1 2))", 7, "2", "3")
+	if failing.Failures[0].Message != "sums" {
+		t.Errorf("got message %q, want sums", failing.Failures[0].Message)
+	}
+	// only = has an expected value
+	check(failing.Failures[1], "(< 5 1)", 8, "", "(< 5 1)")
+	check(failing.Failures[2], "(empty? [1])", 9, "", "false")
+
+	if erroring.Name != "erroring" || erroring.Err == nil ||
+		len(erroring.Failures) != 0 {
+		t.Fatalf("erroring: got %+v", erroring)
+	}
+	if !strings.Contains(erroring.Trace, "testdata/failing.glisp:12:3") {
+		t.Errorf("erroring: trace has no position:\n%s", erroring.Trace)
+	}
+}
+
+func TestFailureString(t *testing.T) {
+	result := RunFile("testdata/failing.glisp", nil)
+	want := "testdata/failing.glisp:7:7: (is (= 2 (+ 1 2))) failed: sums\n" +
+		"  expected: 2\n" +
+		"    actual: 3"
+	if got := result.Tests[1].Failures[0].String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,135 @@
+package glisp
+
+import (
+	"math/big"
+)
+
+// SexpBigInt is an integer too large for SexpInt. Arithmetic promotes to
+// it on overflow, and results that fit are demoted back to SexpInt, so
+// any value held in a SexpBigInt is out of SexpInt's range.
+type SexpBigInt struct {
+	v *big.Int
+}
+
+// SexpRatio is an exact fraction, produced by dividing integers that
+// don't divide evenly. It is always in lowest terms with a denominator
+// other than one.
+type SexpRatio struct {
+	v *big.Rat
+}
+
+func (b SexpBigInt) SexpString() string {
+	return b.v.String()
+}
+
+func (r SexpRatio) SexpString() string {
+	return r.v.RatString()
+}
+
+// BigInt returns a copy of the value.
+func (b SexpBigInt) BigInt() *big.Int {
+	return new(big.Int).Set(b.v)
+}
+
+// Rat returns a copy of the value.
+func (r SexpRatio) Rat() *big.Rat {
+	return new(big.Rat).Set(r.v)
+}
+
+const maxInt = SexpInt(^uint(0) >> 1)
+const minInt = -maxInt - 1
+
+var minSexpInt = big.NewInt(int64(minInt))
+var maxSexpInt = big.NewInt(int64(maxInt))
+
+// MakeBigInt returns i as a SexpInt if it fits, or as a SexpBigInt.
+func MakeBigInt(i *big.Int) Sexp {
+	if i.Cmp(minSexpInt) >= 0 && i.Cmp(maxSexpInt) <= 0 {
+		return SexpInt(i.Int64())
+	}
+	return SexpBigInt{new(big.Int).Set(i)}
+}
+
+// MakeRatio returns r as an integer if its denominator is one, or as a
+// SexpRatio.
+func MakeRatio(r *big.Rat) Sexp {
+	if r.IsInt() {
+		return MakeBigInt(r.Num())
+	}
+	return SexpRatio{new(big.Rat).Set(r)}
+}
+
+// ToBigInt converts an integer value to a big.Int, which must not be
+// modified.
+func ToBigInt(expr Sexp) (*big.Int, bool) {
+	switch e := expr.(type) {
+	case SexpInt:
+		return big.NewInt(int64(e)), true
+	case SexpChar:
+		return big.NewInt(int64(e)), true
+	case SexpBigInt:
+		return e.v, true
+	}
+	return nil, false
+}
+
+// ToRat converts an exact number to a big.Rat, which must not be
+// modified.
+func ToRat(expr Sexp) (*big.Rat, bool) {
+	switch e := expr.(type) {
+	case SexpRatio:
+		return e.v, true
+	case SexpDecimal:
+		return e.Rat(), true
+	}
+	if i, ok := ToBigInt(expr); ok {
+		return new(big.Rat).SetInt(i), true
+	}
+	return nil, false
+}
+
+// ToFloat converts any number to a SexpFloat.
+func ToFloat(expr Sexp) (SexpFloat, bool) {
+	switch e := expr.(type) {
+	case SexpFloat:
+		return e, true
+	case SexpInt:
+		return SexpFloat(e), true
+	case SexpChar:
+		return SexpFloat(e), true
+	case SexpBigInt:
+		f, _ := new(big.Float).SetInt(e.v).Float64()
+		return SexpFloat(f), true
+	case SexpRatio:
+		f, _ := e.v.Float64()
+		return SexpFloat(f), true
+	case SexpDecimal:
+		f, _ := e.Rat().Float64()
+		return SexpFloat(f), true
+	}
+	return 0, false
+}
+
+// overflow-checked SexpInt arithmetic, reporting false if the result
+// doesn't fit
+
+func addInt(a, b SexpInt) (SexpInt, bool) {
+	c := a + b
+	return c, (a^c)&(b^c) >= 0
+}
+
+func subInt(a, b SexpInt) (SexpInt, bool) {
+	c := a - b
+	return c, (a^b)&(a^c) >= 0
+}
+
+func mulInt(a, b SexpInt) (SexpInt, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if (a == -1 && b == minInt) || (b == -1 && a == minInt) || c/b != a {
+		return c, false
+	}
+	return c, true
+}
@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
 )
 
 func signumFloat(f SexpFloat) int {
@@ -16,6 +20,18 @@ func signumFloat(f SexpFloat) int {
 	return 0
 }
 
+// compareFloats compares two floats. NaN is unequal to every number,
+// itself included, and orders after all of them.
+func compareFloats(a, b SexpFloat) int {
+	if math.IsNaN(float64(a)) {
+		return 1
+	}
+	if math.IsNaN(float64(b)) {
+		return -1
+	}
+	return signumFloat(a - b)
+}
+
 func signumInt(i SexpInt) int {
 	if i > 0 {
 		return 1
@@ -26,14 +42,22 @@ func signumInt(i SexpInt) int {
 	return 0
 }
 
+func compareInts(a, b SexpInt) int {
+	if a > b {
+		return 1
+	}
+	if a < b {
+		return -1
+	}
+	return 0
+}
+
 func compareFloat(f SexpFloat, expr Sexp) (int, error) {
 	switch e := expr.(type) {
-	case SexpInt:
-		return signumFloat(f - SexpFloat(e)), nil
 	case SexpFloat:
-		return signumFloat(f - e), nil
-	case SexpChar:
-		return signumFloat(f - SexpFloat(e)), nil
+		return compareFloats(f, e), nil
+	case SexpInt, SexpChar, SexpBigInt, SexpRatio, SexpDecimal:
+		return -compareWithFloat(expr, f), nil
 	}
 	errmsg := fmt.Sprintf("cannot compare %T to %T", f, expr)
 	return 0, errors.New(errmsg)
@@ -42,11 +66,13 @@ func compareFloat(f SexpFloat, expr Sexp) (int, error) {
 func compareInt(i SexpInt, expr Sexp) (int, error) {
 	switch e := expr.(type) {
 	case SexpInt:
-		return signumInt(i - e), nil
+		return compareInts(i, e), nil
 	case SexpFloat:
-		return signumFloat(SexpFloat(i) - e), nil
+		return compareWithFloat(i, e), nil
 	case SexpChar:
-		return signumInt(i - SexpInt(e)), nil
+		return compareInts(i, SexpInt(e)), nil
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return compareExact(i, expr)
 	}
 	errmsg := fmt.Sprintf("cannot compare %T to %T", i, expr)
 	return 0, errors.New(errmsg)
@@ -55,16 +81,55 @@ func compareInt(i SexpInt, expr Sexp) (int, error) {
 func compareChar(c SexpChar, expr Sexp) (int, error) {
 	switch e := expr.(type) {
 	case SexpInt:
-		return signumInt(SexpInt(c) - e), nil
+		return compareInts(SexpInt(c), e), nil
 	case SexpFloat:
-		return signumFloat(SexpFloat(c) - e), nil
+		return compareWithFloat(c, e), nil
 	case SexpChar:
 		return signumInt(SexpInt(c - e)), nil
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return compareExact(c, expr)
 	}
 	errmsg := fmt.Sprintf("cannot compare %T to %T", c, expr)
 	return 0, errors.New(errmsg)
 }
 
+// compareExact compares numbers when either is a big integer, ratio or
+// decimal.
+func compareExact(a Sexp, b Sexp) (int, error) {
+	if fb, ok := b.(SexpFloat); ok {
+		return compareWithFloat(a, fb), nil
+	}
+	ra, aok := ToRat(a)
+	rb, bok := ToRat(b)
+	if !aok || !bok {
+		errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
+		return 0, errors.New(errmsg)
+	}
+	return ra.Cmp(rb), nil
+}
+
+// compareWithFloat compares an exact number with a float without
+// rounding the exact number, so that equality stays transitive. Only
+// integers that convert to a float and back unchanged are compared as
+// floats, other numbers are compared with the float as a ratio, which
+// finite floats convert to exactly.
+func compareWithFloat(a Sexp, f SexpFloat) int {
+	fa, _ := ToFloat(a)
+	if math.IsInf(float64(f), 0) || math.IsNaN(float64(f)) {
+		return compareFloats(fa, f)
+	}
+	switch i := a.(type) {
+	case SexpInt:
+		if i > -1<<53 && i < 1<<53 {
+			return signumFloat(fa - f)
+		}
+	case SexpChar:
+		return signumFloat(fa - f)
+	}
+	ra, _ := ToRat(a)
+	return ra.Cmp(new(big.Rat).SetFloat64(float64(f)))
+}
+
 func compareString(s SexpStr, expr Sexp) (int, error) {
 	switch e := expr.(type) {
 	case SexpStr:
@@ -83,30 +148,42 @@ func compareSymbol(sym SexpSymbol, expr Sexp) (int, error) {
 	return 0, errors.New(errmsg)
 }
 
-func comparePair(a SexpPair, b Sexp) (int, error) {
-	var bp SexpPair
-	switch t := b.(type) {
-	case SexpPair:
-		bp = t
-	default:
-		errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
-		return 0, errors.New(errmsg)
-	}
-	res, err := Compare(a.head, bp.head)
-	if err != nil {
-		return 0, err
-	}
-	if res != 0 {
-		return res, nil
+// comparePair compares lists head by head, looping down their tails so
+// long lists don't count as deeply nested.
+func comparePair(a SexpPair, b Sexp, depth int) (int, error) {
+	for {
+		var bp SexpPair
+		switch t := b.(type) {
+		case SexpPair:
+			bp = t
+		default:
+			errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
+			return 0, errors.New(errmsg)
+		}
+		res, err := compare(a.head, bp.head, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if res != 0 {
+			return res, nil
+		}
+		next, ok := a.tail.(SexpPair)
+		if !ok {
+			return compare(a.tail, bp.tail, depth+1)
+		}
+		a, b = next, bp.tail
 	}
-	return Compare(a.tail, bp.tail)
 }
 
-func compareArray(a SexpArray, b Sexp) (int, error) {
+// compareArray compares arrays and vectors element by element, so an
+// array and a vector with the same elements are equal.
+func compareArray(a SexpArray, b Sexp, depth int) (int, error) {
 	var ba SexpArray
 	switch t := b.(type) {
 	case SexpArray:
 		ba = t
+	case SexpVector:
+		ba = t.Slice()
 	default:
 		errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
 		return 0, errors.New(errmsg)
@@ -119,7 +196,7 @@ func compareArray(a SexpArray, b Sexp) (int, error) {
 	}
 
 	for i := 0; i < length; i++ {
-		res, err := Compare(a[i], ba[i])
+		res, err := compare(a[i], ba[i], depth+1)
 		if err != nil {
 			return 0, err
 		}
@@ -131,6 +208,91 @@ func compareArray(a SexpArray, b Sexp) (int, error) {
 	return signumInt(SexpInt(len(a) - len(ba))), nil
 }
 
+// compareMaps compares hashes and maps, which are equal if they have the
+// same entries, and a hash and a map may be equal too. Having no order,
+// unequal ones compare by size, or as greater if the same size.
+func compareMaps(a Sexp, b Sexp, depth int) (int, error) {
+	if sameHash(a, b) {
+		return 0, nil
+	}
+	apairs, _ := mapPairs(a)
+	bpairs, ok := mapPairs(b)
+	if !ok || typeTag(a) != typeTag(b) {
+		errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
+		return 0, errors.New(errmsg)
+	}
+	if len(apairs) != len(bpairs) {
+		return signumInt(SexpInt(len(apairs) - len(bpairs))), nil
+	}
+	for _, pair := range apairs {
+		val, found, err := mapLookup(b, pair.head)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 1, nil
+		}
+		res, err := compare(pair.tail, val, depth+1)
+		if err != nil || res != 0 {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+// sameHash reports whether a and b are the same hash, which may hold
+// itself and so can't be compared entry by entry.
+func sameHash(a Sexp, b Sexp) bool {
+	ha, ok := a.(SexpHash)
+	hb, okb := b.(SexpHash)
+	return ok && okb && reflect.ValueOf(ha.Map).Pointer() ==
+		reflect.ValueOf(hb.Map).Pointer()
+}
+
+// typeTag is the type name of a hash, so records of different types are
+// never equal, and "hash" for a map.
+func typeTag(expr Sexp) string {
+	if hash, ok := expr.(SexpHash); ok && hash.TypeName != nil {
+		return *hash.TypeName
+	}
+	return "hash"
+}
+
+func mapLookup(expr Sexp, key Sexp) (Sexp, bool, error) {
+	switch e := expr.(type) {
+	case SexpHash:
+		val, err := e.HashGetDefault(key, SexpEnd)
+		return val, val != SexpEnd, err
+	case SexpMap:
+		return e.Get(key)
+	}
+	return SexpNull, false, nil
+}
+
+// compareFunction finds functions equal only to themselves, or a copy of
+// the same closure.
+func compareFunction(a SexpFunction, b Sexp) (int, error) {
+	bf, ok := b.(SexpFunction)
+	if !ok {
+		errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
+		return 0, errors.New(errmsg)
+	}
+	if a.name != bf.name {
+		return strings.Compare(a.name, bf.name), nil
+	}
+	same := a.user == bf.user && a.closeScope == bf.closeScope &&
+		len(a.fun) == len(bf.fun) &&
+		(len(a.fun) == 0 || &a.fun[0] == &bf.fun[0])
+	if a.user && same {
+		same = reflect.ValueOf(a.userfun).Pointer() ==
+			reflect.ValueOf(bf.userfun).Pointer()
+	}
+	if same {
+		return 0, nil
+	}
+	return 1, nil
+}
+
 func compareBool(a SexpBool, b Sexp) (int, error) {
 	var bb SexpBool
 	switch bt := b.(type) {
@@ -154,7 +316,35 @@ func compareBool(a SexpBool, b Sexp) (int, error) {
 	return 0, nil
 }
 
+// identical reports whether a and b are the same value of a type Compare
+// knows nothing else about.
+func identical(a Sexp, b Sexp) (same bool) {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) ||
+		!reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	// a struct may still hold something incomparable in an interface
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// maxNesting is how deeply Compare and HashExpression look into values
+// inside one another before failing with ErrTooDeep, as looking into a
+// value that holds itself would otherwise never end.
+const maxNesting = 10000
+
 func Compare(a Sexp, b Sexp) (int, error) {
+	return compare(a, b, 0)
+}
+
+func compare(a Sexp, b Sexp, depth int) (int, error) {
+	if depth > maxNesting {
+		return 0, ErrTooDeep
+	}
 	switch at := a.(type) {
 	case SexpInt:
 		return compareInt(at, b)
@@ -162,6 +352,8 @@ func Compare(a Sexp, b Sexp) (int, error) {
 		return compareChar(at, b)
 	case SexpFloat:
 		return compareFloat(at, b)
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return compareExact(a, b)
 	case SexpBool:
 		return compareBool(at, b)
 	case SexpStr:
@@ -169,9 +361,15 @@ func Compare(a Sexp, b Sexp) (int, error) {
 	case SexpSymbol:
 		return compareSymbol(at, b)
 	case SexpPair:
-		return comparePair(at, b)
+		return comparePair(at, b, depth)
 	case SexpArray:
-		return compareArray(at, b)
+		return compareArray(at, b, depth)
+	case SexpVector:
+		return compareArray(at.Slice(), b, depth)
+	case SexpHash, SexpMap:
+		return compareMaps(a, b, depth)
+	case SexpFunction:
+		return compareFunction(at, b)
 	case SexpSentinel:
 		if at == SexpNull && b == SexpNull {
 			return 0, nil
@@ -179,6 +377,9 @@ func Compare(a Sexp, b Sexp) (int, error) {
 			return -1, nil
 		}
 	}
+	if identical(a, b) {
+		return 0, nil
+	}
 	errmsg := fmt.Sprintf("cannot compare %T to %T", a, b)
 	return 0, errors.New(errmsg)
 }
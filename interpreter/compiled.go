@@ -0,0 +1,830 @@
+package glisp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// Compiled images start with this magic string followed by the format
+// version. Images written by a different version are rejected.
+const compiledMagic = "GLC"
+const CompiledVersion = 2
+
+// value tags
+const (
+	tagNull byte = iota
+	tagEnd
+	tagMarker
+	tagInt
+	tagFloat
+	tagTrue
+	tagFalse
+	tagChar
+	tagStr
+	tagSymbol
+	tagPair
+	tagArray
+	tagHash
+	tagFunction
+	tagStackmark
+	tagBigInt
+	tagRatio
+	tagDecimal
+	tagVector
+	tagMap
+)
+
+// instruction opcodes
+const (
+	opJump byte = iota
+	opGoto
+	opBranch
+	opPushClosure
+	opPush
+	opPop
+	opDup
+	opGet
+	opPut
+	opSet
+	opCall
+	opDispatch
+	opReturn
+	opTry
+	opEndTry
+	opRethrow
+	opPopStackmark
+	opSequence
+	opAddScope
+	opRemoveScope
+	opExplode
+	opSquash
+	opBindlist
+	opVectorize
+	opHashize
+	opPersist
+	opDefstruct
+	opDefprotocol
+	opExtendType
+	opRequire
+	opQuoteSymbol
+	opLess
+	opIncrement
+	opLen
+	opIndex
+	opBeginCapture
+	opEndCapture
+	opDropCapture
+	opGensym
+)
+
+// WriteCompiled writes the code loaded into the environment's main
+// function, and the macros defined by scripts, as a compiled image that
+// LoadCompiled can read back without parsing or generating it again.
+func (env *Glisp) WriteCompiled(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := &encoder{w: bw, strings: make(map[string]uint64)}
+
+	enc.bytes([]byte(compiledMagic))
+	enc.uint(CompiledVersion)
+	enc.function(env.mainfunc)
+
+	macros := env.scriptMacros()
+	enc.uint(uint64(len(macros)))
+	for _, macro := range macros {
+		enc.function(macro)
+	}
+
+	if enc.err != nil {
+		return enc.err
+	}
+	return bw.Flush()
+}
+
+// LoadCompiled reads an image written by WriteCompiled and loads its code
+// into the environment, as LoadStream would with the original source.
+// Symbols are interned by name, so the image may be loaded into any
+// environment that provides the functions it calls. Later gensyms skip
+// the names the image uses.
+func (env *Glisp) LoadCompiled(r io.Reader) error {
+	dec := &decoder{r: bufio.NewReader(r), env: env}
+
+	magic := make([]byte, len(compiledMagic))
+	if _, err := io.ReadFull(dec.r, magic); err != nil ||
+		string(magic) != compiledMagic {
+		return errors.New("not a compiled glisp image")
+	}
+	if version := dec.uint(); dec.err == nil && version != CompiledVersion {
+		return fmt.Errorf("unsupported compiled image version %d", version)
+	}
+
+	main := dec.function()
+	nmacros := dec.uint()
+	macros := make([]SexpFunction, 0)
+	for i := uint64(0); i < nmacros && dec.err == nil; i++ {
+		macros = append(macros, dec.function())
+	}
+	if dec.err != nil {
+		return fmt.Errorf("reading compiled image: %w", dec.err)
+	}
+
+	for _, macro := range macros {
+		env.macros.set(env.MakeSymbol(macro.name), macro)
+	}
+
+	if !env.ReachedEnd() {
+		env.mainfunc.fun = append(env.mainfunc.fun, PopInstr(0))
+		env.mainfunc.lines = append(env.mainfunc.lines, nil)
+	}
+	env.mainfunc.fun = append(env.mainfunc.fun, main.fun...)
+	env.mainfunc.lines = append(env.mainfunc.lines, main.lines...)
+	env.curfunc = env.mainfunc
+	return nil
+}
+
+// scriptMacros returns the macros written in glisp, as opposed to those
+// added from Go with AddMacro, sorted by name.
+func (env *Glisp) scriptMacros() []SexpFunction {
+	env.macros.mu.RLock()
+	defer env.macros.mu.RUnlock()
+
+	macros := make([]SexpFunction, 0)
+	for _, macro := range env.macros.macros {
+		if !macro.user {
+			macros = append(macros, macro)
+		}
+	}
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].name < macros[j].name
+	})
+	return macros
+}
+
+// encoder writes the parts of a compiled image. The first error is kept
+// and every later write is skipped. Strings used as names are written
+// once and referred to by index afterwards.
+type encoder struct {
+	w       *bufio.Writer
+	strings map[string]uint64
+	err     error
+}
+
+func (enc *encoder) bytes(b []byte) {
+	if enc.err == nil {
+		_, enc.err = enc.w.Write(b)
+	}
+}
+
+func (enc *encoder) byte(b byte) {
+	if enc.err == nil {
+		enc.err = enc.w.WriteByte(b)
+	}
+}
+
+func (enc *encoder) uint(n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	enc.bytes(buf[:binary.PutUvarint(buf[:], n)])
+}
+
+func (enc *encoder) int(n int64) {
+	var buf [binary.MaxVarintLen64]byte
+	enc.bytes(buf[:binary.PutVarint(buf[:], n)])
+}
+
+func (enc *encoder) bool(b bool) {
+	if b {
+		enc.byte(1)
+	} else {
+		enc.byte(0)
+	}
+}
+
+func (enc *encoder) string(s string) {
+	enc.uint(uint64(len(s)))
+	enc.bytes([]byte(s))
+}
+
+// name writes 0 followed by the string the first time it is seen, and
+// its index plus one after that.
+func (enc *encoder) name(s string) {
+	if index, ok := enc.strings[s]; ok {
+		enc.uint(index + 1)
+		return
+	}
+	enc.strings[s] = uint64(len(enc.strings))
+	enc.uint(0)
+	enc.string(s)
+}
+
+func (enc *encoder) position(pos *Position) {
+	if pos == nil {
+		enc.uint(0)
+		return
+	}
+	enc.uint(uint64(pos.Line))
+	enc.uint(uint64(pos.Column))
+	enc.name(pos.File)
+}
+
+func (enc *encoder) function(fun SexpFunction) {
+	if fun.user {
+		enc.fail(fmt.Errorf("cannot compile Go function %s", fun.name))
+		return
+	}
+	enc.name(fun.name)
+	enc.uint(uint64(fun.nargs))
+	enc.bool(fun.varargs)
+	enc.uint(uint64(len(fun.fun)))
+	for i, instr := range fun.fun {
+		enc.instruction(instr)
+		if i < len(fun.lines) {
+			enc.position(fun.lines[i])
+		} else {
+			enc.position(nil)
+		}
+	}
+}
+
+func (enc *encoder) fail(err error) {
+	if enc.err == nil {
+		enc.err = err
+	}
+}
+
+func (enc *encoder) instruction(instr Instruction) {
+	switch i := instr.(type) {
+	case JumpInstr:
+		enc.byte(opJump)
+		enc.int(int64(i.location))
+	case GotoInstr:
+		enc.byte(opGoto)
+		enc.int(int64(i.location))
+	case BranchInstr:
+		enc.byte(opBranch)
+		enc.bool(i.direction)
+		enc.int(int64(i.location))
+	case PushInstrClosure:
+		enc.byte(opPushClosure)
+		enc.function(i.expr)
+	case PushInstr:
+		enc.byte(opPush)
+		enc.value(i.expr)
+	case PopInstr:
+		enc.byte(opPop)
+	case DupInstr:
+		enc.byte(opDup)
+	case GetInstr:
+		enc.byte(opGet)
+		enc.name(i.sym.name)
+		enc.name(i.qualified.name)
+	case PutInstr:
+		enc.byte(opPut)
+		enc.name(i.sym.name)
+	case SetInstr:
+		enc.byte(opSet)
+		enc.name(i.sym.name)
+		enc.name(i.qualified.name)
+	case CallInstr:
+		enc.byte(opCall)
+		enc.name(i.sym.name)
+		enc.name(i.qualified.name)
+		enc.uint(uint64(i.nargs))
+	case DispatchInstr:
+		enc.byte(opDispatch)
+		enc.uint(uint64(i.nargs))
+	case ReturnInstr:
+		enc.byte(opReturn)
+		enc.bool(i.err != nil)
+		if i.err != nil {
+			enc.string(i.err.Error())
+		}
+	case TryInstr:
+		enc.byte(opTry)
+		enc.int(int64(i.location))
+		enc.bool(i.raw)
+	case EndTryInstr:
+		enc.byte(opEndTry)
+	case RethrowInstr:
+		enc.byte(opRethrow)
+	case PopStackmarkInstr:
+		enc.byte(opPopStackmark)
+		enc.name(i.sym.name)
+	case SequenceInstr:
+		enc.byte(opSequence)
+	case AddScopeInstr:
+		enc.byte(opAddScope)
+	case RemoveScopeInstr:
+		enc.byte(opRemoveScope)
+	case ExplodeInstr:
+		enc.byte(opExplode)
+	case SquashInstr:
+		enc.byte(opSquash)
+	case BindlistInstr:
+		enc.byte(opBindlist)
+		enc.uint(uint64(len(i.syms)))
+		for _, sym := range i.syms {
+			enc.name(sym.name)
+		}
+	case VectorizeInstr:
+		enc.byte(opVectorize)
+	case PersistInstr:
+		enc.byte(opPersist)
+		enc.bool(i.Map)
+	case QuoteSymbolInstr:
+		enc.byte(opQuoteSymbol)
+		enc.name(i.sym.name)
+		enc.name(i.ns)
+	case HashizeInstr:
+		enc.byte(opHashize)
+		enc.uint(uint64(i.HashLen))
+		enc.name(i.TypeName)
+	case DefstructInstr:
+		enc.byte(opDefstruct)
+		enc.name(i.name.name)
+		enc.uint(uint64(len(i.fields)))
+		for j, field := range i.fields {
+			enc.name(field.name)
+			enc.bool(i.defaults[j])
+		}
+	case DefprotocolInstr:
+		enc.byte(opDefprotocol)
+		enc.name(i.name.name)
+		enc.uint(uint64(len(i.methods)))
+		for _, method := range i.methods {
+			enc.name(method.name)
+		}
+	case ExtendTypeInstr:
+		enc.byte(opExtendType)
+		enc.name(i.typename.name)
+		enc.name(i.protocol.name)
+		enc.name(i.method.name)
+	case RequireInstr:
+		enc.byte(opRequire)
+		enc.name(i.module.name)
+	case LessInstr:
+		enc.byte(opLess)
+	case IncrementInstr:
+		enc.byte(opIncrement)
+	case LenInstr:
+		enc.byte(opLen)
+	case IndexInstr:
+		enc.byte(opIndex)
+	case BeginCaptureInstr:
+		enc.byte(opBeginCapture)
+	case EndCaptureInstr:
+		enc.byte(opEndCapture)
+	case DropCaptureInstr:
+		enc.byte(opDropCapture)
+	case GensymInstr:
+		enc.byte(opGensym)
+		enc.name(i.prefix)
+	default:
+		enc.fail(fmt.Errorf("cannot compile instruction %s",
+			instr.InstrString()))
+	}
+}
+
+func (enc *encoder) value(expr Sexp) {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		switch e {
+		case SexpNull:
+			enc.byte(tagNull)
+		case SexpEnd:
+			enc.byte(tagEnd)
+		case SexpMarker:
+			enc.byte(tagMarker)
+		}
+	case SexpInt:
+		enc.byte(tagInt)
+		enc.int(int64(e))
+	case SexpFloat:
+		enc.byte(tagFloat)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(float64(e)))
+		enc.bytes(buf[:])
+	case SexpBool:
+		if e {
+			enc.byte(tagTrue)
+		} else {
+			enc.byte(tagFalse)
+		}
+	case SexpChar:
+		enc.byte(tagChar)
+		enc.int(int64(e))
+	case SexpStr:
+		enc.byte(tagStr)
+		enc.string(string(e))
+	case SexpSymbol:
+		enc.byte(tagSymbol)
+		enc.name(e.name)
+	case SexpPair:
+		enc.byte(tagPair)
+		enc.value(e.head)
+		enc.value(e.tail)
+	case SexpArray:
+		enc.byte(tagArray)
+		enc.uint(uint64(len(e)))
+		for _, item := range e {
+			enc.value(item)
+		}
+	case SexpHash:
+		enc.byte(tagHash)
+		enc.name(*e.TypeName)
+		pairs := e.Pairs()
+		enc.uint(uint64(len(pairs)))
+		for _, pair := range pairs {
+			enc.value(pair.head)
+			enc.value(pair.tail)
+		}
+	case SexpFunction:
+		enc.byte(tagFunction)
+		enc.function(e)
+	case SexpStackmark:
+		enc.byte(tagStackmark)
+		enc.name(e.sym.name)
+	case SexpBigInt:
+		enc.byte(tagBigInt)
+		enc.string(e.SexpString())
+	case SexpRatio:
+		enc.byte(tagRatio)
+		enc.string(e.SexpString())
+	case SexpDecimal:
+		enc.byte(tagDecimal)
+		enc.string(e.String())
+	case SexpVector:
+		enc.byte(tagVector)
+		enc.value(SexpArray(e.Slice()))
+	case SexpMap:
+		enc.byte(tagMap)
+		enc.uint(uint64(e.Len()))
+		for _, pair := range e.Pairs() {
+			enc.value(pair.head)
+			enc.value(pair.tail)
+		}
+	default:
+		enc.fail(fmt.Errorf("cannot compile value %s of type %T",
+			expr.SexpString(), expr))
+	}
+}
+
+// decoder reads what encoder writes, interning symbols in env. Like the
+// encoder, it stops at the first error.
+type decoder struct {
+	r       *bufio.Reader
+	env     *Glisp
+	strings []string
+	err     error
+}
+
+func (dec *decoder) fail(err error) {
+	if dec.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		dec.err = err
+	}
+}
+
+func (dec *decoder) byte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	b, err := dec.r.ReadByte()
+	dec.fail(err)
+	return b
+}
+
+func (dec *decoder) uint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(dec.r)
+	dec.fail(err)
+	return n
+}
+
+func (dec *decoder) int() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(dec.r)
+	dec.fail(err)
+	return n
+}
+
+func (dec *decoder) bool() bool {
+	return dec.byte() != 0
+}
+
+func (dec *decoder) string() string {
+	n := dec.uint()
+	if dec.err != nil {
+		return ""
+	}
+	// read in chunks so a corrupt length can't allocate too much up front
+	var buf []byte
+	for n > 0 && dec.err == nil {
+		chunk := n
+		if chunk > 4096 {
+			chunk = 4096
+		}
+		part := make([]byte, chunk)
+		_, err := io.ReadFull(dec.r, part)
+		dec.fail(err)
+		buf = append(buf, part...)
+		n -= chunk
+	}
+	return string(buf)
+}
+
+func (dec *decoder) name() string {
+	index := dec.uint()
+	if dec.err != nil {
+		return ""
+	}
+	if index == 0 {
+		s := dec.string()
+		dec.strings = append(dec.strings, s)
+		return s
+	}
+	if index > uint64(len(dec.strings)) {
+		dec.fail(fmt.Errorf("bad string reference %d", index))
+		return ""
+	}
+	return dec.strings[index-1]
+}
+
+func (dec *decoder) symbol() SexpSymbol {
+	name := dec.name()
+	if dec.err != nil {
+		return SexpSymbol{}
+	}
+	return dec.env.MakeSymbol(name)
+}
+
+// qualified reads the namespace definition of a symbol, which is empty
+// outside of a namespace.
+func (dec *decoder) qualified() SexpSymbol {
+	name := dec.name()
+	if name == "" || dec.err != nil {
+		return SexpSymbol{}
+	}
+	return dec.env.MakeSymbol(name)
+}
+
+func (dec *decoder) position() *Position {
+	line := dec.uint()
+	if line == 0 || dec.err != nil {
+		return nil
+	}
+	column := dec.uint()
+	file := dec.name()
+	return &Position{File: file, Line: int(line), Column: int(column)}
+}
+
+func (dec *decoder) function() SexpFunction {
+	name := dec.name()
+	nargs := dec.uint()
+	varargs := dec.bool()
+	ninstr := dec.uint()
+
+	instrs := make([]Instruction, 0)
+	lines := make([]*Position, 0)
+	for i := uint64(0); i < ninstr && dec.err == nil; i++ {
+		instrs = append(instrs, dec.instruction())
+		lines = append(lines, dec.position())
+	}
+
+	fun := MakeFunction(name, int(nargs), varargs, instrs)
+	fun.lines = lines
+	return fun
+}
+
+func (dec *decoder) instruction() Instruction {
+	op := dec.byte()
+	if dec.err != nil {
+		return nil
+	}
+
+	switch op {
+	case opJump:
+		return JumpInstr{int(dec.int())}
+	case opGoto:
+		return GotoInstr{int(dec.int())}
+	case opBranch:
+		direction := dec.bool()
+		return BranchInstr{direction, int(dec.int())}
+	case opPushClosure:
+		return PushInstrClosure{dec.function()}
+	case opPush:
+		return PushInstr{dec.value()}
+	case opPop:
+		return PopInstr(0)
+	case opDup:
+		return DupInstr(0)
+	case opGet:
+		sym := dec.symbol()
+		return GetInstr{sym, dec.qualified()}
+	case opPut:
+		return PutInstr{dec.symbol()}
+	case opSet:
+		sym := dec.symbol()
+		return SetInstr{sym, dec.qualified()}
+	case opCall:
+		sym := dec.symbol()
+		qualified := dec.qualified()
+		return CallInstr{sym, qualified, int(dec.uint())}
+	case opDispatch:
+		return DispatchInstr{int(dec.uint())}
+	case opReturn:
+		if dec.bool() {
+			return ReturnInstr{errors.New(dec.string())}
+		}
+		return ReturnInstr{nil}
+	case opTry:
+		location := int(dec.int())
+		return TryInstr{location, dec.bool()}
+	case opEndTry:
+		return EndTryInstr(0)
+	case opRethrow:
+		return RethrowInstr(0)
+	case opPopStackmark:
+		return PopStackmarkInstr{dec.symbol()}
+	case opSequence:
+		return SequenceInstr(0)
+	case opAddScope:
+		return AddScopeInstr(0)
+	case opRemoveScope:
+		return RemoveScopeInstr(0)
+	case opExplode:
+		return ExplodeInstr(0)
+	case opSquash:
+		return SquashInstr(0)
+	case opBindlist:
+		n := dec.uint()
+		syms := make([]SexpSymbol, 0)
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			syms = append(syms, dec.symbol())
+		}
+		return BindlistInstr{syms}
+	case opVectorize:
+		return VectorizeInstr(0)
+	case opPersist:
+		return PersistInstr{dec.bool()}
+	case opQuoteSymbol:
+		sym := dec.symbol()
+		return QuoteSymbolInstr{sym, dec.name()}
+	case opHashize:
+		hashlen := dec.uint()
+		return HashizeInstr{int(hashlen), dec.name()}
+	case opDefstruct:
+		name := dec.symbol()
+		n := dec.uint()
+		var fields []SexpSymbol
+		var defaults []bool
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			fields = append(fields, dec.symbol())
+			defaults = append(defaults, dec.bool())
+		}
+		return DefstructInstr{name, fields, defaults}
+	case opDefprotocol:
+		name := dec.symbol()
+		n := dec.uint()
+		var methods []SexpSymbol
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			methods = append(methods, dec.symbol())
+		}
+		return DefprotocolInstr{name, methods}
+	case opExtendType:
+		typename := dec.symbol()
+		protocol := dec.symbol()
+		return ExtendTypeInstr{typename, protocol, dec.symbol()}
+	case opRequire:
+		return RequireInstr{dec.symbol()}
+	case opLess:
+		return LessInstr(0)
+	case opIncrement:
+		return IncrementInstr(0)
+	case opLen:
+		return LenInstr(0)
+	case opIndex:
+		return IndexInstr(0)
+	case opBeginCapture:
+		return BeginCaptureInstr(0)
+	case opEndCapture:
+		return EndCaptureInstr(0)
+	case opDropCapture:
+		return DropCaptureInstr(0)
+	case opGensym:
+		return GensymInstr{dec.name()}
+	}
+	dec.fail(fmt.Errorf("unknown opcode %d", op))
+	return nil
+}
+
+func (dec *decoder) value() Sexp {
+	tag := dec.byte()
+	if dec.err != nil {
+		return SexpNull
+	}
+
+	switch tag {
+	case tagNull:
+		return SexpNull
+	case tagEnd:
+		return SexpEnd
+	case tagMarker:
+		return SexpMarker
+	case tagInt:
+		return SexpInt(dec.int())
+	case tagFloat:
+		var buf [8]byte
+		_, err := io.ReadFull(dec.r, buf[:])
+		dec.fail(err)
+		bits := binary.LittleEndian.Uint64(buf[:])
+		return SexpFloat(math.Float64frombits(bits))
+	case tagTrue:
+		return SexpBool(true)
+	case tagFalse:
+		return SexpBool(false)
+	case tagChar:
+		return SexpChar(dec.int())
+	case tagStr:
+		return SexpStr(dec.string())
+	case tagSymbol:
+		return dec.symbol()
+	case tagPair:
+		head := dec.value()
+		return Cons(head, dec.value())
+	case tagArray:
+		n := dec.uint()
+		arr := make([]Sexp, 0)
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			arr = append(arr, dec.value())
+		}
+		return SexpArray(arr)
+	case tagHash:
+		typename := dec.name()
+		n := dec.uint()
+		hash, _ := MakeHash(nil, typename)
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			key := dec.value()
+			val := dec.value()
+			if dec.err == nil {
+				dec.fail(hash.HashSet(key, val))
+			}
+		}
+		return hash
+	case tagFunction:
+		return dec.function()
+	case tagStackmark:
+		return SexpStackmark{dec.symbol()}
+	case tagBigInt:
+		str := dec.string()
+		i, ok := new(big.Int).SetString(str, 10)
+		if !ok {
+			dec.fail(fmt.Errorf("bad big integer %q", str))
+			return SexpNull
+		}
+		return MakeBigInt(i)
+	case tagRatio:
+		str := dec.string()
+		r, ok := new(big.Rat).SetString(str)
+		if !ok {
+			dec.fail(fmt.Errorf("bad ratio %q", str))
+			return SexpNull
+		}
+		return MakeRatio(r)
+	case tagDecimal:
+		d, err := ParseDecimal(dec.string())
+		if err != nil {
+			dec.fail(err)
+			return SexpNull
+		}
+		return d
+	case tagVector:
+		arr, _ := dec.value().(SexpArray)
+		return MakeVector(arr)
+	case tagMap:
+		n := dec.uint()
+		m := SexpMap{}
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			key := dec.value()
+			val := dec.value()
+			if dec.err == nil {
+				var err error
+				m, err = m.Assoc(key, val)
+				dec.fail(err)
+			}
+		}
+		return m
+	}
+	dec.fail(fmt.Errorf("unknown value tag %d", tag))
+	return SexpNull
+}
@@ -1,8 +1,9 @@
 package glisp
 
 import (
-	"errors"
 	"fmt"
+	"io"
+	"os"
 )
 
 type DataStackElem struct {
@@ -26,7 +27,7 @@ func (stack *Stack) PopExpr() (Sexp, error) {
 func (stack *Stack) GetExpressions(n int) ([]Sexp, error) {
 	stack_start := stack.tos - n + 1
 	if stack_start < 0 {
-		return nil, errors.New("not enough items on stack")
+		return nil, ErrStackUnderflow
 	}
 	arr := make([]Sexp, n)
 	for i := 0; i < n; i++ {
@@ -53,9 +54,13 @@ func (stack *Stack) GetExpr(n int) (Sexp, error) {
 }
 
 func (stack *Stack) PrintStack() {
-	fmt.Printf("\t%d elements\n", stack.tos+1)
+	stack.FprintStack(os.Stdout)
+}
+
+func (stack *Stack) FprintStack(w io.Writer) {
+	fmt.Fprintf(w, "\t%d elements\n", stack.tos+1)
 	for i := 0; i <= stack.tos; i++ {
 		expr := stack.elements[i].(DataStackElem).expr
-		fmt.Println("\t" + expr.SexpString())
+		fmt.Fprintln(w, "\t"+expr.SexpString())
 	}
 }
@@ -0,0 +1,371 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// SexpDecimal is an exact base-10 number with a fixed number of digits
+// after the point, its scale. It is written with an M suffix, as in
+// 12.50M, which has a scale of two.
+type SexpDecimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota
+	RoundHalfUp
+	RoundFloor
+	RoundCeiling
+	RoundDown
+)
+
+var roundingModes = map[string]RoundingMode{
+	"half-even": RoundHalfEven,
+	"half-up":   RoundHalfUp,
+	"floor":     RoundFloor,
+	"ceiling":   RoundCeiling,
+	"down":      RoundDown,
+}
+
+// DecimalContext says how products and quotients of decimals are
+// rounded. Results with more digits after the point than Scale are
+// rounded to it with Rounding. A negative Scale keeps products exact and
+// makes quotients with no exact decimal form ratios.
+type DecimalContext struct {
+	Scale    int
+	Rounding RoundingMode
+}
+
+// ExactDecimals is the context environments start with.
+var ExactDecimals = DecimalContext{Scale: -1}
+
+func (env *Glisp) SetDecimalContext(ctx DecimalContext) {
+	env.decimals = ctx
+}
+
+func (env *Glisp) DecimalContext() DecimalContext {
+	return env.decimals
+}
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// MakeDecimal returns the decimal unscaled * 10^-scale.
+func MakeDecimal(unscaled *big.Int, scale int) SexpDecimal {
+	return SexpDecimal{new(big.Int).Set(unscaled), scale}
+}
+
+// ParseDecimal reads a decimal written as digits with an optional sign
+// and point, such as -12.50. Its scale is the number of digits after the
+// point.
+func ParseDecimal(str string) (SexpDecimal, error) {
+	digits := str
+	scale := 0
+	if point := strings.IndexByte(str, '.'); point >= 0 {
+		digits = str[:point] + str[point+1:]
+		scale = len(str) - point - 1
+	}
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok || scale < 0 || strings.ContainsAny(digits, "+_") {
+		return SexpDecimal{}, fmt.Errorf("invalid decimal %q", str)
+	}
+	return SexpDecimal{unscaled, scale}, nil
+}
+
+// String formats the decimal without the M suffix, for display.
+func (d SexpDecimal) String() string {
+	digits := new(big.Int).Abs(d.unscaled).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		point := len(digits) - d.scale
+		digits = digits[:point] + "." + digits[point:]
+	}
+	if d.unscaled.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+func (d SexpDecimal) SexpString() string {
+	return d.String() + "M"
+}
+
+func (d SexpDecimal) Scale() int {
+	return d.scale
+}
+
+// Rat returns the exact value of the decimal.
+func (d SexpDecimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.unscaled, pow10(d.scale))
+}
+
+// Rescale returns the decimal with the given scale, rounding with mode if
+// digits are dropped.
+func (d SexpDecimal) Rescale(scale int, mode RoundingMode) SexpDecimal {
+	if scale >= d.scale {
+		unscaled := new(big.Int).Mul(d.unscaled, pow10(scale-d.scale))
+		return SexpDecimal{unscaled, scale}
+	}
+	return SexpDecimal{
+		roundQuo(d.unscaled, pow10(d.scale-scale), mode), scale}
+}
+
+// roundQuo divides num by the positive den, rounding with mode.
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, rem := new(big.Int).DivMod(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+
+	// q is now rounded toward negative infinity
+	up := false
+	switch mode {
+	case RoundFloor:
+	case RoundCeiling:
+		up = true
+	case RoundDown:
+		up = num.Sign() < 0
+	case RoundHalfUp, RoundHalfEven:
+		switch new(big.Int).Lsh(rem, 1).Cmp(den) {
+		case 1:
+			up = true
+		case 0:
+			if mode == RoundHalfUp {
+				up = num.Sign() >= 0
+			} else {
+				up = q.Bit(0) == 1
+			}
+		}
+	}
+	if up {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
+
+// RoundRat converts r to a decimal with the given scale.
+func RoundRat(r *big.Rat, scale int, mode RoundingMode) SexpDecimal {
+	num := new(big.Int).Mul(r.Num(), pow10(scale))
+	return SexpDecimal{roundQuo(num, r.Denom(), mode), scale}
+}
+
+// exactDecimal converts r to a decimal of at least the given scale,
+// failing if it has no finite decimal expansion.
+func exactDecimal(r *big.Rat, scale int) (SexpDecimal, bool) {
+	// the expansion is finite if the denominator only has factors of
+	// two and five, and needs as many digits as the larger power
+	den := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	mod := new(big.Int)
+	five := big.NewInt(5)
+	for den.Bit(0) == 0 {
+		den.Rsh(den, 1)
+		twos++
+	}
+	for {
+		q, m := new(big.Int).QuoRem(den, five, mod)
+		if m.Sign() != 0 {
+			break
+		}
+		den = q
+		fives++
+	}
+	if den.Cmp(big.NewInt(1)) != 0 {
+		return SexpDecimal{}, false
+	}
+	if twos > scale {
+		scale = twos
+	}
+	if fives > scale {
+		scale = fives
+	}
+	return RoundRat(r, scale, RoundHalfEven), true
+}
+
+// toDecimal converts an integer or decimal to a decimal.
+func toDecimal(expr Sexp) (SexpDecimal, bool) {
+	if d, ok := expr.(SexpDecimal); ok {
+		return d, true
+	}
+	if i, ok := ToBigInt(expr); ok {
+		return SexpDecimal{i, 0}, true
+	}
+	return SexpDecimal{}, false
+}
+
+// NumericDecimalDo does arithmetic on decimals. Sums and differences
+// have the larger of the two scales and products the sum of them, so
+// neither loses digits. Quotients are decimals if they can be written
+// exactly, and ratios otherwise. Products and quotients are then rounded
+// as ctx says.
+func NumericDecimalDo(op NumericOp, a, b SexpDecimal,
+	ctx DecimalContext) (Sexp, error) {
+	scale := a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+
+	switch op {
+	case Add:
+		a, b = a.Rescale(scale, RoundDown), b.Rescale(scale, RoundDown)
+		return SexpDecimal{new(big.Int).Add(a.unscaled, b.unscaled), scale}, nil
+	case Sub:
+		a, b = a.Rescale(scale, RoundDown), b.Rescale(scale, RoundDown)
+		return SexpDecimal{new(big.Int).Sub(a.unscaled, b.unscaled), scale}, nil
+	case Mult:
+		d := SexpDecimal{new(big.Int).Mul(a.unscaled, b.unscaled),
+			a.scale + b.scale}
+		if ctx.Scale >= 0 && d.scale > ctx.Scale {
+			d = d.Rescale(ctx.Scale, ctx.Rounding)
+		}
+		return d, nil
+	case Div:
+		if b.unscaled.Sign() == 0 {
+			return SexpNull, DivideByZero
+		}
+		q := new(big.Rat).Quo(a.Rat(), b.Rat())
+		d, ok := exactDecimal(q, scale)
+		if ctx.Scale < 0 {
+			if ok {
+				return d, nil
+			}
+			return MakeRatio(q), nil
+		}
+		// an exact quotient keeps its digits unless it has too many
+		if !ok || d.scale > ctx.Scale {
+			return RoundRat(q, ctx.Scale, ctx.Rounding), nil
+		}
+		return d, nil
+	}
+	return SexpNull, errors.New("unrecognized numeric operation")
+}
+
+// parseRoundingMode reads a rounding mode named by a symbol or string.
+func parseRoundingMode(expr Sexp) (RoundingMode, error) {
+	var modename string
+	switch m := expr.(type) {
+	case SexpSymbol:
+		modename = m.name
+	case SexpStr:
+		modename = string(m)
+	default:
+		return RoundHalfEven, errors.New("rounding mode must be a symbol")
+	}
+	mode, ok := roundingModes[modename]
+	if !ok {
+		return RoundHalfEven, fmt.Errorf("unknown rounding mode %s", modename)
+	}
+	return mode, nil
+}
+
+// DecimalFunction implements (decimal x), (decimal x scale) and
+// (decimal x scale mode). Without a scale, x must have an exact decimal
+// form. The rounding mode is a symbol or string naming one of
+// half-even (the default), half-up, floor, ceiling or down.
+func DecimalFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return SexpNull, WrongNargs
+	}
+
+	mode := RoundHalfEven
+	if len(args) == 3 {
+		var err error
+		if mode, err = parseRoundingMode(args[2]); err != nil {
+			return SexpNull, err
+		}
+	}
+
+	// decimals and strings already have a scale, which is kept if no
+	// other is given
+	var value *big.Rat
+	var written *SexpDecimal
+	switch x := args[0].(type) {
+	case SexpDecimal:
+		written = &x
+	case SexpStr:
+		d, err := ParseDecimal(strings.TrimSuffix(string(x), "M"))
+		if err != nil {
+			return SexpNull, err
+		}
+		written = &d
+	case SexpRatio:
+		value = x.v
+	case SexpFloat:
+		// use the shortest digits that read back as the same float,
+		// rather than its exact binary value
+		d, err := ParseDecimal(strconv.FormatFloat(float64(x), 'f', -1, 64))
+		if err != nil {
+			return SexpNull, err
+		}
+		value = d.Rat()
+	default:
+		i, ok := ToBigInt(args[0])
+		if !ok {
+			return SexpNull, typeError("number", args[0])
+		}
+		value = new(big.Rat).SetInt(i)
+	}
+
+	if len(args) == 1 {
+		if written != nil {
+			return *written, nil
+		}
+		d, ok := exactDecimal(value, 0)
+		if !ok {
+			return SexpNull, fmt.Errorf(
+				"%s has no exact decimal form, give a scale to round it to",
+				args[0].SexpString())
+		}
+		return d, nil
+	}
+	if written != nil {
+		value = written.Rat()
+	}
+
+	scale, ok := args[1].(SexpInt)
+	if !ok || scale < 0 {
+		return SexpNull, errors.New("scale must be a non-negative integer")
+	}
+	return RoundRat(value, int(scale), mode), nil
+}
+
+// SetDecimalContextFunction implements (set-decimal-context! scale),
+// (set-decimal-context! scale mode) and (set-decimal-context! 'exact),
+// which set how later products and quotients of decimals are rounded.
+func SetDecimalContextFunction(env *Glisp, name string,
+	args []Sexp) (Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return SexpNull, WrongNargs
+	}
+
+	if sym, ok := args[0].(SexpSymbol); ok && sym.name == "exact" &&
+		len(args) == 1 {
+		env.decimals = ExactDecimals
+		return SexpNull, nil
+	}
+	scale, ok := args[0].(SexpInt)
+	if !ok || scale < 0 {
+		return SexpNull, errors.New("scale must be a non-negative integer")
+	}
+	ctx := DecimalContext{Scale: int(scale), Rounding: RoundHalfEven}
+	if len(args) == 2 {
+		var err error
+		if ctx.Rounding, err = parseRoundingMode(args[1]); err != nil {
+			return SexpNull, err
+		}
+	}
+	env.decimals = ctx
+	return SexpNull, nil
+}
@@ -3,54 +3,87 @@ package glisp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"strconv"
+	"time"
 )
 
 type PreHook func(*Glisp, string, []Sexp)
 type PostHook func(*Glisp, string, Sexp)
 
 type Glisp struct {
-	datastack   *Stack
-	scopestack  *Stack
-	addrstack   *Stack
-	stackstack  *Stack
-	symtable    map[string]int
-	revsymtable map[int]string
-	builtins    map[int]SexpFunction
-	macros      map[int]SexpFunction
-	curfunc     SexpFunction
-	mainfunc    SexpFunction
-	pc          int
-	nextsymbol  int
-	before      []PreHook
-	after       []PostHook
+	datastack  *Stack
+	scopestack *Stack
+	addrstack  *Stack
+	stackstack *Stack
+	trystack   *Stack
+	symbols    *symbolTable
+	builtins   map[int]SexpFunction
+	macros     *macroTable
+	structs    *structTable
+	protocols  *protocolTable
+	namespaces *namespaceTable
+	curns      *namespace
+	modulePath []string
+	curfunc    SexpFunction
+	mainfunc   SexpFunction
+	pc         int
+	before     []PreHook
+	after      []PostHook
+	limits     Limits
+	limited    bool
+	ctx        context.Context
+	steps      int
+	deadline   time.Time
+	running    int
+	forms      map[string]bool
+	fs         fs.FS
+	persistent bool
+	decimals   DecimalContext
+	stdin      io.Reader
+	stdout     io.Writer
+	captures   []capture
+	stderr     io.Writer
 }
 
 const CallStackSize = 25
 const ScopeStackSize = 50
 const DataStackSize = 100
 const StackStackSize = 5
+const TryStackSize = 5
 
 func NewGlisp() *Glisp {
+	return newGlisp(BuiltinFunctions)
+}
+
+func newGlisp(builtins map[string]GlispUserFunction) *Glisp {
 	env := new(Glisp)
 	env.datastack = NewStack(DataStackSize)
 	env.scopestack = NewStack(ScopeStackSize)
-	env.scopestack.PushScope()
+	env.scopestack.Push(newSharedScope())
 	env.stackstack = NewStack(StackStackSize)
 	env.addrstack = NewStack(CallStackSize)
+	env.trystack = NewStack(TryStackSize)
 	env.builtins = make(map[int]SexpFunction)
-	env.macros = make(map[int]SexpFunction)
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = 1
+	env.macros = newMacroTable()
+	env.structs = newStructTable()
+	env.protocols = newProtocolTable()
+	env.namespaces = newNamespaceTable()
+	env.curns = env.namespaces.intern("")
+	env.modulePath = []string{"."}
+	env.decimals = ExactDecimals
+	env.symbols = newSymbolTable()
 	env.before = []PreHook{}
 	env.after = []PostHook{}
+	env.stdin = os.Stdin
+	env.stdout = os.Stdout
+	env.stderr = os.Stderr
 
-	for key, function := range BuiltinFunctions {
+	for key, function := range builtins {
 		sym := env.MakeSymbol(key)
 		env.builtins[sym.number] = MakeUserFunction(key, function)
 		env.AddFunction(key, function)
@@ -69,14 +102,28 @@ func (env *Glisp) Clone() *Glisp {
 	dupenv.stackstack = env.stackstack.Clone()
 	dupenv.scopestack = env.scopestack.Clone()
 	dupenv.addrstack = env.addrstack.Clone()
+	dupenv.trystack = NewStack(TryStackSize)
 
 	dupenv.builtins = env.builtins
 	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.structs = env.structs
+	dupenv.protocols = env.protocols
+	dupenv.namespaces = env.namespaces
+	dupenv.curns = env.curns
+	dupenv.modulePath = env.modulePath
+	dupenv.symbols = env.symbols
 	dupenv.before = env.before
 	dupenv.after = env.after
+	dupenv.limits = env.limits
+	dupenv.limited = env.limited
+	dupenv.ctx = env.ctx
+	dupenv.forms = env.forms
+	dupenv.fs = env.fs
+	dupenv.persistent = env.persistent
+	dupenv.decimals = env.decimals
+	dupenv.stdin = env.stdin
+	dupenv.stdout = env.stdout
+	dupenv.stderr = env.stderr
 
 	dupenv.scopestack.Push(env.scopestack.elements[0])
 
@@ -92,13 +139,27 @@ func (env *Glisp) Duplicate() *Glisp {
 	dupenv.scopestack = NewStack(ScopeStackSize)
 	dupenv.stackstack = NewStack(StackStackSize)
 	dupenv.addrstack = NewStack(CallStackSize)
+	dupenv.trystack = NewStack(TryStackSize)
 	dupenv.builtins = env.builtins
 	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.structs = env.structs
+	dupenv.protocols = env.protocols
+	dupenv.namespaces = env.namespaces
+	dupenv.curns = env.curns
+	dupenv.modulePath = env.modulePath
+	dupenv.symbols = env.symbols
 	dupenv.before = env.before
 	dupenv.after = env.after
+	dupenv.limits = env.limits
+	dupenv.limited = env.limited
+	dupenv.ctx = env.ctx
+	dupenv.forms = env.forms
+	dupenv.fs = env.fs
+	dupenv.persistent = env.persistent
+	dupenv.decimals = env.decimals
+	dupenv.stdin = env.stdin
+	dupenv.stdout = env.stdout
+	dupenv.stderr = env.stderr
 
 	dupenv.scopestack.Push(env.scopestack.elements[0])
 
@@ -109,20 +170,11 @@ func (env *Glisp) Duplicate() *Glisp {
 }
 
 func (env *Glisp) MakeSymbol(name string) SexpSymbol {
-	symnum, ok := env.symtable[name]
-	if ok {
-		return SexpSymbol{name, symnum}
-	}
-	symbol := SexpSymbol{name, env.nextsymbol}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-	env.nextsymbol++
-	return symbol
+	return env.symbols.intern(name)
 }
 
 func (env *Glisp) GenSymbol(prefix string) SexpSymbol {
-	symname := prefix + strconv.Itoa(env.nextsymbol)
-	return env.MakeSymbol(symname)
+	return env.symbols.gensym(prefix)
 }
 
 func (env *Glisp) CurrentFunctionSize() int {
@@ -132,11 +184,11 @@ func (env *Glisp) CurrentFunctionSize() int {
 	return len(env.curfunc.fun)
 }
 
-func (env *Glisp) wrangleOptargs(fnargs, nargs int) error {
+func (env *Glisp) wrangleOptargs(function SexpFunction, nargs int) error {
+	fnargs := function.nargs
 	if nargs < fnargs {
-		return errors.New(
-			fmt.Sprintf("Expected >%d arguments, got %d",
-				fnargs, nargs))
+		return ArityError{Function: function.name, Expected: fnargs,
+			Varargs: true, Got: nargs}
 	}
 	if nargs > fnargs {
 		optargs, err := env.datastack.PopExpressions(nargs - fnargs)
@@ -160,18 +212,21 @@ func (env *Glisp) CallFunction(function SexpFunction, nargs int) error {
 	}
 
 	if function.varargs {
-		err := env.wrangleOptargs(function.nargs, nargs)
+		err := env.wrangleOptargs(function, nargs)
 		if err != nil {
 			return err
 		}
 	} else if nargs != function.nargs {
-		return errors.New(
-			fmt.Sprintf("%s expected %d arguments, got %d",
-				function.name, function.nargs, nargs))
+		return ArityError{Function: function.name,
+			Expected: function.nargs, Got: nargs}
+	}
+
+	if err := env.checkCallDepth(); err != nil {
+		return err
 	}
 
 	if env.scopestack.IsEmpty() {
-		panic("where's the global scope?")
+		return env.withState(internalError(errors.New("no global scope")))
 	}
 	globalScope := env.scopestack.elements[0]
 	env.stackstack.Push(env.scopestack)
@@ -226,8 +281,7 @@ func (env *Glisp) CallUserFunction(
 
 	args, err := env.datastack.PopExpressions(nargs)
 	if err != nil {
-		return errors.New(
-			fmt.Sprintf("Error calling %s: %v", name, err))
+		return fmt.Errorf("Error calling %s: %w", name, err)
 	}
 
 	env.addrstack.PushAddr(env.curfunc, env.pc+1)
@@ -236,8 +290,11 @@ func (env *Glisp) CallUserFunction(
 
 	res, err := function.userfun(env, name, args)
 	if err != nil {
-		return errors.New(
-			fmt.Sprintf("Error calling %s: %v", name, err))
+		// Go functions only say the count was wrong
+		if err == WrongNargs {
+			err = ArityError{Function: name, Expected: -1, Got: nargs}
+		}
+		return fmt.Errorf("Error calling %s: %w", name, err)
 	}
 	env.datastack.PushExpr(res)
 
@@ -250,14 +307,20 @@ func (env *Glisp) CallUserFunction(
 }
 
 func (env *Glisp) ParseStream(in io.Reader) ([]Sexp, error) {
-	lexer := NewLexerFromStream(bufio.NewReader(in))
+	return env.parseStream(in, "")
+}
+
+// parseStream parses the stream, recording filename in the position of
+// every list and symbol read
+func (env *Glisp) parseStream(in io.Reader, filename string) ([]Sexp, error) {
+	lexer := NewLexerFromNamedStream(bufio.NewReader(in), filename)
 
 	var err error
 	var exp []Sexp
 
 	exp, err = ParseTokens(env, lexer)
 	if err != nil {
-		return nil, fmt.Errorf("Error on line %d: %v\n", lexer.Linenum(), err)
+		return nil, fmt.Errorf("Error at %s: %w\n", lexer.Position(), err)
 	}
 
 	return exp, nil
@@ -265,14 +328,14 @@ func (env *Glisp) ParseStream(in io.Reader) ([]Sexp, error) {
 
 // ParseFile, used in the generator at read time to dynamiclly add more defs from other files
 func (env *Glisp) ParseFile(file string) ([]Sexp, error) {
-	in, err := os.Open(file)
+	in, err := env.OpenFile(file)
 	if err != nil {
 		return nil, err
 	}
 
 	var exp []Sexp
 
-	exp, err = env.ParseStream(in)
+	exp, err = env.parseStream(in, file)
 
 	in.Close()
 
@@ -293,6 +356,7 @@ func (env *Glisp) SourceExpressions(expressions []Sexp) error {
 	curpc := env.pc
 
 	env.curfunc = MakeFunction("__source", 0, false, gen.instructions)
+	env.curfunc.lines = gen.lines
 	env.pc = 0
 
 	env.datastack.PushExpr(SexpNull)
@@ -311,7 +375,11 @@ func (env *Glisp) SourceExpressions(expressions []Sexp) error {
 
 // SourceStream, load this in via a __source dynamic function, after it runs it no longer exists
 func (env *Glisp) SourceStream(stream io.Reader) error {
-	expressions, err := env.ParseStream(stream)
+	return env.sourceStream(stream, "")
+}
+
+func (env *Glisp) sourceStream(stream io.Reader, filename string) error {
+	expressions, err := env.parseStream(stream, filename)
 
 	if err != nil {
 		return err
@@ -321,7 +389,7 @@ func (env *Glisp) SourceStream(stream io.Reader) error {
 }
 
 func (env *Glisp) SourceFile(file *os.File) error {
-	return env.SourceStream(bufio.NewReader(file))
+	return env.sourceStream(bufio.NewReader(file), file.Name())
 }
 
 func (env *Glisp) LoadExpressions(expressions []Sexp) error {
@@ -335,6 +403,7 @@ func (env *Glisp) LoadExpressions(expressions []Sexp) error {
 	}
 
 	env.mainfunc.fun = append(env.mainfunc.fun, gen.instructions...)
+	env.mainfunc.lines = append(env.mainfunc.lines, gen.lines...)
 	env.curfunc = env.mainfunc
 
 	return nil
@@ -342,7 +411,11 @@ func (env *Glisp) LoadExpressions(expressions []Sexp) error {
 
 // LoadStream, load this in via running a __main function and setting main on the environment
 func (env *Glisp) LoadStream(stream io.Reader) error {
-	expressions, err := env.ParseStream(stream)
+	return env.loadStream(stream, "")
+}
+
+func (env *Glisp) loadStream(stream io.Reader, filename string) error {
+	expressions, err := env.parseStream(stream, filename)
 
 	if err != nil {
 		return err
@@ -361,7 +434,7 @@ func (env *Glisp) EvalString(str string) (Sexp, error) {
 }
 
 func (env *Glisp) LoadFile(file *os.File) error {
-	return env.LoadStream(bufio.NewReader(file))
+	return env.loadStream(bufio.NewReader(file), file.Name())
 }
 
 func (env *Glisp) LoadString(str string) error {
@@ -374,12 +447,12 @@ func (env *Glisp) AddFunction(name string, function GlispUserFunction) {
 
 func (env *Glisp) AddGlobal(name string, obj Sexp) {
 	sym := env.MakeSymbol(name)
-	env.scopestack.elements[0].(Scope)[sym.number] = obj
+	env.scopestack.elements[0].(*sharedScope).bind(sym, obj)
 }
 
 func (env *Glisp) AddMacro(name string, function GlispUserFunction) {
 	sym := env.MakeSymbol(name)
-	env.macros[sym.number] = MakeUserFunction(name, function)
+	env.macros.set(sym, MakeUserFunction(name, function))
 }
 
 func (env *Glisp) ImportEval() {
@@ -404,36 +477,115 @@ func (env *Glisp) DumpFunctionByName(name string) error {
 	default:
 		return errors.New("not a function")
 	}
-	DumpFunction(fun)
+	FdumpFunction(env.stdout, fun)
 	return nil
 }
 
 func DumpFunction(fun GlispFunction) {
+	FdumpFunction(os.Stdout, fun)
+}
+
+func FdumpFunction(w io.Writer, fun GlispFunction) {
 	for _, instr := range fun {
-		fmt.Println("\t" + instr.InstrString())
+		fmt.Fprintln(w, "\t"+instr.InstrString())
 	}
 }
 
 func (env *Glisp) DumpEnvironment() {
-	fmt.Println("Instructions:")
+	fmt.Fprintln(env.stdout, "Instructions:")
 	if !env.curfunc.user {
-		DumpFunction(env.curfunc.fun)
+		FdumpFunction(env.stdout, env.curfunc.fun)
+	}
+	fmt.Fprintln(env.stdout, "Stack:")
+	env.datastack.FprintStack(env.stdout)
+	fmt.Fprintf(env.stdout, "PC: %d\n", env.pc)
+}
+
+// SetStdout sends what scripts print, and the environment's own dumps,
+// to w instead of os.Stdout. Environments duplicated from this one
+// afterwards, such as coroutines, inherit it.
+func (env *Glisp) SetStdout(w io.Writer) {
+	env.stdout = w
+}
+
+// SetStderr sets where extensions write errors and diagnostics.
+func (env *Glisp) SetStderr(w io.Writer) {
+	env.stderr = w
+}
+
+// SetStdin sets where extensions read standard input from.
+func (env *Glisp) SetStdin(r io.Reader) {
+	env.stdin = r
+}
+
+// capture is output being captured by with-output-to-string, and where
+// output went before it began.
+type capture struct {
+	stdout io.Writer
+	buf    *bytes.Buffer
+}
+
+// restoreOutput stops the captures begun after the first n, sending
+// output back where it went before them.
+func (env *Glisp) restoreOutput(n int) {
+	if len(env.captures) > n {
+		env.stdout = env.captures[n].stdout
+		env.captures = env.captures[:n]
 	}
-	fmt.Println("Stack:")
-	env.datastack.PrintStack()
-	fmt.Printf("PC: %d\n", env.pc)
+}
+
+func (env *Glisp) Stdout() io.Writer {
+	return env.stdout
+}
+
+func (env *Glisp) Stderr() io.Writer {
+	return env.stderr
+}
+
+func (env *Glisp) Stdin() io.Reader {
+	return env.stdin
 }
 
 func (env *Glisp) ReachedEnd() bool {
 	return env.pc == env.CurrentFunctionSize()
 }
 
+// CurrentPosition returns the source position of the instruction being
+// executed, if it is known.
+func (env *Glisp) CurrentPosition() (Position, bool) {
+	return env.curfunc.SourcePosition(env.pc)
+}
+
+// positionError annotates err with the position of the current
+// instruction, if it is known.
+func (env *Glisp) positionError(err error) error {
+	if pos, ok := env.CurrentPosition(); ok {
+		return positionedError{err, pos}
+	}
+	return err
+}
+
 func (env *Glisp) GetStackTrace(err error) string {
-	str := fmt.Sprintf("error in %s:%d: %v\n",
-		env.curfunc.name, env.pc, err)
+	var str string
+	var perr positionedError
+	if errors.As(err, &perr) {
+		// the error already says where it happened
+		str = fmt.Sprintf("error in %s: %v\n", env.curfunc.name, err)
+	} else if pos, ok := env.CurrentPosition(); ok {
+		str = fmt.Sprintf("error in %s at %s: %v\n",
+			env.curfunc.name, pos, err)
+	} else {
+		str = fmt.Sprintf("error in %s:%d: %v\n",
+			env.curfunc.name, env.pc, err)
+	}
 	for !env.addrstack.IsEmpty() {
 		fun, pos, _ := env.addrstack.PopAddr()
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		// the return address is just past the call instruction
+		if callpos, ok := fun.SourcePosition(pos - 1); ok {
+			str += fmt.Sprintf("in %s at %s\n", fun.name, callpos)
+		} else {
+			str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		}
 	}
 	return str
 }
@@ -442,6 +594,8 @@ func (env *Glisp) Clear() {
 	env.datastack.tos = -1
 	env.scopestack.tos = 0
 	env.addrstack.tos = -1
+	env.trystack.tos = -1
+	env.restoreOutput(0)
 	env.mainfunc = MakeFunction("__main", 0, false, make([]Instruction, 0))
 	env.curfunc = env.mainfunc
 	env.pc = 0
@@ -456,8 +610,9 @@ func (env *Glisp) FindObject(name string) (Sexp, bool) {
 	return obj, true
 }
 
-func (env *Glisp) Apply(fun SexpFunction, args []Sexp) (Sexp, error) {
+func (env *Glisp) Apply(fun SexpFunction, args []Sexp) (result Sexp, err error) {
 	if fun.user {
+		defer env.recoverPanic(&err)
 		return fun.userfun(env, fun.name, args)
 	}
 
@@ -467,7 +622,7 @@ func (env *Glisp) Apply(fun SexpFunction, args []Sexp) (Sexp, error) {
 	}
 
 	//log.Print("Apply Calling ", fun, " with ", len(args))
-	err := env.CallFunction(fun, len(args))
+	err = env.CallFunction(fun, len(args))
 	if err != nil {
 		return SexpNull, err
 	}
@@ -475,18 +630,66 @@ func (env *Glisp) Apply(fun SexpFunction, args []Sexp) (Sexp, error) {
 	return env.Run()
 }
 
-func (env *Glisp) Run() (Sexp, error) {
+// unwind restores the VM to the state saved by the innermost try block
+// and transfers control to its handler with the error on the data stack.
+func (env *Glisp) unwind(err error) error {
+	handler, perr := env.trystack.PopHandler()
+	if perr != nil {
+		return err
+	}
+
+	env.scopestack = handler.scopestack
+	env.scopestack.tos = handler.scopetop
+	env.datastack.tos = handler.datatop
+	env.addrstack.tos = handler.addrtop
+	env.stackstack.tos = handler.stacktop
+	env.restoreOutput(handler.capturetop)
+	env.curfunc = handler.function
+	env.pc = handler.position
+
+	if handler.raw {
+		env.datastack.PushExpr(pendingError{err})
+	} else {
+		env.datastack.PushExpr(ErrorValue(err))
+	}
+	return nil
+}
+
+func (env *Glisp) Run() (result Sexp, err error) {
+	// only handlers installed during this run may catch its errors,
+	// outer ones belong to a caller further up the Go stack
+	base := env.trystack.tos
+	captures := len(env.captures)
+
+	env.startRun()
+	defer env.endRun()
+	defer func() {
+		// an error leaving with-output-to-string ends its capture
+		if err != nil {
+			env.restoreOutput(captures)
+		}
+	}()
+	defer env.recoverPanic(&err)
+
 	for env.pc != -1 && !env.ReachedEnd() {
+		if env.limited {
+			if err := env.checkLimits(); err != nil {
+				return SexpNull, err
+			}
+		}
 		instr := env.curfunc.fun[env.pc]
 		err := instr.Execute(env)
 		if err != nil {
-			return SexpNull, err
+			if env.trystack.tos > base && catchable(err) &&
+				env.unwind(err) == nil {
+				continue
+			}
+			return SexpNull, env.withState(err)
 		}
 	}
 
 	if env.datastack.IsEmpty() {
-		env.DumpEnvironment()
-		os.Exit(-1)
+		return SexpNull, env.withState(internalError(ErrStackUnderflow))
 	}
 
 	return env.datastack.PopExpr()
@@ -0,0 +1,182 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// ErrStackUnderflow is returned when an instruction or a finished run
+// needs a value the data stack doesn't have.
+var ErrStackUnderflow = errors.New("stack underflow")
+
+// ErrTooDeep is returned when comparing or hashing values nested too
+// deeply, usually because one holds itself.
+var ErrTooDeep = errors.New("values nested too deeply to compare or hash")
+
+// ErrInternal matches every InternalError with errors.Is.
+var ErrInternal = errors.New("internal error")
+
+// ArityError reports a call with the wrong number of arguments. Expected
+// is -1 when the callee, usually a Go function, doesn't say how many it
+// wanted. It matches WrongNargs with errors.Is.
+type ArityError struct {
+	Function string
+	Expected int
+	Varargs  bool // Expected is a minimum
+	Got      int
+}
+
+func (e ArityError) Error() string {
+	switch {
+	case e.Expected < 0:
+		return fmt.Sprintf("wrong number of arguments (%d)", e.Got)
+	case e.Varargs:
+		return fmt.Sprintf("%s expected at least %d arguments, got %d",
+			e.Function, e.Expected, e.Got)
+	}
+	return fmt.Sprintf("%s expected %d arguments, got %d",
+		e.Function, e.Expected, e.Got)
+}
+
+func (e ArityError) Is(target error) bool {
+	return target == WrongNargs
+}
+
+// TypeError reports a value of the wrong type. Actual is the TypeName of
+// the value. It matches WrongType with errors.Is.
+type TypeError struct {
+	Expected string
+	Actual   string
+}
+
+func (e TypeError) Error() string {
+	return fmt.Sprintf("expected %s, got %s", e.Expected, e.Actual)
+}
+
+func (e TypeError) Is(target error) bool {
+	return target == WrongType
+}
+
+func typeError(expected string, actual Sexp) error {
+	return TypeError{Expected: expected, Actual: TypeName(actual)}
+}
+
+// UnboundSymbolError reports a reference to a symbol with no binding.
+type UnboundSymbolError struct {
+	Name string
+}
+
+func (e UnboundSymbolError) Error() string {
+	return fmt.Sprintf("symbol %s not found", e.Name)
+}
+
+// positionedError is an error annotated with the source position where
+// it happened.
+type positionedError struct {
+	err error
+	pos Position
+}
+
+func (e positionedError) Error() string {
+	return fmt.Sprintf("%v at %s", e.err, e.pos)
+}
+
+func (e positionedError) Unwrap() error {
+	return e.err
+}
+
+// VMState is a snapshot of the virtual machine, taken when an internal
+// error happens.
+type VMState struct {
+	Function    string
+	PC          int
+	Instruction string
+	Position    Position
+	Stack       []string
+}
+
+func (s VMState) String() string {
+	str := fmt.Sprintf("in %s at pc %d", s.Function, s.PC)
+	if s.Instruction != "" {
+		str += " (" + s.Instruction + ")"
+	}
+	if s.Position.Line > 0 {
+		str += " at " + s.Position.String()
+	}
+	return str
+}
+
+// InternalError reports a broken invariant in the interpreter, or a Go
+// panic, usually from a Go function scripts called. The environment may
+// be left inconsistent, so scripts cannot catch it.
+type InternalError struct {
+	Err   error
+	State VMState
+	Stack string // the Go stack, if Err came from a panic
+
+	hasState bool
+}
+
+func (e *InternalError) Error() string {
+	if !e.hasState {
+		return fmt.Sprintf("internal error: %v", e.Err)
+	}
+	return fmt.Sprintf("internal error: %v, %s", e.Err, e.State)
+}
+
+func (e *InternalError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InternalError) Is(target error) bool {
+	return target == ErrInternal
+}
+
+func internalError(err error) *InternalError {
+	return &InternalError{Err: err}
+}
+
+// snapshot records the state of the VM for an InternalError.
+func (env *Glisp) snapshot() VMState {
+	state := VMState{Function: env.curfunc.name, PC: env.pc}
+	if env.pc >= 0 && env.pc < len(env.curfunc.fun) {
+		state.Instruction = env.curfunc.fun[env.pc].InstrString()
+	}
+	if pos, ok := env.CurrentPosition(); ok {
+		state.Position = pos
+	}
+	for i := 0; i <= env.datastack.tos; i++ {
+		if elem, ok := env.datastack.elements[i].(DataStackElem); ok {
+			state.Stack = append(state.Stack, elem.expr.SexpString())
+		}
+	}
+	return state
+}
+
+// withState attaches the VM state to err if it is an InternalError
+// without one.
+func (env *Glisp) withState(err error) error {
+	var ierr *InternalError
+	if errors.As(err, &ierr) && !ierr.hasState {
+		ierr.State = env.snapshot()
+		ierr.hasState = true
+	}
+	return err
+}
+
+// recoverPanic turns a panic into an InternalError in *errp. It must be
+// deferred directly.
+func (env *Glisp) recoverPanic(errp *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	ierr := &InternalError{Err: fmt.Errorf("panic: %w", err),
+		Stack: string(debug.Stack())}
+	*errp = env.withState(ierr)
+}
@@ -0,0 +1,71 @@
+package glisp
+
+import (
+	"errors"
+)
+
+// UserError is the error produced by the throw builtin. It carries an
+// arbitrary glisp value which is handed to the matching catch clause.
+// Errors made by the error builtin also have a message.
+type UserError struct {
+	Data    Sexp
+	Message string
+}
+
+func (e UserError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	switch t := e.Data.(type) {
+	case SexpStr:
+		return string(t)
+	case SexpError:
+		return t.Err.Error()
+	}
+	return e.Data.SexpString()
+}
+
+// Unwrap gives the original error when an error value was thrown.
+func (e UserError) Unwrap() error {
+	if t, ok := e.Data.(SexpError); ok {
+		return t.Err
+	}
+	return nil
+}
+
+// pendingError holds an error on the data stack while a finally block
+// runs, so that it can be rethrown unchanged afterwards.
+type pendingError struct {
+	err error
+}
+
+func (p pendingError) SexpString() string {
+	return "[error " + p.err.Error() + "]"
+}
+
+// catchable reports whether a try block may handle err. Exceeding the
+// execution limits and internal errors always end the run.
+func catchable(err error) bool {
+	var lerr LimitError
+	return !errors.As(err, &lerr) && !errors.Is(err, ErrInternal)
+}
+
+// SexpError is an error as a glisp value. Catch clauses bind errors that
+// weren't thrown values to one.
+type SexpError struct {
+	Err error
+}
+
+func (e SexpError) SexpString() string {
+	return "[error " + e.Err.Error() + "]"
+}
+
+// ErrorValue converts an error into the value bound by a catch clause.
+// Thrown values are returned as-is, other errors become a SexpError.
+func ErrorValue(err error) Sexp {
+	var uerr UserError
+	if errors.As(err, &uerr) && uerr.Message == "" {
+		return uerr.Data
+	}
+	return SexpError{err}
+}
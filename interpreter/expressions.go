@@ -1,6 +1,7 @@
 package glisp
 
 import (
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -35,10 +36,11 @@ func (sent SexpSentinel) SexpString() string {
 type SexpPair struct {
 	head Sexp
 	tail Sexp
+	pos  *Position
 }
 
 func Cons(a Sexp, b Sexp) SexpPair {
-	return SexpPair{a, b}
+	return SexpPair{head: a, tail: b}
 }
 
 func (pair SexpPair) Head() Sexp {
@@ -50,24 +52,28 @@ func (pair SexpPair) Tail() Sexp {
 }
 
 func (pair SexpPair) SexpString() string {
+	return pair.printString(nil)
+}
+
+func (pair SexpPair) printString(seen printSet) string {
 	str := "("
 
 	for {
 		switch pair.tail.(type) {
 		case SexpPair:
-			str += pair.head.SexpString() + " "
+			str += printString(pair.head, seen) + " "
 			pair = pair.tail.(SexpPair)
 			continue
 		}
 		break
 	}
 
-	str += pair.head.SexpString()
+	str += printString(pair.head, seen)
 
 	if pair.tail == SexpNull {
 		str += ")"
 	} else {
-		str += " . " + pair.tail.SexpString() + ")"
+		str += " . " + printString(pair.tail, seen) + ")"
 	}
 
 	return str
@@ -80,6 +86,10 @@ type SexpHash struct {
 	KeyOrder *[]Sexp // must user pointers here, else hset! will fail to update.
 	GoStruct *interface{}
 	NumKeys  *int
+	// the position in KeyOrder of each key in Map, bucket by bucket.
+	// Deleting a key leaves a gap in KeyOrder until enough gaps build
+	// up to compact it.
+	Index *map[int][]int
 }
 type SexpInt int
 type SexpBool bool
@@ -90,26 +100,99 @@ type SexpStr string
 var SexpIntSize = reflect.TypeOf(SexpInt(0)).Bits()
 var SexpFloatSize = reflect.TypeOf(SexpFloat(0.0)).Bits()
 
+// printSet holds the arrays and hashes being printed, so that one which
+// holds itself, as aset! and hset! can make, prints as ... inside itself
+// instead of without end.
+type printSet map[printKey]bool
+
+type printKey struct {
+	ptr uintptr
+	len int
+}
+
+// enter adds the array or hash with the given reference to seen, unless
+// it is already being printed.
+func (seen printSet) enter(ref interface{}, n int) (printSet, printKey, bool) {
+	key := printKey{reflect.ValueOf(ref).Pointer(), n}
+	if seen[key] {
+		return seen, key, false
+	}
+	if seen == nil {
+		seen = make(printSet)
+	}
+	seen[key] = true
+	return seen, key, true
+}
+
+// printString is like expr.SexpString, but skips the values in seen.
+func printString(expr Sexp, seen printSet) string {
+	switch e := expr.(type) {
+	case SexpPair:
+		return e.printString(seen)
+	case SexpArray:
+		return e.printString(seen)
+	case SexpHash:
+		return e.printString(seen)
+	case SexpVector:
+		return SexpArray(e.Slice()).printString(seen)
+	case SexpMap:
+		return e.printString(seen)
+	}
+	return expr.SexpString()
+}
+
 func (arr SexpArray) SexpString() string {
+	return arr.printString(nil)
+}
+
+func (arr SexpArray) printString(seen printSet) string {
 	if len(arr) == 0 {
 		return "[]"
 	}
+	seen, key, ok := seen.enter(arr, len(arr))
+	if !ok {
+		return "[...]"
+	}
+	defer delete(seen, key)
 
-	str := "[" + arr[0].SexpString()
+	str := "[" + printString(arr[0], seen)
 	for _, sexp := range arr[1:] {
-		str += " " + sexp.SexpString()
+		str += " " + printString(sexp, seen)
 	}
 	str += "]"
 	return str
 }
 
+// SexpString prints a struct instance as a call to its constructor, like
+// (Point x: 1 y: 2), and any other hash as a literal.
 func (hash SexpHash) SexpString() string {
-	str := "{"
-	for _, arr := range hash.Map {
-		for _, pair := range arr {
-			str += pair.head.SexpString() + " "
-			str += pair.tail.SexpString() + " "
+	return hash.printString(nil)
+}
+
+func (hash SexpHash) printString(seen printSet) string {
+	isStruct := hash.TypeName != nil && *hash.TypeName != "hash"
+	seen, key, ok := seen.enter(hash.Map, 0)
+	if !ok {
+		if isStruct {
+			return "(" + *hash.TypeName + " ...)"
 		}
+		return "{...}"
+	}
+	defer delete(seen, key)
+
+	if isStruct {
+		str := "(" + *hash.TypeName
+		for _, pair := range hash.Pairs() {
+			str += " " + printString(pair.head, seen) + ": "
+			str += printString(pair.tail, seen)
+		}
+		return str + ")"
+	}
+
+	str := "{"
+	for _, pair := range hash.Pairs() {
+		str += printString(pair.head, seen) + " "
+		str += printString(pair.tail, seen) + " "
 	}
 	if len(str) > 1 {
 		return str[:len(str)-1] + "}"
@@ -128,8 +211,19 @@ func (i SexpInt) SexpString() string {
 	return strconv.Itoa(int(i))
 }
 
+// SexpString gives the shortest digits that read back as the same float,
+// always with a point or exponent so they don't read back as an integer.
 func (f SexpFloat) SexpString() string {
-	return strconv.FormatFloat(float64(f), 'g', 5, SexpFloatSize)
+	abs := math.Abs(float64(f))
+	if abs == 0 || (abs >= 1e-4 && abs < 1e21) {
+		str := strconv.FormatFloat(float64(f), 'f', -1, SexpFloatSize)
+		if !strings.Contains(str, ".") {
+			str += ".0"
+		}
+		return str
+	}
+	str := strconv.FormatFloat(float64(f), 'g', -1, SexpFloatSize)
+	return strings.Replace(str, "e+", "e", 1)
 }
 
 func (c SexpChar) SexpString() string {
@@ -143,6 +237,7 @@ func (s SexpStr) SexpString() string {
 type SexpSymbol struct {
 	name   string
 	number int
+	pos    *Position
 }
 
 func (sym SexpSymbol) SexpString() string {
@@ -165,12 +260,22 @@ type SexpFunction struct {
 	fun        GlispFunction
 	userfun    GlispUserFunction
 	closeScope *Stack
+	lines      []*Position
 }
 
 func (sf SexpFunction) SexpString() string {
 	return "fn [" + sf.name + "]"
 }
 
+// SourcePosition looks up the source position of the instruction at pc
+// in the function's line table.
+func (sf SexpFunction) SourcePosition(pc int) (Position, bool) {
+	if pc < 0 || pc >= len(sf.lines) || sf.lines[pc] == nil {
+		return Position{}, false
+	}
+	return *sf.lines[pc], true
+}
+
 func IsTruthy(expr Sexp) bool {
 	switch e := expr.(type) {
 	case SexpBool:
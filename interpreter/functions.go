@@ -1,10 +1,11 @@
 package glisp
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"os"
+	"math/big"
 )
 
 var WrongNargs error = errors.New("wrong number of arguments")
@@ -98,6 +99,8 @@ func ComplementFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return ^t, nil
 	case SexpChar:
 		return ^t, nil
+	case SexpBigInt:
+		return MakeBigInt(new(big.Int).Not(t.v)), nil
 	}
 
 	return SexpNull, errors.New("Argument to bit-not should be integer")
@@ -123,7 +126,7 @@ func NumericFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	}
 
 	for _, expr := range args[1:] {
-		accum, err = NumericDo(op, accum, expr)
+		accum, err = NumericDoContext(op, accum, expr, env.decimals)
 		if err != nil {
 			return SexpNull, err
 		}
@@ -149,9 +152,14 @@ func FirstFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return expr.head, nil
 	case SexpArray:
 		return expr[0], nil
+	case SexpVector:
+		if expr.Len() > 0 {
+			return expr.Nth(0), nil
+		}
+		return SexpNull, nil
 	}
 
-	return SexpNull, WrongType
+	return SexpNull, typeError("list or array", args[0])
 }
 
 func RestFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
@@ -167,13 +175,18 @@ func RestFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 			return expr, nil
 		}
 		return expr[1:], nil
+	case SexpVector:
+		if expr.Len() == 0 {
+			return expr, nil
+		}
+		return MakeVector(expr.Slice()[1:]), nil
 	case SexpSentinel:
 		if expr == SexpNull {
 			return SexpNull, nil
 		}
 	}
 
-	return SexpNull, WrongType
+	return SexpNull, typeError("list or array", args[0])
 }
 
 func ArrayAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
@@ -185,6 +198,14 @@ func ArrayAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch t := args[0].(type) {
 	case SexpArray:
 		arr = t
+	case SexpVector:
+		if name != "aget" {
+			return SexpNull, errors.New("vectors are immutable, use assoc")
+		}
+		if i, ok := args[1].(SexpInt); ok && int(i) >= 0 && int(i) < t.Len() {
+			return t.Nth(int(i)), nil
+		}
+		return SexpNull, errors.New("Array index out of bounds")
 	default:
 		return SexpNull, errors.New("First argument of aget must be array")
 	}
@@ -250,6 +271,8 @@ func HashAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch e := args[0].(type) {
 	case SexpHash:
 		hash = e
+	case SexpMap:
+		return mapAccess(name, e, args[1:])
 	default:
 		return SexpNull, errors.New("first argument of hget must be hash")
 	}
@@ -261,12 +284,37 @@ func HashAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		}
 		return hash.HashGet(args[1])
 	case "hset!":
-		err := hash.HashSet(args[1], args[2])
+		if len(args) != 3 {
+			return SexpNull, WrongNargs
+		}
+		err := env.checkStructKey(hash, args[1])
+		if err != nil {
+			return SexpNull, err
+		}
+		existing, err := hash.HashGetDefault(args[1], SexpEnd)
+		if err != nil {
+			return SexpNull, err
+		}
+		if existing == SexpEnd {
+			n, err := HashCountKeys(hash)
+			if err != nil {
+				return SexpNull, err
+			}
+			err = env.CheckCollectionSize(n + 1)
+			if err != nil {
+				return SexpNull, err
+			}
+		}
+		err = hash.HashSet(args[1], args[2])
 		return SexpNull, err
 	case "hdel!":
 		if len(args) != 2 {
 			return SexpNull, WrongNargs
 		}
+		if _, ok := env.LookupStruct(*hash.TypeName); ok {
+			return SexpNull, fmt.Errorf("cannot delete fields of %s",
+				*hash.TypeName)
+		}
 		err := hash.HashDelete(args[1])
 		return SexpNull, err
 	}
@@ -274,6 +322,144 @@ func HashAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, nil
 }
 
+func mapAccess(name string, m SexpMap, args []Sexp) (Sexp, error) {
+	if name != "hget" {
+		return SexpNull, errors.New("maps are immutable, use assoc or dissoc")
+	}
+	val, found, err := m.Get(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	if found {
+		return val, nil
+	}
+	if len(args) == 2 {
+		return args[1], nil
+	}
+	return SexpNull, fmt.Errorf("key %s not found", args[0].SexpString())
+}
+
+// emptyLike makes an empty hash or map to hold entries taken from coll.
+// A new hash keeps the type name of the old one.
+func emptyLike(coll Sexp) (Sexp, error) {
+	switch t := coll.(type) {
+	case SexpHash:
+		return MakeHash(nil, *t.TypeName)
+	case SexpMap:
+		return SexpMap{}, nil
+	}
+	return SexpNull, typeError("hash or map", coll)
+}
+
+func putEntry(coll Sexp, key Sexp, val Sexp) (Sexp, error) {
+	switch t := coll.(type) {
+	case SexpHash:
+		return t, t.HashSet(key, val)
+	case SexpMap:
+		return t.Assoc(key, val)
+	}
+	return SexpNull, typeError("hash or map", coll)
+}
+
+// HashEntriesFunction implements hkeys, hvals and hpairs, which list the
+// entries of a hash as an array, in the order the keys were added.
+func HashEntriesFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	pairs, ok := mapPairs(args[0])
+	if !ok {
+		return SexpNull, typeError("hash or map", args[0])
+	}
+
+	arr := make([]Sexp, len(pairs))
+	for i, pair := range pairs {
+		switch name {
+		case "hkeys":
+			arr[i] = pair.head
+		case "hvals":
+			arr[i] = pair.tail
+		default:
+			arr[i] = SexpArray{pair.head, pair.tail}
+		}
+	}
+	return SexpArray(arr), nil
+}
+
+// HashMergeFunction makes a new hash with the entries of all its
+// arguments, where later ones win. Merging into a struct instance makes
+// an instance only if the fields are still exactly those of its type.
+func HashMergeFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+	merged, err := emptyLike(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+
+	var pairs []SexpPair
+	for _, arg := range args {
+		argpairs, ok := mapPairs(arg)
+		if !ok {
+			return SexpNull, typeError("hash or map", arg)
+		}
+		pairs = append(pairs, argpairs...)
+	}
+	// there may be fewer keys, if some are repeated
+	if err := env.CheckCollectionSize(len(pairs)); err != nil {
+		return SexpNull, err
+	}
+
+	for _, pair := range pairs {
+		merged, err = putEntry(merged, pair.head, pair.tail)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return env.asInstance(merged), nil
+}
+
+// HashTransformFunction implements (hfilter f hash), keeping the entries
+// for which (f key value) is true, and (hmap f hash), replacing each value
+// with (f key value). Both make a new hash, which is a plain hash if
+// hfilter drops fields of a struct instance.
+func HashTransformFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	fun, ok := args[0].(SexpFunction)
+	if !ok {
+		return SexpNull, typeError("function", args[0])
+	}
+	pairs, ok := mapPairs(args[1])
+	if !ok {
+		return SexpNull, typeError("hash or map", args[1])
+	}
+	result, err := emptyLike(args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+
+	for _, pair := range pairs {
+		res, err := env.Apply(fun, []Sexp{pair.head, pair.tail})
+		if err != nil {
+			return SexpNull, err
+		}
+		val := pair.tail
+		if name == "hmap" {
+			val = res
+		} else if !IsTruthy(res) {
+			continue
+		}
+		result, err = putEntry(result, pair.head, val)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return env.asInstance(result), nil
+}
+
 func SliceFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 3 {
 		return SexpNull, WrongNargs
@@ -302,6 +488,11 @@ func SliceFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch t := args[0].(type) {
 	case SexpArray:
 		return SexpArray(t[start:end]), nil
+	case SexpVector:
+		if start < 0 || end > t.Len() || start > end {
+			return SexpNull, errors.New("slice bounds out of range")
+		}
+		return MakeVector(t.Slice()[start:end]), nil
 	case SexpStr:
 		return SexpStr(t[start:end]), nil
 	}
@@ -320,7 +511,12 @@ func LenFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	case SexpStr:
 		return SexpInt(len(t)), nil
 	case SexpHash:
-		return SexpInt(HashCountKeys(t)), nil
+		n, err := HashCountKeys(t)
+		return SexpInt(n), err
+	case SexpVector:
+		return SexpInt(t.Len()), nil
+	case SexpMap:
+		return SexpInt(t.Len()), nil
 	}
 
 	return SexpInt(0), errors.New("argument must be string or array")
@@ -333,8 +529,19 @@ func AppendFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 
 	switch t := args[0].(type) {
 	case SexpArray:
+		if err := env.CheckCollectionSize(len(t) + 1); err != nil {
+			return SexpNull, err
+		}
 		return SexpArray(append(t, args[1])), nil
+	case SexpVector:
+		if err := env.CheckCollectionSize(t.Len() + 1); err != nil {
+			return SexpNull, err
+		}
+		return t.Conj(args[1]), nil
 	case SexpStr:
+		if err := env.CheckCollectionSize(len(t) + 1); err != nil {
+			return SexpNull, err
+		}
 		return AppendStr(t, args[1])
 	}
 
@@ -348,16 +555,51 @@ func ConcatFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 
 	switch t := args[0].(type) {
 	case SexpArray:
+		if other, ok := args[1].(SexpArray); ok {
+			err := env.CheckCollectionSize(len(t) + len(other))
+			if err != nil {
+				return SexpNull, err
+			}
+		}
 		return ConcatArray(t, args[1])
+	case SexpVector:
+		other, ok := args[1].(SexpVector)
+		if !ok {
+			return SexpNull, errors.New("second argument is not a vector")
+		}
+		err := env.CheckCollectionSize(t.Len() + other.Len())
+		if err != nil {
+			return SexpNull, err
+		}
+		for _, item := range other.Slice() {
+			t = t.Conj(item)
+		}
+		return t, nil
 	case SexpStr:
+		if other, ok := args[1].(SexpStr); ok {
+			err := env.CheckCollectionSize(len(t) + len(other))
+			if err != nil {
+				return SexpNull, err
+			}
+		}
 		return ConcatStr(t, args[1])
 	case SexpPair:
+		err := env.CheckCollectionSize(ListLen(t) + ListLen(args[1]))
+		if err != nil {
+			return SexpNull, err
+		}
 		return ConcatList(t, args[1])
 	}
 
 	return SexpNull, errors.New("expected strings or arrays")
 }
 
+// ExpressionReader is a value read can take expressions from one at a
+// time, such as an I/O port.
+type ExpressionReader interface {
+	ReadExpression(env *Glisp) (Sexp, error)
+}
+
 func ReadFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
@@ -366,8 +608,10 @@ func ReadFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch t := args[0].(type) {
 	case SexpStr:
 		str = string(t)
+	case ExpressionReader:
+		return t.ReadExpression(env)
 	default:
-		return SexpNull, WrongType
+		return SexpNull, typeError("string", args[0])
 	}
 	lexer := NewLexerFromStream(bytes.NewBuffer([]byte(str)))
 	parser := Parser{lexer, env}
@@ -379,11 +623,13 @@ func EvalFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, WrongNargs
 	}
 	newenv := env.Duplicate()
-	err := newenv.LoadExpressions(args)
+	err := newenv.LoadExpressions([]Sexp{env.codeForm(args[0])})
 	if err != nil {
 		return SexpNull, errors.New("failed to compile expression")
 	}
 	newenv.pc = 0
+	env.lendBudget(newenv)
+	defer env.reclaimBudget(newenv)
 	return newenv.Run()
 }
 
@@ -407,6 +653,10 @@ func TypeQueryFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		result = IsFloat(args[0])
 	case "int?":
 		result = IsInt(args[0])
+	case "ratio?":
+		result = IsRatio(args[0])
+	case "decimal?":
+		result = IsDecimal(args[0])
 	case "char?":
 		result = IsChar(args[0])
 	case "symbol?":
@@ -415,6 +665,12 @@ func TypeQueryFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		result = IsString(args[0])
 	case "hash?":
 		result = IsHash(args[0])
+	case "error?":
+		result = IsError(args[0])
+	case "vector?":
+		result = IsVector(args[0])
+	case "map?":
+		result = IsMap(args[0])
 	case "zero?":
 		result = IsZero(args[0])
 	case "empty?":
@@ -438,14 +694,40 @@ func PrintFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		str = expr.SexpString()
 	}
 
+	var err error
 	switch name {
 	case "println":
-		fmt.Println(str)
+		_, err = fmt.Fprintln(env.stdout, str)
 	case "print":
-		fmt.Print(str)
+		_, err = fmt.Fprint(env.stdout, str)
 	}
 
-	return SexpNull, nil
+	return SexpNull, err
+}
+
+// CaptureOutputFunction implements (call-with-output-string f), which
+// calls f and returns everything it printed as a string.
+func CaptureOutputFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	fun, ok := args[0].(SexpFunction)
+	if !ok {
+		return SexpNull, errors.New("argument of " + name + " must be a function")
+	}
+
+	var buf bytes.Buffer
+	stdout := env.stdout
+	env.stdout = &buf
+	_, err := env.Apply(fun, []Sexp{})
+	env.stdout = stdout
+	if err != nil {
+		return SexpNull, err
+	}
+	if err := env.CheckCollectionSize(buf.Len()); err != nil {
+		return SexpNull, err
+	}
+	return SexpStr(buf.String()), nil
 }
 
 func NotFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
@@ -474,6 +756,8 @@ func ApplyFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch e := args[1].(type) {
 	case SexpArray:
 		funargs = e
+	case SexpVector:
+		funargs = e.Slice()
 	case SexpPair:
 		var err error
 		funargs, err = ListToArray(e)
@@ -503,6 +787,12 @@ func MapFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	switch e := args[1].(type) {
 	case SexpArray:
 		return MapArray(env, fun, e)
+	case SexpVector:
+		arr, err := MapArray(env, fun, e.Slice())
+		if err != nil {
+			return SexpNull, err
+		}
+		return MakeVector(arr), nil
 	case SexpPair:
 		return MapList(env, fun, e)
 	}
@@ -522,6 +812,10 @@ func MakeArrayFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, errors.New("first argument must be integer")
 	}
 
+	if err := env.CheckCollectionSize(size); err != nil {
+		return SexpNull, err
+	}
+
 	var fill Sexp
 	if len(args) == 2 {
 		fill = args[1]
@@ -538,6 +832,14 @@ func MakeArrayFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func ConstructorFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	size := len(args)
+	if name == "hash" || name == "hash-map" {
+		size /= 2
+	}
+	if err := env.CheckCollectionSize(size); err != nil {
+		return SexpNull, err
+	}
+
 	switch name {
 	case "array":
 		return SexpArray(args), nil
@@ -545,10 +847,168 @@ func ConstructorFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return MakeList(args), nil
 	case "hash":
 		return MakeHash(args, "hash")
+	case "vector":
+		return MakeVector(args), nil
+	case "hash-map":
+		return MakeMap(args)
 	}
 	return SexpNull, errors.New("invalid constructor")
 }
 
+// assocOne sets key to val in a vector or map, giving a new one.
+// Assigning one past the end of a vector appends to it.
+func assocOne(env *Glisp, coll Sexp, key Sexp, val Sexp) (Sexp, error) {
+	switch t := coll.(type) {
+	case SexpVector:
+		i, ok := key.(SexpInt)
+		if !ok {
+			return SexpNull, typeError("int", key)
+		}
+		if int(i) == t.Len() {
+			if err := env.CheckCollectionSize(t.Len() + 1); err != nil {
+				return SexpNull, err
+			}
+			return t.Conj(val), nil
+		}
+		if i < 0 || int(i) >= t.Len() {
+			return SexpNull, errors.New("Array index out of bounds")
+		}
+		return t.Assoc(int(i), val), nil
+	case SexpMap:
+		m, err := t.Assoc(key, val)
+		if err != nil {
+			return SexpNull, err
+		}
+		// replacing the value of a key doesn't grow the map
+		if m.Len() > t.Len() {
+			if err := env.CheckCollectionSize(m.Len()); err != nil {
+				return SexpNull, err
+			}
+		}
+		return m, nil
+	}
+	return SexpNull, typeError("vector or map", coll)
+}
+
+func AssocFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return SexpNull, WrongNargs
+	}
+
+	coll := args[0]
+	for i := 1; i < len(args); i += 2 {
+		var err error
+		coll, err = assocOne(env, coll, args[i], args[i+1])
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return coll, nil
+}
+
+func DissocFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+
+	m, ok := args[0].(SexpMap)
+	if !ok {
+		return SexpNull, typeError("map", args[0])
+	}
+	for _, key := range args[1:] {
+		var err error
+		m, err = m.Dissoc(key)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return m, nil
+}
+
+// ConjFunction adds items to a collection where they fit best: the end
+// of a vector, the front of a list, or into a map given [key value].
+func ConjFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+
+	coll := args[0]
+	for _, item := range args[1:] {
+		switch t := coll.(type) {
+		case SexpVector:
+			if err := env.CheckCollectionSize(t.Len() + 1); err != nil {
+				return SexpNull, err
+			}
+			coll = t.Conj(item)
+		case SexpMap:
+			var entry []Sexp
+			switch e := item.(type) {
+			case SexpVector:
+				entry = e.Slice()
+			case SexpArray:
+				entry = e
+			}
+			if len(entry) != 2 {
+				return SexpNull, errors.New("conj to a map needs [key value]")
+			}
+			var err error
+			coll, err = assocOne(env, t, entry[0], entry[1])
+			if err != nil {
+				return SexpNull, err
+			}
+		case SexpPair:
+			coll = Cons(item, t)
+		default:
+			if coll != SexpNull {
+				return SexpNull, typeError("vector, map or list", coll)
+			}
+			coll = Cons(item, coll)
+		}
+	}
+	return coll, nil
+}
+
+// UpdateFunction implements (update coll key f args...), which sets key
+// to the result of calling f on its old value and args. A missing map
+// key has the value ().
+func UpdateFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 3 {
+		return SexpNull, WrongNargs
+	}
+	fun, ok := args[2].(SexpFunction)
+	if !ok {
+		return SexpNull, typeError("function", args[2])
+	}
+
+	var old Sexp
+	switch t := args[0].(type) {
+	case SexpVector:
+		i, ok := args[1].(SexpInt)
+		if !ok {
+			return SexpNull, typeError("int", args[1])
+		}
+		if i < 0 || int(i) >= t.Len() {
+			return SexpNull, errors.New("Array index out of bounds")
+		}
+		old = t.Nth(int(i))
+	case SexpMap:
+		var err error
+		old, _, err = t.Get(args[1])
+		if err != nil {
+			return SexpNull, err
+		}
+	default:
+		return SexpNull, typeError("vector or map", args[0])
+	}
+
+	funargs := append([]Sexp{old}, args[3:]...)
+	val, err := env.Apply(fun, funargs)
+	if err != nil {
+		return SexpNull, err
+	}
+	return assocOne(env, args[0], args[1], val)
+}
+
 func SymnumFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
@@ -561,6 +1021,73 @@ func SymnumFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, errors.New("argument must be symbol")
 }
 
+// GensymFunction makes a new symbol that no other symbol is equal to,
+// named with an optional prefix.
+func GensymFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) > 1 {
+		return SexpNull, WrongNargs
+	}
+
+	prefix := "G__"
+	if len(args) == 1 {
+		switch t := args[0].(type) {
+		case SexpStr:
+			prefix = string(t)
+		case SexpSymbol:
+			prefix = t.name
+		default:
+			return SexpNull, typeError("string or symbol", args[0])
+		}
+	}
+	return env.GenSymbol(prefix), nil
+}
+
+func ThrowFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+
+	return SexpNull, UserError{Data: args[0]}
+}
+
+// ErrorFunction makes an error value from a message and optional data,
+// to be thrown or returned.
+func ErrorFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return SexpNull, WrongNargs
+	}
+	msg, ok := args[0].(SexpStr)
+	if !ok {
+		return SexpNull, typeError("string", args[0])
+	}
+	var data Sexp = SexpNull
+	if len(args) == 2 {
+		data = args[1]
+	}
+	return SexpError{UserError{Data: data, Message: string(msg)}}, nil
+}
+
+// ErrorAccessFunction implements error-message and error-data. Only
+// errors made by the error builtin have data.
+func ErrorAccessFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	e, ok := args[0].(SexpError)
+	if !ok {
+		return SexpNull, typeError("error", args[0])
+	}
+
+	if name == "error-message" {
+		return SexpStr(e.Err.Error()), nil
+	}
+	var uerr UserError
+	if errors.As(e.Err, &uerr) {
+		return uerr.Data, nil
+	}
+	return SexpNull, nil
+}
+
 func SourceFileFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	if len(args) < 1 {
 		return SexpNull, WrongNargs
@@ -586,18 +1113,16 @@ func SourceFileFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 				expr = list.tail
 			}
 		case SexpStr:
-			var f *os.File
-			var err error
-
-			if f, err = os.Open(string(t)); err != nil {
+			f, err := env.OpenFile(string(t))
+			if err != nil {
 				return err
 			}
 
-			if err = env.SourceFile(f); err != nil {
+			err = env.sourceStream(bufio.NewReader(f), string(t))
+			f.Close()
+			if err != nil {
 				return err
 			}
-
-			f.Close()
 		default:
 			return fmt.Errorf("%v: Expected `string`, `list`, `array` given type %T val %v", name, item, item)
 		}
@@ -614,7 +1139,7 @@ func SourceFileFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, nil
 }
 
-var MissingFunction = SexpFunction{"__missing", true, 0, false, nil, nil, nil}
+var MissingFunction = SexpFunction{"__missing", true, 0, false, nil, nil, nil, nil}
 
 func MakeFunction(name string, nargs int, varargs bool,
 	fun GlispFunction) SexpFunction {
@@ -666,12 +1191,17 @@ var BuiltinFunctions = map[string]GlispUserFunction{
 	"hash?":      TypeQueryFunction,
 	"number?":    TypeQueryFunction,
 	"int?":       TypeQueryFunction,
+	"ratio?":     TypeQueryFunction,
+	"decimal?":   TypeQueryFunction,
 	"float?":     TypeQueryFunction,
 	"char?":      TypeQueryFunction,
 	"symbol?":    TypeQueryFunction,
 	"string?":    TypeQueryFunction,
 	"zero?":      TypeQueryFunction,
 	"empty?":     TypeQueryFunction,
+	"error?":     TypeQueryFunction,
+	"vector?":    TypeQueryFunction,
+	"map?":       TypeQueryFunction,
 	"println":    PrintFunction,
 	"print":      PrintFunction,
 	"not":        NotFunction,
@@ -684,6 +1214,12 @@ var BuiltinFunctions = map[string]GlispUserFunction{
 	"hget":       HashAccessFunction,
 	"hset!":      HashAccessFunction,
 	"hdel!":      HashAccessFunction,
+	"hkeys":      HashEntriesFunction,
+	"hvals":      HashEntriesFunction,
+	"hpairs":     HashEntriesFunction,
+	"hmerge":     HashMergeFunction,
+	"hfilter":    HashTransformFunction,
+	"hmap":       HashTransformFunction,
 	"slice":      SliceFunction,
 	"len":        LenFunction,
 	"append":     AppendFunction,
@@ -691,8 +1227,24 @@ var BuiltinFunctions = map[string]GlispUserFunction{
 	"array":      ConstructorFunction,
 	"list":       ConstructorFunction,
 	"hash":       ConstructorFunction,
+	"vector":     ConstructorFunction,
+	"hash-map":   ConstructorFunction,
 	"symnum":     SymnumFunction,
+	"gensym":     GensymFunction,
 	"str":        StringifyFunction,
+	"decimal":    DecimalFunction,
+	"throw":      ThrowFunction,
+	"error":      ErrorFunction,
+	"assoc":      AssocFunction,
+	"dissoc":     DissocFunction,
+	"conj":       ConjFunction,
+	"update":     UpdateFunction,
+	"satisfies?": SatisfiesFunction,
+
+	"call-with-output-string": CaptureOutputFunction,
+	"error-message":           ErrorAccessFunction,
+	"error-data":              ErrorAccessFunction,
+	"set-decimal-context!":    SetDecimalContextFunction,
 }
 
 func StringifyFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
@@ -700,5 +1252,15 @@ func StringifyFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, WrongNargs
 	}
 
-	return SexpStr(args[0].SexpString()), nil
+	// decimals are mostly amounts to display, so leave off the M
+	var str string
+	if d, ok := args[0].(SexpDecimal); ok {
+		str = d.String()
+	} else {
+		str = args[0].SexpString()
+	}
+	if err := env.CheckCollectionSize(len(str)); err != nil {
+		return SexpNull, err
+	}
+	return SexpStr(str), nil
 }
@@ -3,6 +3,7 @@ package glisp
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type Generator struct {
@@ -11,6 +12,19 @@ type Generator struct {
 	tail         bool
 	scopes       int
 	instructions []Instruction
+	lines        []*Position
+	pos          *Position
+	loops        *Stack
+	tries        []tryFrame
+}
+
+// tryFrame is a try block or output capture the code being generated
+// is in, which break and continue must leave properly.
+type tryFrame struct {
+	scopes  int    // scopes open when the try block was entered
+	handler bool   // whether its handler is installed
+	finally []Sexp // its finally clause, if it has one
+	capture bool   // whether it's a capture instead of a try block
 }
 
 type Loop struct {
@@ -19,14 +33,36 @@ type Loop struct {
 	loopLen        int
 	breakOffset    int // i.e. relative to loopStart
 	continueOffset int // i.e. relative to loopStart
+	scopes         int // scopes open when the loop was entered
+	tries          int // try blocks open when the loop was entered
 }
 
 func (loop *Loop) IsStackElem() {}
 
+// resolve replaces the break and continue placeholders of this loop with
+// jumps, given the offset of the instructions from the loop start.
+func (loop *Loop) resolve(instructions []Instruction, offset int) {
+	for i, instr := range instructions {
+		placeholder, ok := instr.(loopJumpInstr)
+		if !ok || placeholder.loop != loop {
+			continue
+		}
+		target := loop.continueOffset
+		if placeholder.brk {
+			target = loop.breakOffset
+		}
+		instructions[i] = JumpInstr{target - (offset + i)}
+	}
+}
+
+const LoopStackSize = 5
+
 func NewGenerator(env *Glisp) *Generator {
 	gen := new(Generator)
 	gen.env = env
 	gen.instructions = make([]Instruction, 0)
+	gen.lines = make([]*Position, 0)
+	gen.loops = NewStack(LoopStackSize)
 	// tail marks whether or not we are in the tail position
 	gen.tail = false
 	// scopes is the number of extra (non-function) scopes we've created
@@ -35,11 +71,33 @@ func NewGenerator(env *Glisp) *Generator {
 }
 
 func (gen *Generator) AddInstructions(instr []Instruction) {
-	gen.instructions = append(gen.instructions, instr...)
+	for _, in := range instr {
+		gen.AddInstruction(in)
+	}
 }
 
 func (gen *Generator) AddInstruction(instr Instruction) {
 	gen.instructions = append(gen.instructions, instr)
+	gen.lines = append(gen.lines, gen.pos)
+}
+
+// AddGenerated appends the code of another generator along with its
+// line table.
+func (gen *Generator) AddGenerated(subgen *Generator) {
+	gen.instructions = append(gen.instructions, subgen.instructions...)
+	gen.lines = append(gen.lines, subgen.lines...)
+}
+
+// subGenerator returns a generator for code that will be spliced into
+// this one, sharing its function context.
+func (gen *Generator) subGenerator() *Generator {
+	subgen := NewGenerator(gen.env)
+	subgen.scopes = gen.scopes
+	subgen.funcname = gen.funcname
+	subgen.pos = gen.pos
+	subgen.loops = gen.loops
+	subgen.tries = gen.tries
+	return subgen
 }
 
 func (gen *Generator) GenerateBegin(expressions []Sexp) error {
@@ -105,7 +163,9 @@ func buildSexpFun(env *Glisp, name string, funcargs SexpArray,
 	gen.AddInstruction(ReturnInstr{nil})
 
 	newfunc := GlispFunction(gen.instructions)
-	return MakeFunction(gen.funcname, nargs, varargs, newfunc), nil
+	sfun := MakeFunction(gen.funcname, nargs, varargs, newfunc)
+	sfun.lines = gen.lines
+	return sfun, nil
 }
 
 func (gen *Generator) GenerateFn(args []Sexp) error {
@@ -132,7 +192,19 @@ func (gen *Generator) GenerateFn(args []Sexp) error {
 	return nil
 }
 
+// topLevel reports whether definitions made here are global, and so
+// belong to the current namespace.
+func (gen *Generator) topLevel() bool {
+	return gen.funcname == "" && gen.scopes == 0
+}
+
 func (gen *Generator) GenerateDef(args []Sexp) error {
+	return gen.generateDef(args, true)
+}
+
+// generateDef compiles def, or def- for a definition that is private to
+// the current namespace.
+func (gen *Generator) generateDef(args []Sexp, public bool) error {
 	if len(args) != 2 {
 		return errors.New("Wrong number of arguments to def")
 	}
@@ -145,6 +217,10 @@ func (gen *Generator) GenerateDef(args []Sexp) error {
 		return errors.New("Definition name must by symbol")
 	}
 
+	if gen.topLevel() {
+		sym = gen.env.qualifyDef(sym, public)
+	}
+
 	gen.tail = false
 	err := gen.Generate(args[1])
 	if err != nil {
@@ -155,7 +231,40 @@ func (gen *Generator) GenerateDef(args []Sexp) error {
 	return nil
 }
 
+func (gen *Generator) GenerateSet(args []Sexp) error {
+	if len(args) != 2 {
+		return errors.New("Wrong number of arguments to set!")
+	}
+
+	var sym SexpSymbol
+	switch expr := args[0].(type) {
+	case SexpSymbol:
+		sym = expr
+	default:
+		return errors.New("Assignment target must be symbol")
+	}
+	sym, qualified, err := gen.env.resolveSymbol(sym)
+	if err != nil {
+		return err
+	}
+
+	gen.tail = false
+	err = gen.Generate(args[1])
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(SetInstr{sym, qualified})
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
 func (gen *Generator) GenerateDefn(args []Sexp) error {
+	return gen.generateDefn(args, true)
+}
+
+// generateDefn compiles defn, or defn- for a function that is private to
+// the current namespace.
+func (gen *Generator) generateDefn(args []Sexp, public bool) error {
 	if len(args) < 3 {
 		return errors.New("Wrong number of arguments to defn")
 	}
@@ -181,6 +290,10 @@ func (gen *Generator) GenerateDefn(args []Sexp) error {
 		return err
 	}
 
+	if gen.topLevel() {
+		sym = gen.env.qualifyDef(sym, public)
+	}
+
 	gen.AddInstruction(PushInstr{sfun})
 	gen.AddInstruction(PutInstr{sym})
 	gen.AddInstruction(PushInstr{SexpNull})
@@ -208,15 +321,248 @@ func (gen *Generator) GenerateDefmac(args []Sexp) error {
 	default:
 		return errors.New("Definition name must by symbol")
 	}
+	// macros are defined at compile time, so always at top level
+	sym = gen.env.qualifyDef(sym, true)
 
 	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:])
 	if err != nil {
 		return err
 	}
 
-	gen.env.macros[sym.number] = sfun
+	gen.env.macros.set(sym, sfun)
+	gen.AddInstruction(PushInstr{SexpNull})
+
+	return nil
+}
+
+// GenerateDefstruct compiles (defstruct Name field... (field default)...),
+// which defines a record type along with its constructor, type predicate
+// and field accessors. Defaults are evaluated each time the constructor
+// needs them, so instances don't share a default array or hash.
+func (gen *Generator) GenerateDefstruct(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	name, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("struct name must be symbol")
+	}
+	if name.name == "hash" || IsKeyword(name) {
+		return fmt.Errorf("%s cannot be a struct name", name.name)
+	}
+	unqualified := name
+	if gen.topLevel() {
+		name = gen.env.qualifyDef(name, true)
+	}
+
+	fields := make([]SexpSymbol, len(args)-1)
+	defaults := make([]bool, len(args)-1)
+	oldtail := gen.tail
+	gen.tail = false
+	for i, expr := range args[1:] {
+		switch t := expr.(type) {
+		case SexpSymbol:
+			fields[i] = t
+		case SexpPair:
+			spec, _ := ListToArray(t)
+			if len(spec) != 2 {
+				return errors.New("field default must be (field value)")
+			}
+			field, ok := spec[0].(SexpSymbol)
+			if !ok {
+				return errors.New("field name must be symbol")
+			}
+			err := gen.GenerateFn([]Sexp{SexpArray{}, spec[1]})
+			if err != nil {
+				return err
+			}
+			fields[i] = field
+			defaults[i] = true
+		default:
+			return errors.New("field name must be symbol")
+		}
+		for _, prev := range fields[:i] {
+			if prev.number == fields[i].number {
+				return fmt.Errorf("duplicate field %s", prev.name)
+			}
+		}
+	}
+	gen.tail = oldtail
+
+	// the predicate and accessors belong to the namespace too
+	if gen.topLevel() {
+		env := gen.env
+		env.qualifyDef(env.MakeSymbol(unqualified.name+"?"), true)
+		for _, field := range fields {
+			env.qualifyDef(
+				env.MakeSymbol(unqualified.name+"-"+field.name), true)
+		}
+	}
+
+	gen.AddInstruction(DefstructInstr{name, fields, defaults})
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+// GenerateDefprotocol compiles (defprotocol Name (method [args])...),
+// which defines a generic function for each method. The argument lists
+// only document the methods. At top level, the protocol and its methods
+// belong to the current namespace.
+func (gen *Generator) GenerateDefprotocol(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	name, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("protocol name must be symbol")
+	}
+
+	methods := make([]SexpSymbol, len(args)-1)
+	for i, expr := range args[1:] {
+		if pair, ok := expr.(SexpPair); ok {
+			expr = pair.head
+		}
+		method, ok := expr.(SexpSymbol)
+		if !ok {
+			return errors.New("method name must be symbol")
+		}
+		methods[i] = method
+	}
+
+	if gen.topLevel() {
+		name = gen.env.qualifyDef(name, true)
+		for i, method := range methods {
+			methods[i] = gen.env.qualifyDef(method, true)
+		}
+	}
+	gen.AddInstruction(DefprotocolInstr{name, methods})
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+// GenerateExtendType compiles
+// (extend-type type Protocol (method [args] body...)... Protocol ...),
+// which implements the methods of one or more protocols for the values
+// whose TypeName is type. The type and protocols may be qualified, and
+// methods are those of the protocol's namespace.
+func (gen *Generator) GenerateExtendType(args []Sexp) error {
+	if len(args) < 2 {
+		return WrongNargs
+	}
+
+	typename, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("type name must be symbol")
+	}
+	typename, err := gen.env.resolveDefined(typename)
+	if err != nil {
+		return err
+	}
+
+	var protocol *SexpSymbol
+	for _, expr := range args[1:] {
+		switch t := expr.(type) {
+		case SexpSymbol:
+			resolved, err := gen.env.resolveDefined(t)
+			if err != nil {
+				return err
+			}
+			protocol = &resolved
+			continue
+		case SexpPair:
+			if protocol == nil {
+				return errors.New("methods must follow a protocol name")
+			}
+		default:
+			return errors.New("malformed extend-type")
+		}
+
+		spec, _ := ListToArray(expr)
+		if len(spec) < 3 {
+			return errors.New("method requires a name, arguments and body")
+		}
+		method, ok := spec[0].(SexpSymbol)
+		if !ok {
+			return errors.New("method name must be symbol")
+		}
+		funcargs, ok := spec[1].(SexpArray)
+		if !ok {
+			return errors.New("function arguments must be in vector")
+		}
+
+		sfun, err := buildSexpFun(gen.env, method.name, funcargs, spec[2:])
+		if err != nil {
+			return err
+		}
+		method, err = gen.env.protocolMethod(*protocol, method)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(PushInstrClosure{sfun})
+		gen.AddInstruction(ExtendTypeInstr{typename, *protocol, method})
+	}
+
 	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+// GenerateNs compiles (ns name), which puts the definitions that follow
+// in the namespace name.
+func (gen *Generator) GenerateNs(args []Sexp) error {
+	if len(args) != 1 {
+		return WrongNargs
+	}
+	name, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("namespace name must be symbol")
+	}
 
+	if name.name == GlobalPrefix {
+		return errors.New("namespace " + GlobalPrefix + " is reserved")
+	}
+
+	env := gen.env
+	if env.namespaces.isCompiling(env.curns) && env.curns.name != name.name {
+		return fmt.Errorf("module %s declares namespace %s",
+			env.curns.name, name.name)
+	}
+	env.curns = env.namespaces.intern(name.name)
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+// GenerateRequire compiles (require my.lib) or (require my.lib :as l).
+// The module is compiled now, so its definitions can be resolved, and
+// run when the require is.
+func (gen *Generator) GenerateRequire(args []Sexp) error {
+	if len(args) != 1 && len(args) != 3 {
+		return WrongNargs
+	}
+	module, ok := args[0].(SexpSymbol)
+	if !ok {
+		return errors.New("module name must be symbol")
+	}
+
+	env := gen.env
+	if len(args) == 3 {
+		opt, ok := args[1].(SexpSymbol)
+		if !ok || opt.name != ":as" {
+			return errors.New("require expects :as after the module name")
+		}
+		alias, ok := args[2].(SexpSymbol)
+		if !ok {
+			return errors.New("module alias must be symbol")
+		}
+		env.curns.alias(alias.name, module.name)
+	}
+
+	if _, err := env.compileModule(module.name); err != nil {
+		return err
+	}
+	gen.AddInstruction(RequireInstr{module})
+	gen.AddInstruction(PushInstr{SexpNull})
 	return nil
 }
 
@@ -243,7 +589,11 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 	if islist {
 		switch t := list.head.(type) {
 		case SexpSymbol:
-			macro, ismacrocall = gen.env.macros[t.number]
+			var err error
+			macro, ismacrocall, err = gen.env.lookupMacro(t)
+			if err != nil {
+				return err
+			}
 		default:
 			ismacrocall = false
 		}
@@ -271,22 +621,20 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	size := len(args)
 
-	subgen := NewGenerator(gen.env)
-	subgen.scopes = gen.scopes
-	subgen.tail = gen.tail
-	subgen.funcname = gen.funcname
-	subgen.Generate(args[size-1])
-	instructions := subgen.instructions
+	rest := gen.subGenerator()
+	rest.tail = gen.tail
+	rest.Generate(args[size-1])
 
 	for i := size - 2; i >= 0; i-- {
-		subgen = NewGenerator(gen.env)
+		subgen := gen.subGenerator()
 		subgen.Generate(args[i])
 		subgen.AddInstruction(DupInstr(0))
-		subgen.AddInstruction(BranchInstr{or, len(instructions) + 2})
+		subgen.AddInstruction(BranchInstr{or, len(rest.instructions) + 2})
 		subgen.AddInstruction(PopInstr(0))
-		instructions = append(subgen.instructions, instructions...)
+		subgen.AddGenerated(rest)
+		rest = subgen
 	}
-	gen.AddInstructions(instructions)
+	gen.AddGenerated(rest)
 
 	return nil
 }
@@ -296,44 +644,37 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		return errors.New("missing default case")
 	}
 
-	subgen := NewGenerator(gen.env)
-	subgen.tail = gen.tail
-	subgen.scopes = gen.scopes
-	subgen.funcname = gen.funcname
-	err := subgen.Generate(args[len(args)-1])
+	rest := gen.subGenerator()
+	rest.tail = gen.tail
+	err := rest.Generate(args[len(args)-1])
 	if err != nil {
 		return err
 	}
-	instructions := subgen.instructions
 
 	for i := len(args)/2 - 1; i >= 0; i-- {
-		subgen.Reset()
-		err := subgen.Generate(args[2*i])
+		pred_code := gen.subGenerator()
+		err := pred_code.Generate(args[2*i])
 		if err != nil {
 			return err
 		}
-		pred_code := subgen.instructions
 
-		subgen.Reset()
-		subgen.tail = gen.tail
-		subgen.scopes = gen.scopes
-		subgen.funcname = gen.funcname
-		err = subgen.Generate(args[2*i+1])
+		body_code := gen.subGenerator()
+		body_code.tail = gen.tail
+		err = body_code.Generate(args[2*i+1])
 		if err != nil {
 			return err
 		}
-		body_code := subgen.instructions
 
-		subgen.Reset()
-		subgen.AddInstructions(pred_code)
-		subgen.AddInstruction(BranchInstr{false, len(body_code) + 2})
-		subgen.AddInstructions(body_code)
-		subgen.AddInstruction(JumpInstr{len(instructions) + 1})
-		subgen.AddInstructions(instructions)
-		instructions = subgen.instructions
+		subgen := gen.subGenerator()
+		subgen.AddGenerated(pred_code)
+		subgen.AddInstruction(BranchInstr{false, len(body_code.instructions) + 2})
+		subgen.AddGenerated(body_code)
+		subgen.AddInstruction(JumpInstr{len(rest.instructions) + 1})
+		subgen.AddGenerated(rest)
+		rest = subgen
 	}
 
-	gen.AddInstructions(instructions)
+	gen.AddGenerated(rest)
 	return nil
 }
 
@@ -423,6 +764,456 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	return nil
 }
 
+// generateSub compiles expressions in a sub-generator that is never in
+// tail position.
+func (gen *Generator) generateSub(expressions []Sexp) (*Generator, error) {
+	subgen := gen.subGenerator()
+	if len(expressions) == 0 {
+		expressions = []Sexp{SexpNull}
+	}
+	err := subgen.GenerateBegin(expressions)
+	if err != nil {
+		return nil, err
+	}
+	return subgen, nil
+}
+
+// tryClause returns the name and arguments of a (catch ...) or
+// (finally ...) clause, or the empty string if expr is neither.
+func tryClause(expr Sexp) (string, []Sexp) {
+	pair, ok := expr.(SexpPair)
+	if !ok || !IsList(pair) {
+		return "", nil
+	}
+	sym, ok := pair.head.(SexpSymbol)
+	if !ok || (sym.name != "catch" && sym.name != "finally") {
+		return "", nil
+	}
+	args, _ := ListToArray(pair.tail)
+	return sym.name, args
+}
+
+func (gen *Generator) GenerateTry(args []Sexp) error {
+	body := args
+	var catchargs, finallyargs []Sexp
+	hascatch := false
+	hasfinally := false
+
+	for i, expr := range args {
+		name, clauseargs := tryClause(expr)
+		if name == "" {
+			if hascatch || hasfinally {
+				return errors.New("try body must precede catch and finally")
+			}
+			continue
+		}
+		if !hascatch && !hasfinally {
+			body = args[:i]
+		}
+		if name == "catch" {
+			if hascatch || hasfinally {
+				return errors.New("catch must come once, before finally")
+			}
+			catchargs = clauseargs
+			hascatch = true
+		} else {
+			if hasfinally {
+				return errors.New("try can only have one finally clause")
+			}
+			finallyargs = clauseargs
+			hasfinally = true
+		}
+	}
+
+	if !hascatch && !hasfinally {
+		return errors.New("try requires a catch or finally clause")
+	}
+
+	frame := tryFrame{scopes: gen.scopes, handler: true, finally: finallyargs}
+	outer := gen.tries
+	gen.tries = append(outer[:len(outer):len(outer)], frame)
+	bodycode, err := gen.generateSub(body)
+	gen.tries = outer
+	if err != nil {
+		return err
+	}
+
+	catchcode := gen.subGenerator()
+	if hascatch {
+		if len(catchargs) < 1 {
+			return errors.New("catch requires a symbol to bind")
+		}
+		sym, ok := catchargs[0].(SexpSymbol)
+		if !ok {
+			return errors.New("catch binding must be a symbol")
+		}
+		// the handler runs in the scope binding the error, and in a
+		// try block of its own if there is a finally clause
+		if hasfinally {
+			gen.tries = append(outer[:len(outer):len(outer)], frame)
+		}
+		gen.scopes++
+		handlercode, err := gen.generateSub(catchargs[1:])
+		gen.scopes--
+		gen.tries = outer
+		if err != nil {
+			return err
+		}
+		if hasfinally {
+			// an error in the handler must still run finally
+			catchcode.AddInstruction(TryInstr{
+				len(handlercode.instructions) + 6, true})
+		}
+		catchcode.AddInstruction(AddScopeInstr(0))
+		catchcode.AddInstruction(PutInstr{sym})
+		catchcode.AddGenerated(handlercode)
+		catchcode.AddInstruction(RemoveScopeInstr(0))
+		if hasfinally {
+			catchcode.AddInstruction(EndTryInstr(0))
+		}
+	}
+
+	// the error path of finally runs the cleanup and rethrows,
+	// the normal path runs it and leaves the result on the stack
+	finallycode := gen.subGenerator()
+	errorcode := gen.subGenerator()
+	if hasfinally {
+		cleanup, err := gen.generateSub(finallyargs)
+		if err != nil {
+			return err
+		}
+		finallycode.AddGenerated(cleanup)
+		finallycode.AddInstruction(PopInstr(0))
+		errorcode.AddGenerated(finallycode)
+		errorcode.AddInstruction(RethrowInstr(0))
+	}
+
+	if hascatch {
+		catchcode.AddInstruction(JumpInstr{len(errorcode.instructions) + 1})
+	}
+
+	gen.AddInstruction(TryInstr{len(bodycode.instructions) + 3, !hascatch})
+	gen.AddGenerated(bodycode)
+	gen.AddInstruction(EndTryInstr(0))
+	gen.AddInstruction(JumpInstr{
+		len(catchcode.instructions) + len(errorcode.instructions) + 1})
+	gen.AddGenerated(catchcode)
+	gen.AddGenerated(errorcode)
+	gen.AddGenerated(finallycode)
+	return nil
+}
+
+// loopBody returns a loop body that evaluates expressions.
+func loopBody(expressions []Sexp) func(*Generator) error {
+	if len(expressions) == 0 {
+		expressions = []Sexp{SexpNull}
+	}
+	return func(gen *Generator) error {
+		return gen.GenerateBegin(expressions)
+	}
+}
+
+// generateLoop emits a loop that runs test, then the code body generates
+// and step for as long as test is truthy. The loop always evaluates to ().
+func (gen *Generator) generateLoop(name string, test *Generator,
+	body func(*Generator) error, step *Generator) error {
+
+	loop := &Loop{
+		stmtname: gen.env.MakeSymbol(name),
+		scopes:   gen.scopes,
+		tries:    len(gen.tries),
+	}
+
+	// the stackmark lets break and continue discard whatever the
+	// body had pushed when they were reached
+	gen.AddInstruction(PushInstr{SexpStackmark{loop.stmtname}})
+
+	bodygen := gen.subGenerator()
+	gen.loops.Push(loop)
+	err := body(bodygen)
+	gen.loops.Pop()
+	if err != nil {
+		return err
+	}
+	bodygen.AddInstruction(PopInstr(0))
+
+	if step == nil {
+		step = gen.subGenerator()
+	}
+
+	testlen := len(test.instructions)
+	bodylen := len(bodygen.instructions)
+	steplen := len(step.instructions)
+
+	loop.loopStart = len(gen.instructions)
+	loop.continueOffset = testlen + 1 + bodylen
+	loop.breakOffset = loop.continueOffset + steplen + 1
+	loop.loopLen = loop.breakOffset
+	loop.resolve(bodygen.instructions, testlen+1)
+
+	gen.AddGenerated(test)
+	gen.AddInstruction(BranchInstr{false, bodylen + steplen + 2})
+	gen.AddGenerated(bodygen)
+	gen.AddGenerated(step)
+	gen.AddInstruction(JumpInstr{-(testlen + 1 + bodylen + steplen)})
+	gen.AddInstruction(PopInstr(0))
+	gen.AddInstruction(PushInstr{SexpNull})
+	return nil
+}
+
+// generateCounted emits a loop in a new scope which binds sym to init
+// and rebinds it to the value of step after every iteration.
+func (gen *Generator) generateCounted(name string, sym SexpSymbol,
+	init Sexp, test Sexp, step Sexp, body []Sexp) error {
+
+	gen.AddInstruction(AddScopeInstr(0))
+	gen.scopes++
+
+	err := gen.Generate(init)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(PutInstr{sym})
+
+	testgen := gen.subGenerator()
+	err = testgen.Generate(test)
+	if err != nil {
+		return err
+	}
+
+	stepgen := gen.subGenerator()
+	err = stepgen.Generate(step)
+	if err != nil {
+		return err
+	}
+	stepgen.AddInstruction(PutInstr{sym})
+
+	err = gen.generateLoop(name, testgen, loopBody(body), stepgen)
+	if err != nil {
+		return err
+	}
+
+	gen.AddInstruction(RemoveScopeInstr(0))
+	gen.scopes--
+	return nil
+}
+
+func (gen *Generator) GenerateWhile(args []Sexp) error {
+	if len(args) < 1 {
+		return errors.New("while requires a condition")
+	}
+
+	test := gen.subGenerator()
+	err := test.Generate(args[0])
+	if err != nil {
+		return err
+	}
+	return gen.generateLoop("while", test, loopBody(args[1:]), nil)
+}
+
+func (gen *Generator) GenerateFor(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	clause, ok := args[0].(SexpArray)
+	if !ok || len(clause) != 4 {
+		return errors.New("for requires [symbol init test step]")
+	}
+	sym, ok := clause[0].(SexpSymbol)
+	if !ok {
+		return errors.New("for can only bind a symbol")
+	}
+
+	return gen.generateCounted("for", sym,
+		clause[1], clause[2], clause[3], args[1:])
+}
+
+func (gen *Generator) GenerateDotimes(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	clause, ok := args[0].(SexpArray)
+	if !ok || len(clause) != 2 {
+		return errors.New("dotimes requires [symbol count]")
+	}
+	sym, ok := clause[0].(SexpSymbol)
+	if !ok {
+		return errors.New("dotimes can only bind a symbol")
+	}
+
+	// evaluate the count once, into a hidden binding
+	limit := gen.env.GenSymbol("__limit")
+	gen.AddInstruction(AddScopeInstr(0))
+	gen.scopes++
+	err := gen.Generate(clause[1])
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(PutInstr{limit})
+	gen.AddInstruction(PushInstr{SexpInt(0)})
+	gen.AddInstruction(PutInstr{sym})
+
+	test := gen.subGenerator()
+	test.AddInstruction(GetInstr{sym: sym})
+	test.AddInstruction(GetInstr{sym: limit})
+	test.AddInstruction(LessInstr(0))
+
+	step := gen.subGenerator()
+	step.AddInstruction(GetInstr{sym: sym})
+	step.AddInstruction(IncrementInstr(0))
+	step.AddInstruction(PutInstr{sym})
+
+	err = gen.generateLoop("dotimes", test, loopBody(args[1:]), step)
+	if err != nil {
+		return err
+	}
+
+	gen.AddInstruction(RemoveScopeInstr(0))
+	gen.scopes--
+	return nil
+}
+
+func (gen *Generator) GenerateDoseq(args []Sexp) error {
+	if len(args) < 1 {
+		return WrongNargs
+	}
+
+	clause, ok := args[0].(SexpArray)
+	if !ok || len(clause) != 2 {
+		return errors.New("doseq requires [symbol collection]")
+	}
+	sym, ok := clause[0].(SexpSymbol)
+	if !ok {
+		return errors.New("doseq can only bind a symbol")
+	}
+
+	// turn the collection into an array once, then walk it by index
+	seq := gen.env.GenSymbol("__seq")
+	idx := gen.env.GenSymbol("__idx")
+	gen.AddInstruction(AddScopeInstr(0))
+	gen.scopes++
+	err := gen.Generate(clause[1])
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(SequenceInstr(0))
+	gen.AddInstruction(PutInstr{seq})
+	gen.AddInstruction(PushInstr{SexpInt(0)})
+	gen.AddInstruction(PutInstr{idx})
+
+	test := gen.subGenerator()
+	test.AddInstruction(GetInstr{sym: idx})
+	test.AddInstruction(GetInstr{sym: seq})
+	test.AddInstruction(LenInstr(0))
+	test.AddInstruction(LessInstr(0))
+
+	step := gen.subGenerator()
+	step.AddInstruction(GetInstr{sym: idx})
+	step.AddInstruction(IncrementInstr(0))
+	step.AddInstruction(PutInstr{idx})
+
+	// each element gets its own scope, so closures made in the body
+	// see the element of their iteration
+	each := loopBody(args[1:])
+	body := func(bodygen *Generator) error {
+		bodygen.AddInstruction(AddScopeInstr(0))
+		bodygen.scopes++
+		bodygen.AddInstruction(GetInstr{sym: seq})
+		bodygen.AddInstruction(GetInstr{sym: idx})
+		bodygen.AddInstruction(IndexInstr(0))
+		bodygen.AddInstruction(PutInstr{sym})
+		err := each(bodygen)
+		if err != nil {
+			return err
+		}
+		bodygen.AddInstruction(RemoveScopeInstr(0))
+		bodygen.scopes--
+		return nil
+	}
+
+	err = gen.generateLoop("doseq", test, body, step)
+	if err != nil {
+		return err
+	}
+
+	gen.AddInstruction(RemoveScopeInstr(0))
+	gen.scopes--
+	return nil
+}
+
+// GenerateWithOutputToString compiles (with-output-to-string body...),
+// capturing the output of body while it runs.
+func (gen *Generator) GenerateWithOutputToString(args []Sexp) error {
+	outer := gen.tries
+	gen.tries = append(outer[:len(outer):len(outer)],
+		tryFrame{scopes: gen.scopes, capture: true})
+	body, err := gen.generateSub(args)
+	gen.tries = outer
+	if err != nil {
+		return err
+	}
+
+	gen.AddInstruction(BeginCaptureInstr(0))
+	gen.AddGenerated(body)
+	gen.AddInstruction(EndCaptureInstr(0))
+	return nil
+}
+
+// GenerateLoopJump compiles break and continue, which leave the
+// innermost loop or skip to its next iteration.
+func (gen *Generator) GenerateLoopJump(name string, args []Sexp) error {
+	if len(args) != 0 {
+		return WrongNargs
+	}
+
+	elem, err := gen.loops.Get(0)
+	if err != nil {
+		return fmt.Errorf("%s outside of loop", name)
+	}
+	loop := elem.(*Loop)
+
+	// leave the try blocks and captures inside the loop, running
+	// finally clauses, innermost first
+	scopes := gen.scopes
+	for i := len(gen.tries) - 1; i >= loop.tries; i-- {
+		frame := gen.tries[i]
+		for ; scopes > frame.scopes; scopes-- {
+			gen.AddInstruction(RemoveScopeInstr(0))
+		}
+		if frame.capture {
+			gen.AddInstruction(DropCaptureInstr(0))
+		}
+		if frame.handler {
+			gen.AddInstruction(EndTryInstr(0))
+		}
+		if frame.finally == nil {
+			continue
+		}
+		finally := frame.finally
+		if len(finally) == 0 {
+			finally = []Sexp{SexpNull}
+		}
+		cleanup := gen.subGenerator()
+		cleanup.scopes = scopes
+		cleanup.tries = gen.tries[:i]
+		err := cleanup.GenerateBegin(finally)
+		if err != nil {
+			return err
+		}
+		gen.AddGenerated(cleanup)
+		gen.AddInstruction(PopInstr(0))
+	}
+
+	for ; scopes > loop.scopes; scopes-- {
+		gen.AddInstruction(RemoveScopeInstr(0))
+	}
+	gen.AddInstruction(PopStackmarkInstr{loop.stmtname})
+	gen.AddInstruction(loopJumpInstr{loop, name == "break"})
+	return nil
+}
+
 func (gen *Generator) GenerateInclude(args []Sexp) error {
 	if len(args) < 1 {
 		return WrongNargs
@@ -479,6 +1270,10 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 }
 
 func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
+	if !gen.env.allowsForm(sym.name) && isSpecialForm(sym.name) {
+		return fmt.Errorf("%s is not available in this environment", sym.name)
+	}
+
 	switch sym.name {
 	case "and":
 		return gen.GenerateShortCircuit(false, args)
@@ -490,10 +1285,16 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		return gen.GenerateQuote(args)
 	case "def":
 		return gen.GenerateDef(args)
+	case "def-":
+		return gen.generateDef(args, false)
+	case "set!":
+		return gen.GenerateSet(args)
 	case "fn":
 		return gen.GenerateFn(args)
 	case "defn":
 		return gen.GenerateDefn(args)
+	case "defn-":
+		return gen.generateDefn(args, false)
 	case "begin":
 		return gen.GenerateBegin(args)
 	case "let":
@@ -506,13 +1307,42 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		return gen.GenerateDefmac(args)
 	case "macexpand":
 		return gen.GenerateMacexpand(args)
+	case "defstruct":
+		return gen.GenerateDefstruct(args)
+	case "defprotocol":
+		return gen.GenerateDefprotocol(args)
+	case "extend-type":
+		return gen.GenerateExtendType(args)
+	case "ns":
+		return gen.GenerateNs(args)
+	case "require":
+		return gen.GenerateRequire(args)
 	case "syntax-quote":
-		return gen.GenerateSyntaxQuote(args)
+		return gen.GenerateHygienicQuote(args)
 	case "include":
 		return gen.GenerateInclude(args)
+	case "try":
+		return gen.GenerateTry(args)
+	case "while":
+		return gen.GenerateWhile(args)
+	case "for":
+		return gen.GenerateFor(args)
+	case "dotimes":
+		return gen.GenerateDotimes(args)
+	case "doseq":
+		return gen.GenerateDoseq(args)
+	case "break":
+		return gen.GenerateLoopJump("break", args)
+	case "continue":
+		return gen.GenerateLoopJump("continue", args)
+	case "with-output-to-string":
+		return gen.GenerateWithOutputToString(args)
 	}
 
-	macro, found := gen.env.macros[sym.number]
+	macro, found, err := gen.env.lookupMacro(sym)
+	if err != nil {
+		return err
+	}
 	if found {
 		// calling Apply on the current environment will screw up
 		// the stack, creating a duplicate environment is safer
@@ -521,12 +1351,17 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		if err != nil {
 			return err
 		}
-		return gen.Generate(expr)
+		return gen.Generate(gen.env.codeForm(expr))
+	}
+
+	resolved, qualified, err := gen.env.resolveSymbol(sym)
+	if err != nil {
+		return err
 	}
 
 	oldtail := gen.tail
 	gen.tail = false
-	err := gen.GenerateAll(args)
+	err = gen.GenerateAll(args)
 	if err != nil {
 		return err
 	}
@@ -539,15 +1374,21 @@ func (gen *Generator) GenerateCallBySymbol(sym SexpSymbol, args []Sexp) error {
 		}
 		gen.AddInstruction(GotoInstr{0})
 	} else {
-		gen.AddInstruction(CallInstr{sym, len(args)})
+		gen.AddInstruction(CallInstr{resolved, qualified, len(args)})
 	}
 	gen.tail = oldtail
 	return nil
 }
 
 func (gen *Generator) GenerateDispatch(fun Sexp, args []Sexp) error {
-	gen.GenerateAll(args)
-	gen.Generate(fun)
+	err := gen.GenerateAll(args)
+	if err != nil {
+		return err
+	}
+	err = gen.Generate(fun)
+	if err != nil {
+		return err
+	}
 	gen.AddInstruction(DispatchInstr{len(args)})
 	return nil
 }
@@ -566,18 +1407,84 @@ func (gen *Generator) GenerateArray(arr SexpArray) error {
 	if err != nil {
 		return err
 	}
-	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("array"), len(arr)})
+	constructor := "array"
+	if gen.env.persistent {
+		constructor = "vector"
+	}
+	gen.AddInstruction(CallInstr{sym: gen.env.MakeSymbol(constructor),
+		nargs: len(arr)})
 	return nil
 }
 
+// codeForm turns the vectors and maps syntax-quote builds when literals
+// are persistent back into the arrays and hash-map calls the reader
+// makes of [] and {}, so code built by macros or for eval compiles the
+// same as code that was read. Quoted forms are left alone.
+func (env *Glisp) codeForm(expr Sexp) Sexp {
+	if !env.persistent {
+		return expr
+	}
+	switch e := expr.(type) {
+	case SexpPair:
+		if !IsList(e) {
+			return e
+		}
+		if head, ok := e.head.(SexpSymbol); ok && head.name == "quote" {
+			return e
+		}
+		items, _ := ListToArray(e)
+		for i, item := range items {
+			items[i] = env.codeForm(item)
+		}
+		list := MakeList(items).(SexpPair)
+		list.pos = e.pos
+		return list
+	case SexpArray:
+		arr := make(SexpArray, len(e))
+		for i, item := range e {
+			arr[i] = env.codeForm(item)
+		}
+		return arr
+	case SexpVector:
+		return env.codeForm(SexpArray(e.Slice()))
+	case SexpMap:
+		items := []Sexp{env.MakeSymbol("hash-map")}
+		for _, pair := range e.Pairs() {
+			items = append(items, env.codeForm(pair.head),
+				env.codeForm(pair.tail))
+		}
+		return MakeList(items)
+	}
+	return expr
+}
+
 func (gen *Generator) Generate(expr Sexp) error {
+	if pos := SexpPosition(expr); pos != nil {
+		oldpos := gen.pos
+		gen.pos = pos
+		defer func() { gen.pos = oldpos }()
+	}
+
 	switch e := expr.(type) {
 	case SexpSymbol:
-		gen.AddInstruction(GetInstr{e})
+		if IsKeyword(e) {
+			gen.AddInstruction(PushInstr{e})
+			return nil
+		}
+		sym, qualified, err := gen.env.resolveSymbol(e)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(GetInstr{sym, qualified})
 		return nil
 	case SexpPair:
 		if IsList(e) {
 			err := gen.GenerateCall(e)
+			if err != nil && e.pos != nil {
+				return errors.New(
+					fmt.Sprintf("Error generating %s at %s:\n%v",
+						expr.SexpString(), e.pos, err))
+			}
 			if err != nil {
 				return errors.New(
 					fmt.Sprintf("Error generating %s:\n%v",
@@ -608,10 +1515,96 @@ func (gen *Generator) GenerateAll(expressions []Sexp) error {
 
 func (gen *Generator) Reset() {
 	gen.instructions = make([]Instruction, 0)
+	gen.lines = make([]*Position, 0)
 	gen.tail = false
 	gen.scopes = 0
 }
 
+// GenerateHygienicQuote compiles a syntax-quote, first giving every
+// auto-gensym like x# in it a fresh symbol each time it is evaluated.
+// The same auto-gensym names the same symbol throughout the form.
+func (gen *Generator) GenerateHygienicQuote(args []Sexp) error {
+	if len(args) != 1 {
+		return errors.New("syntax-quote takes exactly one argument")
+	}
+
+	autosyms := make(map[int]SexpSymbol)
+	var bindings SexpArray
+	form := gen.replaceAutoGensyms(args[0], autosyms, &bindings)
+	if len(bindings) == 0 {
+		return gen.GenerateSyntaxQuote(args)
+	}
+
+	gen.AddInstruction(AddScopeInstr(0))
+	gen.scopes++
+	for i := 0; i < len(bindings); i += 2 {
+		prefix := string(bindings[i+1].(SexpStr))
+		gen.AddInstruction(GensymInstr{prefix})
+		gen.AddInstruction(PutInstr{bindings[i].(SexpSymbol)})
+	}
+	err := gen.GenerateSyntaxQuote([]Sexp{form})
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(RemoveScopeInstr(0))
+	gen.scopes--
+	return nil
+}
+
+// IsAutoGensym reports whether sym is like x#, which syntax-quote
+// replaces with a fresh symbol.
+func IsAutoGensym(sym SexpSymbol) bool {
+	return len(sym.name) > 1 && strings.HasSuffix(sym.name, "#")
+}
+
+// replaceAutoGensyms replaces the auto-gensyms in a syntax-quoted form,
+// outside of unquotes, with unquoted hidden symbols, adding a binding of
+// each hidden symbol to the prefix of the symbol to generate for it.
+func (gen *Generator) replaceAutoGensyms(expr Sexp,
+	autosyms map[int]SexpSymbol, bindings *SexpArray) Sexp {
+
+	env := gen.env
+	switch t := expr.(type) {
+	case SexpSymbol:
+		if !IsAutoGensym(t) {
+			return expr
+		}
+		hidden, ok := autosyms[t.number]
+		if !ok {
+			hidden = env.GenSymbol("__auto")
+			autosyms[t.number] = hidden
+			prefix := SexpStr(strings.TrimSuffix(t.name, "#") + "__")
+			*bindings = append(*bindings, hidden, prefix)
+		}
+		return MakeList([]Sexp{env.MakeSymbol("unquote"), hidden})
+	case SexpPair:
+		if !IsList(t) {
+			return expr
+		}
+		if sym, ok := t.head.(SexpSymbol); ok &&
+			(sym.name == "unquote" || sym.name == "unquote-splicing") {
+			return expr
+		}
+		items, _ := ListToArray(t)
+		for i, item := range items {
+			items[i] = gen.replaceAutoGensyms(item, autosyms, bindings)
+		}
+		list := MakeList(items)
+		if pair, ok := list.(SexpPair); ok {
+			pair.pos = t.pos
+			return pair
+		}
+		return list
+	case SexpArray:
+		arr := make(SexpArray, len(t))
+		for i, item := range t {
+			arr[i] = gen.replaceAutoGensyms(item, autosyms, bindings)
+		}
+		return arr
+	}
+	return expr
+}
+
 // side-effect (or main effect) has to be pushing an expression on the top of
 // the datastack that represents the expanded and substituted expression
 func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
@@ -623,7 +1616,7 @@ func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
 
 	// need to handle arrays, since they can have unquotes
 	// in them too.
-	switch arg.(type) {
+	switch a := arg.(type) {
 	case SexpArray:
 		gen.generateSyntaxQuoteArray(arg)
 		return nil
@@ -636,6 +1629,11 @@ func (gen *Generator) GenerateSyntaxQuote(args []Sexp) error {
 	case SexpHash:
 		gen.generateSyntaxQuoteHash(arg)
 		return nil
+	case SexpSymbol:
+		if !IsKeyword(a) {
+			gen.AddInstruction(QuoteSymbolInstr{a, gen.env.curns.name})
+			return nil
+		}
 	}
 	gen.AddInstruction(PushInstr{arg})
 	return nil
@@ -658,6 +1656,15 @@ func (gen *Generator) generateSyntaxQuoteList(arg Sexp) error {
 	// to substitute.
 	quotebody, _ := ListToArray(arg)
 
+	// the reader makes {} literals calls to hash-map when they are
+	// persistent, so build the map they stand for
+	if head, ok := quotebody[0].(SexpSymbol); ok && gen.env.persistent &&
+		head.name == "hash-map" {
+		gen.generateSyntaxQuoteItems(quotebody[1:])
+		gen.AddInstruction(PersistInstr{Map: true})
+		return nil
+	}
+
 	if len(quotebody) == 2 {
 		var issymbol bool
 		var sym SexpSymbol
@@ -702,15 +1709,24 @@ func (gen *Generator) generateSyntaxQuoteArray(arg Sexp) error {
 		return fmt.Errorf("arg to generateSyntaxQuoteArray() must be an array; got %T", a)
 	}
 
+	gen.generateSyntaxQuoteItems(arr)
+	if gen.env.persistent {
+		gen.AddInstruction(PersistInstr{})
+	}
+	return nil
+}
+
+// generateSyntaxQuoteItems pushes an array of the syntax-quoted items,
+// with any unquote-splicing spliced in.
+func (gen *Generator) generateSyntaxQuoteItems(items []Sexp) {
 	gen.AddInstruction(PushInstr{SexpMarker})
-	for _, expr := range arr {
+	for _, expr := range items {
 		gen.AddInstruction(PushInstr{SexpMarker})
 		gen.GenerateSyntaxQuote([]Sexp{expr})
 		gen.AddInstruction(SquashInstr(0))
 		gen.AddInstruction(ExplodeInstr(0))
 	}
 	gen.AddInstruction(VectorizeInstr(0))
-	return nil
 }
 
 func (gen *Generator) generateSyntaxQuoteHash(arg Sexp) error {
@@ -723,15 +1739,12 @@ func (gen *Generator) generateSyntaxQuoteHash(arg Sexp) error {
 	default:
 		return fmt.Errorf("arg to generateSyntaxQuoteHash() must be a hash; got %T", a)
 	}
-	n := HashCountKeys(hash)
+	pairs := hash.Pairs()
+	n := len(pairs)
 	gen.AddInstruction(PushInstr{SexpMarker})
 	for i := 0; i < n; i++ {
 		// must reverse order here to preserve order on rebuild
-		key := (*hash.KeyOrder)[(n-i)-1]
-		val, err := hash.HashGet(key)
-		if err != nil {
-			return err
-		}
+		key, val := pairs[(n-i)-1].head, pairs[(n-i)-1].tail
 		// value first, since value comes second on rebuild
 		gen.AddInstruction(PushInstr{SexpMarker})
 		gen.GenerateSyntaxQuote([]Sexp{val})
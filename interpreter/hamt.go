@@ -0,0 +1,265 @@
+package glisp
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// SexpMap is a persistent hash map, a hash array mapped trie. Like
+// SexpVector, changing one makes a new map sharing most of its structure
+// with the old one. Keys are compared as hash keys are, with Compare.
+type SexpMap struct {
+	count int
+	root  *hamtNode
+}
+
+const (
+	hamtBits = 5
+	hamtMask = 1<<hamtBits - 1
+)
+
+// hamtNode holds an entry for each bit set in bitmap, in bit order.
+type hamtNode struct {
+	bitmap  uint32
+	entries []hamtEntry
+}
+
+// hamtEntry is either a child node, or the pairs whose keys all have the
+// full hash code hash.
+type hamtEntry struct {
+	node  *hamtNode
+	hash  uint32
+	pairs []SexpPair
+}
+
+var emptyHamtNode = &hamtNode{}
+
+// MakeMap makes a map from alternating keys and values.
+func MakeMap(args []Sexp) (SexpMap, error) {
+	if len(args)%2 != 0 {
+		return SexpMap{}, errors.New("hash-map requires even number of arguments")
+	}
+	m := SexpMap{root: emptyHamtNode}
+	for i := 0; i < len(args); i += 2 {
+		var err error
+		m, err = m.Assoc(args[i], args[i+1])
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func hashKey(key Sexp) (uint32, error) {
+	h, err := HashExpression(key)
+	return uint32(h), err
+}
+
+func sameKey(a, b Sexp) bool {
+	res, err := Compare(a, b)
+	return err == nil && res == 0
+}
+
+func (m SexpMap) Len() int {
+	return m.count
+}
+
+// Get returns the value for key, and whether there was one.
+func (m SexpMap) Get(key Sexp) (Sexp, bool, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return SexpNull, false, err
+	}
+	node := m.root
+	for shift := uint(0); node != nil; shift += hamtBits {
+		bit := uint32(1) << ((h >> shift) & hamtMask)
+		if node.bitmap&bit == 0 {
+			break
+		}
+		entry := node.entries[node.index(bit)]
+		if entry.node != nil {
+			node = entry.node
+			continue
+		}
+		if entry.hash == h {
+			for _, pair := range entry.pairs {
+				if sameKey(pair.head, key) {
+					return pair.tail, true, nil
+				}
+			}
+		}
+		break
+	}
+	return SexpNull, false, nil
+}
+
+func (node *hamtNode) index(bit uint32) int {
+	return bits.OnesCount32(node.bitmap & (bit - 1))
+}
+
+// with returns a copy of node with the entry for bit set to entry.
+func (node *hamtNode) with(bit uint32, entry hamtEntry) *hamtNode {
+	idx := node.index(bit)
+	if node.bitmap&bit != 0 {
+		entries := make([]hamtEntry, len(node.entries))
+		copy(entries, node.entries)
+		entries[idx] = entry
+		return &hamtNode{node.bitmap, entries}
+	}
+	entries := make([]hamtEntry, len(node.entries)+1)
+	copy(entries, node.entries[:idx])
+	entries[idx] = entry
+	copy(entries[idx+1:], node.entries[idx:])
+	return &hamtNode{node.bitmap | bit, entries}
+}
+
+// without returns a copy of node with no entry for bit.
+func (node *hamtNode) without(bit uint32) *hamtNode {
+	idx := node.index(bit)
+	entries := make([]hamtEntry, 0, len(node.entries)-1)
+	entries = append(entries, node.entries[:idx]...)
+	entries = append(entries, node.entries[idx+1:]...)
+	return &hamtNode{node.bitmap &^ bit, entries}
+}
+
+// Assoc returns a map with key set to val.
+func (m SexpMap) Assoc(key Sexp, val Sexp) (SexpMap, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return m, err
+	}
+	if m.root == nil {
+		m.root = emptyHamtNode
+	}
+	root, added := m.root.assoc(0, h, Cons(key, val))
+	m.root = root
+	if added {
+		m.count++
+	}
+	return m, nil
+}
+
+func (node *hamtNode) assoc(shift uint, h uint32, pair SexpPair) (*hamtNode, bool) {
+	bit := uint32(1) << ((h >> shift) & hamtMask)
+	if node.bitmap&bit == 0 {
+		return node.with(bit, hamtEntry{hash: h, pairs: []SexpPair{pair}}), true
+	}
+
+	entry := node.entries[node.index(bit)]
+	if entry.node != nil {
+		child, added := entry.node.assoc(shift+hamtBits, h, pair)
+		return node.with(bit, hamtEntry{node: child}), added
+	}
+
+	if entry.hash == h {
+		pairs := make([]SexpPair, len(entry.pairs), len(entry.pairs)+1)
+		copy(pairs, entry.pairs)
+		for i := range pairs {
+			if sameKey(pairs[i].head, pair.head) {
+				pairs[i] = pair
+				return node.with(bit, hamtEntry{hash: h, pairs: pairs}), false
+			}
+		}
+		pairs = append(pairs, pair)
+		return node.with(bit, hamtEntry{hash: h, pairs: pairs}), true
+	}
+
+	// two hash codes share this slot, so split it into a child node
+	child := emptyHamtNode.with(
+		uint32(1)<<((entry.hash>>(shift+hamtBits))&hamtMask), entry)
+	child, _ = child.assoc(shift+hamtBits, h, pair)
+	return node.with(bit, hamtEntry{node: child}), true
+}
+
+// Dissoc returns a map without key.
+func (m SexpMap) Dissoc(key Sexp) (SexpMap, error) {
+	h, err := hashKey(key)
+	if err != nil {
+		return m, err
+	}
+	if m.root == nil {
+		return m, nil
+	}
+	root, removed := m.root.dissoc(0, h, key)
+	m.root = root
+	if removed {
+		m.count--
+	}
+	return m, nil
+}
+
+func (node *hamtNode) dissoc(shift uint, h uint32, key Sexp) (*hamtNode, bool) {
+	bit := uint32(1) << ((h >> shift) & hamtMask)
+	if node.bitmap&bit == 0 {
+		return node, false
+	}
+
+	entry := node.entries[node.index(bit)]
+	if entry.node != nil {
+		child, removed := entry.node.dissoc(shift+hamtBits, h, key)
+		if !removed {
+			return node, false
+		}
+		switch {
+		case len(child.entries) == 0:
+			return node.without(bit), true
+		case len(child.entries) == 1 && child.entries[0].node == nil:
+			// a lone bucket can move up, it knows its own hash
+			return node.with(bit, child.entries[0]), true
+		}
+		return node.with(bit, hamtEntry{node: child}), true
+	}
+
+	if entry.hash != h {
+		return node, false
+	}
+	for i, pair := range entry.pairs {
+		if !sameKey(pair.head, key) {
+			continue
+		}
+		if len(entry.pairs) == 1 {
+			return node.without(bit), true
+		}
+		pairs := make([]SexpPair, 0, len(entry.pairs)-1)
+		pairs = append(pairs, entry.pairs[:i]...)
+		pairs = append(pairs, entry.pairs[i+1:]...)
+		return node.with(bit, hamtEntry{hash: h, pairs: pairs}), true
+	}
+	return node, false
+}
+
+// Pairs returns the entries of the map as (key . value) pairs, in an
+// order that depends only on the keys' hash codes.
+func (m SexpMap) Pairs() []SexpPair {
+	pairs := make([]SexpPair, 0, m.count)
+	var walk func(node *hamtNode)
+	walk = func(node *hamtNode) {
+		for _, entry := range node.entries {
+			if entry.node != nil {
+				walk(entry.node)
+			} else {
+				pairs = append(pairs, entry.pairs...)
+			}
+		}
+	}
+	if m.root != nil {
+		walk(m.root)
+	}
+	return pairs
+}
+
+func (m SexpMap) SexpString() string {
+	return m.printString(nil)
+}
+
+func (m SexpMap) printString(seen printSet) string {
+	str := "{"
+	for i, pair := range m.Pairs() {
+		if i > 0 {
+			str += " "
+		}
+		str += printString(pair.head, seen) + " " +
+			printString(pair.tail, seen)
+	}
+	return str + "}"
+}
@@ -0,0 +1,29 @@
+package glisp
+
+// Handler records the state of the VM at the point a try block was
+// entered, so that an error can unwind the stacks back to it.
+type Handler struct {
+	function   SexpFunction
+	position   int
+	raw        bool
+	scopestack *Stack
+	scopetop   int
+	datatop    int
+	addrtop    int
+	stacktop   int
+	capturetop int
+}
+
+func (h Handler) IsStackElem() {}
+
+func (stack *Stack) PushHandler(handler Handler) {
+	stack.Push(handler)
+}
+
+func (stack *Stack) PopHandler() (Handler, error) {
+	elem, err := stack.Pop()
+	if err != nil {
+		return Handler{}, err
+	}
+	return elem.(Handler), nil
+}
@@ -4,25 +4,152 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"reflect"
 )
 
+// HashExpression hashes expr consistently with Compare: values that
+// compare as equal, like 2, 2.0 and 2M, or an array and a vector with the
+// same elements, hash alike.
 func HashExpression(expr Sexp) (int, error) {
+	return hashExpression(expr, 0)
+}
+
+func hashExpression(expr Sexp, depth int) (int, error) {
+	if depth > maxNesting {
+		return 0, ErrTooDeep
+	}
 	switch e := expr.(type) {
-	case SexpInt:
-		return int(e), nil
-	case SexpChar:
-		return int(e), nil
+	case SexpInt, SexpChar, SexpFloat, SexpBigInt, SexpRatio, SexpDecimal:
+		return hashNumber(expr), nil
 	case SexpSymbol:
 		return e.number, nil
 	case SexpStr:
-		hasher := fnv.New32()
-		_, err := hasher.Write([]byte(e))
+		return hashString(string(e))
+	case SexpBool:
+		if e {
+			return 1231, nil
+		}
+		return 1237, nil
+	case SexpSentinel:
+		return int(e), nil
+	case SexpPair:
+		return hashPair(e, depth)
+	case SexpArray:
+		return hashSequence(e, depth)
+	case SexpVector:
+		return hashSequence(e.Slice(), depth)
+	case SexpHash, SexpMap:
+		return hashPairs(expr, depth)
+	case SexpFunction:
+		return hashString(e.name)
+	}
+	if reflect.TypeOf(expr).Comparable() {
+		// Compare finds these equal only to themselves
+		return hashString(TypeName(expr) + " " + expr.SexpString())
+	}
+	return 0, errors.New(fmt.Sprintf("cannot hash type %T", expr))
+}
+
+// hashNumber hashes a number by its value as a float, as Compare
+// compares exact numbers with floats. Whole numbers hash to themselves.
+func hashNumber(expr Sexp) int {
+	switch e := expr.(type) {
+	case SexpInt:
+		return int(e)
+	case SexpChar:
+		return int(e)
+	case SexpFloat:
+		// NaN equals nothing, so any hash would do
+		if math.IsNaN(float64(e)) {
+			return int(math.Float64bits(math.NaN()))
+		}
+		// floats equal to an int hash like it
+		if e == SexpFloat(math.Trunc(float64(e))) &&
+			e >= math.MinInt64 && e < math.MaxInt64 {
+			return int(e)
+		}
+		return int(math.Float64bits(float64(e)))
+	}
+
+	// exact numbers are only equal to a float that is exactly their
+	// value, in which case converting them gives that float
+	r, _ := ToRat(expr)
+	if r.IsInt() && r.Num().IsInt64() {
+		return int(r.Num().Int64())
+	}
+	f, _ := r.Float64()
+	return hashNumber(SexpFloat(f))
+}
+
+func hashSequence(items []Sexp, depth int) (int, error) {
+	hash := 1
+	for _, item := range items {
+		h, err := hashExpression(item, depth+1)
 		if err != nil {
 			return 0, err
 		}
-		return int(hasher.Sum32()), nil
+		hash = 31*hash + h
 	}
-	return 0, errors.New(fmt.Sprintf("cannot hash type %T", expr))
+	return hash, nil
+}
+
+func hashPair(pair SexpPair, depth int) (int, error) {
+	hash := 7
+	var expr Sexp = pair
+	for {
+		p, ok := expr.(SexpPair)
+		if !ok {
+			break
+		}
+		h, err := hashExpression(p.head, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		hash = 31*hash + h
+		expr = p.tail
+	}
+	h, err := hashExpression(expr, depth+1)
+	return 31*hash + h, err
+}
+
+// hashPairs hashes a hash or map without depending on the order of its
+// entries.
+func hashPairs(expr Sexp, depth int) (int, error) {
+	pairs, _ := mapPairs(expr)
+	hash := 0
+	for _, pair := range pairs {
+		hk, err := hashExpression(pair.head, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		hv, err := hashExpression(pair.tail, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		hash += 31*hk ^ hv
+	}
+	return hash, nil
+}
+
+// mapPairs returns the entries of a hash or map, in order.
+func mapPairs(expr Sexp) ([]SexpPair, bool) {
+	switch e := expr.(type) {
+	case SexpHash:
+		return e.Pairs(), true
+	case SexpMap:
+		return e.Pairs(), true
+	}
+	return nil, false
+}
+
+func hashString(s string) (int, error) {
+	hasher := fnv.New32()
+	_, err := hasher.Write([]byte(s))
+	if err != nil {
+		return 0, err
+	}
+	return int(hasher.Sum32()), nil
 }
 
 func MakeHash(args []Sexp, typename string) (SexpHash, error) {
@@ -33,12 +160,14 @@ func MakeHash(args []Sexp, typename string) (SexpHash, error) {
 
 	var iface interface{}
 	var memberCount int
+	index := make(map[int][]int)
 	hash := SexpHash{
 		TypeName: &typename,
 		Map:      make(map[int][]SexpPair),
 		KeyOrder: &[]Sexp{},
 		GoStruct: &iface,
 		NumKeys:  &memberCount,
+		Index:    &index,
 	}
 	k := 0
 	for i := 0; i < len(args); i += 2 {
@@ -95,32 +224,24 @@ func (hash *SexpHash) HashSet(key Sexp, val Sexp) error {
 	if err != nil {
 		return err
 	}
-	arr, ok := hash.Map[hashval]
-
-	if !ok {
-		hash.Map[hashval] = []SexpPair{Cons(key, val)}
-		*hash.KeyOrder = append(*hash.KeyOrder, key)
-		(*hash.NumKeys)++
-		return nil
-	}
+	arr := hash.Map[hashval]
+	index := *hash.Index
 
-	found := false
 	for i, pair := range arr {
 		res, err := Compare(pair.head, key)
 		if err == nil && res == 0 {
 			arr[i] = Cons(key, val)
-			found = true
+			// an equal key of another type, like 2.0 for 2, takes
+			// the place of the old one
+			(*hash.KeyOrder)[index[hashval][i]] = key
+			return nil
 		}
 	}
 
-	if !found {
-		arr = append(arr, Cons(key, val))
-		*hash.KeyOrder = append(*hash.KeyOrder, key)
-		(*hash.NumKeys)++
-	}
-
-	hash.Map[hashval] = arr
-
+	hash.Map[hashval] = append(arr, Cons(key, val))
+	index[hashval] = append(index[hashval], len(*hash.KeyOrder))
+	*hash.KeyOrder = append(*hash.KeyOrder, key)
+	(*hash.NumKeys)++
 	return nil
 }
 
@@ -129,18 +250,26 @@ func (hash *SexpHash) HashDelete(key Sexp) error {
 	if err != nil {
 		return err
 	}
-	arr, ok := hash.Map[hashval]
+	arr := hash.Map[hashval]
+	index := *hash.Index
 
-	// if it doesn't exist, no need to delete it
-	if !ok {
-		return nil
-	}
-
-	(*hash.NumKeys)--
 	for i, pair := range arr {
 		res, err := Compare(pair.head, key)
 		if err == nil && res == 0 {
-			hash.Map[hashval] = append(arr[0:i], arr[i+1:]...)
+			pos := index[hashval][i]
+			if len(arr) == 1 {
+				delete(hash.Map, hashval)
+				delete(index, hashval)
+			} else {
+				hash.Map[hashval] = append(arr[0:i], arr[i+1:]...)
+				index[hashval] = append(index[hashval][0:i],
+					index[hashval][i+1:]...)
+			}
+			(*hash.KeyOrder)[pos] = SexpEnd
+			(*hash.NumKeys)--
+			if len(*hash.KeyOrder) > 2*(*hash.NumKeys)+8 {
+				hash.compactKeyOrder()
+			}
 			break
 		}
 	}
@@ -148,15 +277,68 @@ func (hash *SexpHash) HashDelete(key Sexp) error {
 	return nil
 }
 
-func HashCountKeys(hash SexpHash) int {
+// compactKeyOrder closes the gaps deleted keys left in the order of the
+// keys.
+func (hash *SexpHash) compactKeyOrder() {
+	order := *hash.KeyOrder
+	moved := make([]int, len(order))
+	for i := range moved {
+		moved[i] = -1
+	}
+	for _, positions := range *hash.Index {
+		for _, pos := range positions {
+			moved[pos] = 0
+		}
+	}
+
+	compacted := make([]Sexp, 0, *hash.NumKeys)
+	for i, key := range order {
+		if moved[i] == 0 {
+			moved[i] = len(compacted)
+			compacted = append(compacted, key)
+		}
+	}
+	for _, positions := range *hash.Index {
+		for j, pos := range positions {
+			positions[j] = moved[pos]
+		}
+	}
+	*hash.KeyOrder = compacted
+}
+
+// Pairs returns the entries of the hash as (key . value) pairs, in the
+// order the keys were added.
+func (hash *SexpHash) Pairs() []SexpPair {
+	order := make([]SexpPair, len(*hash.KeyOrder))
+	present := make([]bool, len(order))
+	for hashval, arr := range hash.Map {
+		for i, pair := range arr {
+			pos := (*hash.Index)[hashval][i]
+			order[pos] = pair
+			present[pos] = true
+		}
+	}
+
+	pairs := make([]SexpPair, 0, *hash.NumKeys)
+	for i, pair := range order {
+		if present[i] {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+func HashCountKeys(hash SexpHash) (int, error) {
 	var num int
 	for _, arr := range hash.Map {
 		num += len(arr)
 	}
 	if num != (*hash.NumKeys) {
-		panic(fmt.Errorf("HashCountKeys disagreement on count: num=%d, (*hash.NumKeys)=%d", num, (*hash.NumKeys)))
+		return num, internalError(fmt.Errorf(
+			"HashCountKeys disagreement on count: num=%d, (*hash.NumKeys)=%d",
+			num, (*hash.NumKeys)))
 	}
-	return num
+	return num, nil
 }
 
 func HashIsEmpty(hash SexpHash) bool {
@@ -169,16 +351,42 @@ func HashIsEmpty(hash SexpHash) bool {
 }
 
 func SetHashKeyOrder(hash *SexpHash, keyOrd Sexp) error {
-	// truncate down to zero, then build back up correctly.
-	*(*hash).KeyOrder = (*(*hash).KeyOrder)[:0]
-
 	keys, isArr := keyOrd.(SexpArray)
 	if !isArr {
 		return fmt.Errorf("must have SexpArray for keyOrd, but instead we have: %T with value='%#v'", keyOrd, keyOrd)
 	}
-	for _, key := range keys {
-		*hash.KeyOrder = append(*hash.KeyOrder, key)
+	if len(keys) != *hash.NumKeys {
+		return errors.New("key order must hold each key of the hash once")
+	}
+
+	// find each key in its bucket, then build the order back up
+	index := make(map[int][]int)
+	for hashval, arr := range hash.Map {
+		index[hashval] = make([]int, len(arr))
+		for i := range arr {
+			index[hashval][i] = -1
+		}
+	}
+	for pos, key := range keys {
+		hashval, err := HashExpression(key)
+		if err != nil {
+			return err
+		}
+		found := false
+		for i, pair := range hash.Map[hashval] {
+			res, err := Compare(pair.head, key)
+			if err == nil && res == 0 && index[hashval][i] < 0 {
+				index[hashval][i] = pos
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("key %s not found", key.SexpString())
+		}
 	}
 
+	*hash.Index = index
+	*hash.KeyOrder = append((*hash.KeyOrder)[:0], keys...)
 	return nil
 }
@@ -30,6 +30,8 @@ const (
 	TokenOct
 	TokenBinary
 	TokenFloat
+	TokenRatio
+	TokenBigDecimal
 	TokenChar
 	TokenString
 	TokenEnd
@@ -88,12 +90,18 @@ const (
 )
 
 type Lexer struct {
-	state    LexerState
-	tokens   []Token
-	buffer   *bytes.Buffer
-	stream   io.RuneReader
-	linenum  int
-	finished bool
+	state     LexerState
+	tokens    []Token
+	positions []Position
+	buffer    *bytes.Buffer
+	stream    io.RuneReader
+	filename  string
+	linenum   int
+	column    int
+	runepos   Position // position of the rune being lexed
+	startpos  Position // position of the first rune in the buffer
+	lastpos   Position // position of the last token returned
+	finished  bool
 }
 
 var (
@@ -102,7 +110,9 @@ var (
 	HexRegex     = regexp.MustCompile("^0x[0-9a-fA-F]+$")
 	OctRegex     = regexp.MustCompile("^0o[0-7]+$")
 	BinaryRegex  = regexp.MustCompile("^0b[01]+$")
-	SymbolRegex  = regexp.MustCompile("^[^'#]+$")
+	RatioRegex   = regexp.MustCompile("^-?[0-9]+/[0-9]+$")
+	BigDecRegex  = regexp.MustCompile("^-?[0-9]+(\\.[0-9]+)?M$")
+	SymbolRegex  = regexp.MustCompile("^[^'#]+#?$")
 	CharRegex    = regexp.MustCompile("^#\\\\?.$")
 	FloatRegex   = regexp.MustCompile("^-?([0-9]+\\.[0-9]*)|(\\.[0-9]+)|([0-9]+(\\.[0-9]*)?[eE](-?[0-9]+))$")
 )
@@ -173,6 +183,12 @@ func DecodeAtom(atom string) (Token, error) {
 	if BinaryRegex.MatchString(atom) {
 		return Token{TokenBinary, atom[2:]}, nil
 	}
+	if RatioRegex.MatchString(atom) {
+		return Token{TokenRatio, atom}, nil
+	}
+	if BigDecRegex.MatchString(atom) {
+		return Token{TokenBigDecimal, atom[:len(atom)-1]}, nil
+	}
 	if FloatRegex.MatchString(atom) {
 		return Token{TokenFloat, atom}, nil
 	}
@@ -201,14 +217,19 @@ func (lexer *Lexer) dumpBuffer() error {
 	}
 
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, tok)
+	lexer.emit(tok, lexer.startpos)
 	return nil
 }
 
 func (lexer *Lexer) dumpString() {
 	str := lexer.buffer.String()
 	lexer.buffer.Reset()
-	lexer.tokens = append(lexer.tokens, Token{TokenString, str})
+	lexer.emit(Token{TokenString, str}, lexer.startpos)
+}
+
+func (lexer *Lexer) emit(tok Token, pos Position) {
+	lexer.tokens = append(lexer.tokens, tok)
+	lexer.positions = append(lexer.positions, pos)
 }
 
 func DecodeBrace(brace rune) Token {
@@ -260,11 +281,10 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 	}
 	if lexer.state == LexerUnquote {
 		if r == '@' {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTildeAt, ""})
+			lexer.emit(Token{TokenTildeAt, ""}, lexer.startpos)
 		} else {
-			lexer.tokens = append(
-				lexer.tokens, Token{TokenTilde, ""})
+			lexer.emit(Token{TokenTilde, ""}, lexer.startpos)
+			lexer.startpos = lexer.runepos
 			lexer.buffer.WriteRune(r)
 		}
 		lexer.state = LexerNormal
@@ -275,6 +295,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected quote")
 		}
+		lexer.startpos = lexer.runepos
 		lexer.state = LexerStrLit
 		return nil
 	}
@@ -288,7 +309,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected quote")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenQuote, ""})
+		lexer.emit(Token{TokenQuote, ""}, lexer.runepos)
 		return nil
 	}
 
@@ -296,7 +317,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected backtick")
 		}
-		lexer.tokens = append(lexer.tokens, Token{TokenBacktick, ""})
+		lexer.emit(Token{TokenBacktick, ""}, lexer.runepos)
 		return nil
 	}
 
@@ -304,6 +325,7 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if lexer.buffer.Len() > 0 {
 			return errors.New("Unexpected tilde")
 		}
+		lexer.startpos = lexer.runepos
 		lexer.state = LexerUnquote
 		return nil
 	}
@@ -313,13 +335,10 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		if err != nil {
 			return err
 		}
-		lexer.tokens = append(lexer.tokens, DecodeBrace(r))
+		lexer.emit(DecodeBrace(r), lexer.runepos)
 		return nil
 	}
 	if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
-		if r == '\n' {
-			lexer.linenum++
-		}
 		err := lexer.dumpBuffer()
 		if err != nil {
 			return err
@@ -327,6 +346,9 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 		return nil
 	}
 
+	if lexer.buffer.Len() == 0 {
+		lexer.startpos = lexer.runepos
+	}
 	_, err := lexer.buffer.WriteRune(r)
 	if err != nil {
 		return err
@@ -349,6 +371,14 @@ func (lexer *Lexer) PeekNextToken() (Token, error) {
 			return Token{TokenEnd, ""}, nil
 		}
 
+		lexer.runepos = Position{lexer.filename, lexer.linenum, lexer.column}
+		if r == '\n' {
+			lexer.linenum++
+			lexer.column = 1
+		} else {
+			lexer.column++
+		}
+
 		err = lexer.LexNextRune(r)
 		if err != nil {
 			return Token{TokenEnd, ""}, err
@@ -364,21 +394,41 @@ func (lexer *Lexer) GetNextToken() (Token, error) {
 	if err != nil || tok.typ == TokenEnd {
 		return Token{TokenEnd, ""}, err
 	}
+	lexer.lastpos = lexer.positions[0]
 	lexer.tokens = lexer.tokens[1:]
+	lexer.positions = lexer.positions[1:]
 	return tok, nil
 }
 
 func NewLexerFromStream(stream io.RuneReader) *Lexer {
 	return &Lexer{
-		tokens:   make([]Token, 0, 10),
-		buffer:   new(bytes.Buffer),
-		state:    LexerNormal,
-		stream:   stream,
-		linenum:  1,
-		finished: false,
+		tokens:    make([]Token, 0, 10),
+		positions: make([]Position, 0, 10),
+		buffer:    new(bytes.Buffer),
+		state:     LexerNormal,
+		stream:    stream,
+		linenum:   1,
+		column:    1,
+		finished:  false,
 	}
 }
 
+func NewLexerFromNamedStream(stream io.RuneReader, filename string) *Lexer {
+	lexer := NewLexerFromStream(stream)
+	lexer.filename = filename
+	return lexer
+}
+
 func (lexer *Lexer) Linenum() int {
 	return lexer.linenum
 }
+
+// Position returns the current position of the lexer in its input.
+func (lexer *Lexer) Position() Position {
+	return Position{lexer.filename, lexer.linenum, lexer.column}
+}
+
+// LastPosition returns the position of the last token read.
+func (lexer *Lexer) LastPosition() Position {
+	return lexer.lastpos
+}
@@ -0,0 +1,181 @@
+package glisp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Limits bounds the resources a script may use while it runs. A zero
+// value for any field means that resource is unlimited.
+type Limits struct {
+	MaxInstructions   int           // instructions executed per run
+	MaxDuration       time.Duration // wall time per run
+	MaxStackDepth     int           // values on the data stack
+	MaxCallDepth      int           // nested function calls
+	MaxCollectionSize int           // elements in an array, string or hash
+}
+
+type LimitKind int
+
+const (
+	InstructionLimit LimitKind = iota
+	TimeLimit
+	StackLimit
+	CallDepthLimit
+	CollectionLimit
+	Cancelled
+)
+
+func (kind LimitKind) String() string {
+	switch kind {
+	case InstructionLimit:
+		return "instruction"
+	case TimeLimit:
+		return "time"
+	case StackLimit:
+		return "stack depth"
+	case CallDepthLimit:
+		return "call depth"
+	case CollectionLimit:
+		return "collection size"
+	case Cancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// LimitError is returned when a run exceeds one of its Limits or its
+// context is done. Scripts cannot catch it.
+type LimitError struct {
+	Kind LimitKind
+	Err  error // the context's error, if Kind is Cancelled
+}
+
+func (e LimitError) Error() string {
+	if e.Kind == Cancelled {
+		return fmt.Sprintf("execution cancelled: %v", e.Err)
+	}
+	return fmt.Sprintf("%s limit exceeded", e.Kind)
+}
+
+func (e LimitError) Unwrap() error {
+	return e.Err
+}
+
+// how many instructions run between checks of the clock and context
+const limitCheckInterval = 256
+
+func (env *Glisp) SetLimits(limits Limits) {
+	env.limits = limits
+	env.limited = env.ctx != nil || limits != Limits{}
+}
+
+func (env *Glisp) Limits() Limits {
+	return env.limits
+}
+
+// Limited reports whether runs are bounded, by Limits or by the context
+// of RunContext or ApplyContext.
+func (env *Glisp) Limited() bool {
+	return env.limited
+}
+
+// RunContext is like Run, but stops with a LimitError once ctx is done.
+func (env *Glisp) RunContext(ctx context.Context) (Sexp, error) {
+	oldctx := env.ctx
+	env.setContext(ctx)
+	defer env.setContext(oldctx)
+
+	return env.Run()
+}
+
+// ApplyContext is like Apply, but stops with a LimitError once ctx is
+// done.
+func (env *Glisp) ApplyContext(ctx context.Context,
+	fun SexpFunction, args []Sexp) (Sexp, error) {
+
+	oldctx := env.ctx
+	env.setContext(ctx)
+	defer env.setContext(oldctx)
+
+	return env.Apply(fun, args)
+}
+
+func (env *Glisp) setContext(ctx context.Context) {
+	env.ctx = ctx
+	env.limited = ctx != nil || env.limits != Limits{}
+}
+
+// startRun resets the per-run budgets, unless this run is nested inside
+// one that is already in progress.
+func (env *Glisp) startRun() {
+	if env.running == 0 {
+		env.steps = 0
+		if env.limits.MaxDuration > 0 {
+			env.deadline = time.Now().Add(env.limits.MaxDuration)
+		}
+	}
+	env.running++
+}
+
+func (env *Glisp) endRun() {
+	env.running--
+}
+
+func (env *Glisp) checkLimits() error {
+	env.steps++
+	if env.limits.MaxInstructions > 0 &&
+		env.steps > env.limits.MaxInstructions {
+		return LimitError{Kind: InstructionLimit}
+	}
+	if env.limits.MaxStackDepth > 0 &&
+		env.datastack.tos >= env.limits.MaxStackDepth {
+		return LimitError{Kind: StackLimit}
+	}
+
+	if env.steps%limitCheckInterval != 0 {
+		return nil
+	}
+	if env.ctx != nil {
+		if err := env.ctx.Err(); err != nil {
+			return LimitError{Kind: Cancelled, Err: err}
+		}
+	}
+	if env.limits.MaxDuration > 0 && time.Now().After(env.deadline) {
+		return LimitError{Kind: TimeLimit}
+	}
+	return nil
+}
+
+func (env *Glisp) checkCallDepth() error {
+	if env.limits.MaxCallDepth > 0 &&
+		env.addrstack.tos+1 >= env.limits.MaxCallDepth {
+		return LimitError{Kind: CallDepthLimit}
+	}
+	return nil
+}
+
+// CheckCollectionSize fails with a LimitError if a collection of the given
+// size would exceed the environment's limits. Functions that build
+// arrays, strings or hashes should call it with the size they build.
+func (env *Glisp) CheckCollectionSize(size int) error {
+	if env.limits.MaxCollectionSize > 0 &&
+		size > env.limits.MaxCollectionSize {
+		return LimitError{Kind: CollectionLimit}
+	}
+	return nil
+}
+
+// lendBudget lets a duplicate environment evaluate code on behalf of this
+// one using what is left of this run's budget. The instructions it
+// executes are counted against this run when it is reclaimed.
+func (env *Glisp) lendBudget(dupenv *Glisp) {
+	dupenv.steps = env.steps
+	dupenv.deadline = env.deadline
+	dupenv.running = 1
+}
+
+func (env *Glisp) reclaimBudget(dupenv *Glisp) {
+	env.steps = dupenv.steps
+}
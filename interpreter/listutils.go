@@ -21,6 +21,20 @@ func ListToArray(expr Sexp) ([]Sexp, error) {
 	return arr, nil
 }
 
+// ListLen counts the pairs in a list, stopping at the first tail that
+// isn't one.
+func ListLen(expr Sexp) int {
+	n := 0
+	for {
+		list, ok := expr.(SexpPair)
+		if !ok {
+			return n
+		}
+		n++
+		expr = list.tail
+	}
+}
+
 func MakeList(expressions []Sexp) Sexp {
 	if len(expressions) == 0 {
 		return SexpNull
@@ -0,0 +1,598 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+var (
+	sexpType   = reflect.TypeOf((*Sexp)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	envType    = reflect.TypeOf((*Glisp)(nil))
+	bigIntType = reflect.TypeOf(big.Int{})
+	bigRatType = reflect.TypeOf(big.Rat{})
+)
+
+// AddGoFunction makes an ordinary Go function callable from scripts.
+// Arguments are converted with ToGo and results with FromGo. A trailing
+// error result is returned as the call's error, and multiple results are
+// returned as an array. If the first parameter is a *Glisp, it receives
+// the calling environment.
+func (env *Glisp) AddGoFunction(name string, function interface{}) error {
+	fval := reflect.ValueOf(function)
+	if fval.Kind() != reflect.Func {
+		return fmt.Errorf("%s: expected a function, got %T", name, function)
+	}
+	env.AddFunction(name, makeGoFunction(fval))
+	return nil
+}
+
+func makeGoFunction(fval reflect.Value) GlispUserFunction {
+	ftype := fval.Type()
+	passenv := ftype.NumIn() > 0 && ftype.In(0) == envType
+	first := 0
+	if passenv {
+		first = 1
+	}
+	nparams := ftype.NumIn() - first
+
+	return func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+		if ftype.IsVariadic() {
+			if len(args) < nparams-1 {
+				return SexpNull, WrongNargs
+			}
+		} else if len(args) != nparams {
+			return SexpNull, WrongNargs
+		}
+
+		in := make([]reflect.Value, 0, first+len(args))
+		if passenv {
+			in = append(in, reflect.ValueOf(env))
+		}
+		for i, arg := range args {
+			var ptype reflect.Type
+			if ftype.IsVariadic() && first+i >= ftype.NumIn()-1 {
+				ptype = ftype.In(ftype.NumIn() - 1).Elem()
+			} else {
+				ptype = ftype.In(first + i)
+			}
+			param := reflect.New(ptype).Elem()
+			if err := env.toGoValue(arg, param); err != nil {
+				return SexpNull, fmt.Errorf("argument %d: %w", i+1, err)
+			}
+			in = append(in, param)
+		}
+
+		out := fval.Call(in)
+		if n := len(out); n > 0 && ftype.Out(n-1) == errorType {
+			if err, _ := out[n-1].Interface().(error); err != nil {
+				return SexpNull, err
+			}
+			out = out[:n-1]
+		}
+
+		switch len(out) {
+		case 0:
+			return SexpNull, nil
+		case 1:
+			return env.fromGoValue(out[0])
+		}
+		results := make([]Sexp, len(out))
+		for i, res := range out {
+			expr, err := env.fromGoValue(res)
+			if err != nil {
+				return SexpNull, err
+			}
+			results[i] = expr
+		}
+		return SexpArray(results), nil
+	}
+}
+
+// FromGo converts a Go value into the corresponding glisp value. Structs
+// become hashes typed with the struct's name and keyed by symbols, slices
+// become arrays, and functions become callable glisp functions.
+func (env *Glisp) FromGo(value interface{}) (Sexp, error) {
+	if value == nil {
+		return SexpNull, nil
+	}
+	return env.fromGoValue(reflect.ValueOf(value))
+}
+
+func (env *Glisp) fromGoValue(val reflect.Value) (Sexp, error) {
+	if !val.IsValid() {
+		return SexpNull, nil
+	}
+	if val.Type().Implements(sexpType) {
+		if val.Kind() == reflect.Interface && val.IsNil() {
+			return SexpNull, nil
+		}
+		return val.Interface().(Sexp), nil
+	}
+
+	switch val.Type() {
+	case bigIntType:
+		i := val.Interface().(big.Int)
+		return MakeBigInt(&i), nil
+	case bigRatType:
+		r := val.Interface().(big.Rat)
+		return MakeRatio(&r), nil
+	}
+
+	switch val.Kind() {
+	case reflect.Bool:
+		return SexpBool(val.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return SexpInt(val.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		if u := val.Uint(); u > math.MaxInt64 {
+			return MakeBigInt(new(big.Int).SetUint64(u)), nil
+		}
+		return SexpInt(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return SexpFloat(val.Float()), nil
+	case reflect.String:
+		return SexpStr(val.String()), nil
+	case reflect.Ptr, reflect.Interface:
+		if val.IsNil() {
+			return SexpNull, nil
+		}
+		return env.fromGoValue(val.Elem())
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice {
+			if val.IsNil() {
+				return SexpNull, nil
+			}
+			if val.Type().Elem().Kind() == reflect.Uint8 {
+				return SexpStr(val.Bytes()), nil
+			}
+		}
+		arr := make([]Sexp, val.Len())
+		for i := range arr {
+			expr, err := env.fromGoValue(val.Index(i))
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = expr
+		}
+		return SexpArray(arr), nil
+	case reflect.Map:
+		if val.IsNil() {
+			return SexpNull, nil
+		}
+		hash, _ := MakeHash(nil, "hash")
+		iter := val.MapRange()
+		for iter.Next() {
+			key, err := env.fromGoValue(iter.Key())
+			if err != nil {
+				return SexpNull, err
+			}
+			elem, err := env.fromGoValue(iter.Value())
+			if err != nil {
+				return SexpNull, err
+			}
+			if err = hash.HashSet(key, elem); err != nil {
+				return SexpNull, err
+			}
+		}
+		return hash, nil
+	case reflect.Struct:
+		return env.fromGoStruct(val)
+	case reflect.Func:
+		if val.IsNil() {
+			return SexpNull, nil
+		}
+		return MakeUserFunction(val.Type().String(), makeGoFunction(val)), nil
+	}
+	return SexpNull, fmt.Errorf("cannot convert Go type %s", val.Type())
+}
+
+func (env *Glisp) fromGoStruct(val reflect.Value) (Sexp, error) {
+	hash, _ := MakeHash(nil, val.Type().Name())
+	for _, field := range structFields(val.Type()) {
+		elem, err := env.fromGoValue(val.FieldByIndex(field.index))
+		if err != nil {
+			return SexpNull, fmt.Errorf("field %s: %w", field.name, err)
+		}
+		err = hash.HashSet(env.MakeSymbol(field.name), elem)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+
+	// keep the original so ToGo can restore fields scripts can't see
+	copied := reflect.New(val.Type()).Elem()
+	copied.Set(val)
+	*hash.GoStruct = copied.Interface()
+	return hash, nil
+}
+
+// ToGo converts a glisp value into the Go value that target points to.
+// Hashes fill in structs field by field, looking each field up by its
+// glisp struct tag or its name, as a symbol or a string key.
+func (env *Glisp) ToGo(expr Sexp, target interface{}) error {
+	ptr := reflect.ValueOf(target)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("ToGo target must be a non-nil pointer, got %T",
+			target)
+	}
+	return env.toGoValue(expr, ptr.Elem())
+}
+
+func (env *Glisp) toGoValue(expr Sexp, val reflect.Value) error {
+	vtype := val.Type()
+	if vtype.Kind() == reflect.Interface && vtype.NumMethod() > 0 {
+		if !reflect.TypeOf(expr).AssignableTo(vtype) {
+			return fmt.Errorf("cannot convert %s to %s",
+				expr.SexpString(), vtype)
+		}
+		val.Set(reflect.ValueOf(expr))
+		return nil
+	}
+	if reflect.TypeOf(expr).AssignableTo(vtype) &&
+		vtype.Kind() != reflect.Interface {
+		val.Set(reflect.ValueOf(expr))
+		return nil
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("cannot convert %s to %s", expr.SexpString(), vtype)
+	}
+
+	switch vtype {
+	case bigIntType:
+		i, ok := ToBigInt(expr)
+		if !ok {
+			return mismatch()
+		}
+		val.Set(reflect.ValueOf(*new(big.Int).Set(i)))
+		return nil
+	case bigRatType:
+		r, ok := ToRat(expr)
+		if !ok {
+			return mismatch()
+		}
+		val.Set(reflect.ValueOf(*new(big.Rat).Set(r)))
+		return nil
+	}
+
+	switch vtype.Kind() {
+	case reflect.Interface:
+		gval, err := env.naturalGoValue(expr)
+		if err != nil {
+			return err
+		}
+		if gval == nil {
+			val.Set(reflect.Zero(vtype))
+		} else {
+			val.Set(reflect.ValueOf(gval))
+		}
+		return nil
+	case reflect.Bool:
+		b, ok := expr.(SexpBool)
+		if !ok {
+			return mismatch()
+		}
+		val.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		var n int64
+		switch e := expr.(type) {
+		case SexpInt:
+			n = int64(e)
+		case SexpChar:
+			n = int64(e)
+		default:
+			return mismatch()
+		}
+		if val.OverflowInt(n) {
+			return fmt.Errorf("%s overflows %s", expr.SexpString(), vtype)
+		}
+		val.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch e := expr.(type) {
+		case SexpInt:
+			if e < 0 {
+				return mismatch()
+			}
+			n = uint64(e)
+		case SexpBigInt:
+			if e.v.Sign() < 0 {
+				return mismatch()
+			}
+			if !e.v.IsUint64() {
+				return fmt.Errorf("%s overflows %s", expr.SexpString(), vtype)
+			}
+			n = e.v.Uint64()
+		default:
+			return mismatch()
+		}
+		if val.OverflowUint(n) {
+			return fmt.Errorf("%s overflows %s", expr.SexpString(), vtype)
+		}
+		val.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		switch e := expr.(type) {
+		case SexpFloat:
+			val.SetFloat(float64(e))
+		case SexpInt:
+			val.SetFloat(float64(e))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		switch e := expr.(type) {
+		case SexpStr:
+			val.SetString(string(e))
+		case SexpSymbol:
+			val.SetString(e.name)
+		case SexpChar:
+			val.SetString(string(e))
+		default:
+			return mismatch()
+		}
+	case reflect.Ptr:
+		if expr == SexpNull {
+			val.Set(reflect.Zero(vtype))
+			return nil
+		}
+		elem := reflect.New(vtype.Elem())
+		if err := env.toGoValue(expr, elem.Elem()); err != nil {
+			return err
+		}
+		val.Set(elem)
+	case reflect.Slice:
+		if expr == SexpNull {
+			val.Set(reflect.Zero(vtype))
+			return nil
+		}
+		if s, ok := expr.(SexpStr); ok &&
+			vtype.Elem().Kind() == reflect.Uint8 {
+			val.SetBytes([]byte(s))
+			return nil
+		}
+		items, err := sequenceItems(expr)
+		if err != nil {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(vtype, len(items), len(items))
+		for i, item := range items {
+			if err := env.toGoValue(item, slice.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+		val.Set(slice)
+	case reflect.Array:
+		items, err := sequenceItems(expr)
+		if err != nil {
+			return mismatch()
+		}
+		if len(items) != vtype.Len() {
+			return fmt.Errorf("expected %d elements for %s, got %d",
+				vtype.Len(), vtype, len(items))
+		}
+		for i, item := range items {
+			if err := env.toGoValue(item, val.Index(i)); err != nil {
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+		}
+	case reflect.Map:
+		if expr == SexpNull {
+			val.Set(reflect.Zero(vtype))
+			return nil
+		}
+		var pairs []SexpPair
+		switch e := expr.(type) {
+		case SexpHash:
+			pairs = e.Pairs()
+		case SexpMap:
+			pairs = e.Pairs()
+		default:
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(vtype, len(pairs))
+		for _, pair := range pairs {
+			key, elem := pair.head, pair.tail
+			gkey := reflect.New(vtype.Key()).Elem()
+			if err := env.toGoValue(key, gkey); err != nil {
+				return fmt.Errorf("key %s: %w", key.SexpString(), err)
+			}
+			gelem := reflect.New(vtype.Elem()).Elem()
+			if err := env.toGoValue(elem, gelem); err != nil {
+				return fmt.Errorf("key %s: %w", key.SexpString(), err)
+			}
+			m.SetMapIndex(gkey, gelem)
+		}
+		val.Set(m)
+	case reflect.Struct:
+		hash, ok := expr.(SexpHash)
+		if !ok {
+			return mismatch()
+		}
+		return env.toGoStruct(hash, val)
+	case reflect.Func:
+		fun, ok := expr.(SexpFunction)
+		if !ok {
+			return mismatch()
+		}
+		return env.toGoFunction(fun, val)
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+func (env *Glisp) toGoStruct(hash SexpHash, val reflect.Value) error {
+	vtype := val.Type()
+	if orig := *hash.GoStruct; orig != nil &&
+		reflect.TypeOf(orig) == vtype {
+		val.Set(reflect.ValueOf(orig))
+	}
+
+	for _, field := range structFields(vtype) {
+		elem, err := hash.HashGetDefault(env.MakeSymbol(field.name), SexpEnd)
+		if err != nil {
+			return err
+		}
+		if elem == SexpEnd {
+			elem, err = hash.HashGetDefault(SexpStr(field.name), SexpEnd)
+			if err != nil {
+				return err
+			}
+		}
+		if elem == SexpEnd {
+			continue
+		}
+		err = env.toGoValue(elem, val.FieldByIndex(field.index))
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.name, err)
+		}
+	}
+	return nil
+}
+
+// toGoFunction wraps a glisp function so Go code can call it. The Go
+// function type must return an error last, which reports failures from
+// the call or from converting its result.
+func (env *Glisp) toGoFunction(fun SexpFunction, val reflect.Value) error {
+	ftype := val.Type()
+	nout := ftype.NumOut()
+	if nout == 0 || nout > 2 || ftype.Out(nout-1) != errorType {
+		return fmt.Errorf("cannot convert function to %s: "+
+			"it must return an error and at most one other value", ftype)
+	}
+
+	wrapper := func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, nout)
+		for i := range out {
+			out[i] = reflect.New(ftype.Out(i)).Elem()
+		}
+		fail := func(err error) []reflect.Value {
+			out[nout-1] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+
+		var args []Sexp
+		for i, arg := range in {
+			if ftype.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					expr, err := env.fromGoValue(arg.Index(j))
+					if err != nil {
+						return fail(err)
+					}
+					args = append(args, expr)
+				}
+				break
+			}
+			expr, err := env.fromGoValue(arg)
+			if err != nil {
+				return fail(err)
+			}
+			args = append(args, expr)
+		}
+
+		result, err := env.Apply(fun, args)
+		if err != nil {
+			return fail(err)
+		}
+		if nout == 2 {
+			if err = env.toGoValue(result, out[0]); err != nil {
+				return fail(err)
+			}
+		}
+		return out
+	}
+	val.Set(reflect.MakeFunc(ftype, wrapper))
+	return nil
+}
+
+// naturalGoValue picks a Go representation for a glisp value when the
+// target type doesn't say which one to use.
+func (env *Glisp) naturalGoValue(expr Sexp) (interface{}, error) {
+	switch e := expr.(type) {
+	case SexpInt:
+		return int(e), nil
+	case SexpFloat:
+		return float64(e), nil
+	case SexpBigInt:
+		return e.BigInt(), nil
+	case SexpRatio:
+		return e.Rat(), nil
+	case SexpDecimal:
+		return e.Rat(), nil
+	case SexpBool:
+		return bool(e), nil
+	case SexpStr:
+		return string(e), nil
+	case SexpChar:
+		return rune(e), nil
+	case SexpSymbol:
+		return e.name, nil
+	case SexpArray, SexpVector, SexpPair:
+		var items []interface{}
+		err := env.toGoValue(expr, reflect.ValueOf(&items).Elem())
+		return items, err
+	case SexpHash, SexpMap:
+		var m map[string]interface{}
+		err := env.toGoValue(expr, reflect.ValueOf(&m).Elem())
+		return m, err
+	}
+	if expr == SexpNull {
+		return nil, nil
+	}
+	return expr, nil
+}
+
+// sequenceItems returns the elements of an array, vector or list.
+func sequenceItems(expr Sexp) ([]Sexp, error) {
+	switch e := expr.(type) {
+	case SexpArray:
+		return e, nil
+	case SexpVector:
+		return e.Slice(), nil
+	case SexpPair:
+		return ListToArray(e)
+	}
+	if expr == SexpNull {
+		return []Sexp{}, nil
+	}
+	return nil, errors.New("not a sequence")
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// structFields lists the exported fields of a struct type along with the
+// names they have in glisp. A field tagged `glisp:"name"` uses that name,
+// and one tagged `glisp:"-"` is left out.
+func structFields(stype reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < stype.NumField(); i++ {
+		field := stype.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("glisp"); ok {
+			tag = strings.Split(tag, ",")[0]
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, structField{name, field.Index})
+	}
+	return fields
+}
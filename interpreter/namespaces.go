@@ -0,0 +1,359 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// namespace records what is known about a namespace while compiling: the
+// names it defines at top level, and the aliases it gave to the modules
+// it requires. Its definitions are bound in the global scope under
+// qualified names like my.lib/helper.
+type namespace struct {
+	name    string
+	mu      sync.RWMutex
+	defs    map[string]bool // name to whether it is public
+	aliases map[string]string
+
+	// set for namespaces loaded from a file by require
+	code      *SexpFunction
+	compiling bool
+	loaded    bool
+}
+
+func newNamespace(name string) *namespace {
+	return &namespace{
+		name:    name,
+		defs:    make(map[string]bool),
+		aliases: make(map[string]string),
+	}
+}
+
+func (ns *namespace) define(name string, public bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.defs[name] = public
+}
+
+func (ns *namespace) defines(name string) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	_, ok := ns.defs[name]
+	return ok
+}
+
+func (ns *namespace) isPrivate(name string) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	public, ok := ns.defs[name]
+	return ok && !public
+}
+
+func (ns *namespace) alias(alias string, name string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.aliases[alias] = name
+}
+
+func (ns *namespace) resolveAlias(alias string) string {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if name, ok := ns.aliases[alias]; ok {
+		return name
+	}
+	return alias
+}
+
+// namespaceTable holds the namespaces of an environment and its
+// duplicates, along with the modules compiled for them.
+type namespaceTable struct {
+	mu         sync.Mutex
+	namespaces map[string]*namespace
+}
+
+func newNamespaceTable() *namespaceTable {
+	return &namespaceTable{namespaces: make(map[string]*namespace)}
+}
+
+func (table *namespaceTable) get(name string) (*namespace, bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	ns, ok := table.namespaces[name]
+	return ns, ok
+}
+
+// intern finds the namespace with the given name, creating it if needed.
+func (table *namespaceTable) intern(name string) *namespace {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	ns, ok := table.namespaces[name]
+	if !ok {
+		ns = newNamespace(name)
+		table.namespaces[name] = ns
+	}
+	return ns
+}
+
+// startLoad marks a module as loaded, reporting whether it wasn't yet.
+func (table *namespaceTable) startLoad(ns *namespace) bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if ns.loaded {
+		return false
+	}
+	ns.loaded = true
+	return true
+}
+
+func (table *namespaceTable) failLoad(ns *namespace) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	ns.loaded = false
+}
+
+func (table *namespaceTable) isCompiling(ns *namespace) bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return ns.compiling
+}
+
+func (table *namespaceTable) setCompiling(ns *namespace, compiling bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	ns.compiling = compiling
+}
+
+// compiled returns the code of a module, or nil if it isn't compiled yet.
+func (table *namespaceTable) compiled(ns *namespace) *SexpFunction {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return ns.code
+}
+
+func (table *namespaceTable) setCompiled(ns *namespace, code *SexpFunction) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	ns.code = code
+}
+
+// SplitQualified splits a qualified name like lib/fn into its namespace
+// and name. The division operator / is not qualified.
+func SplitQualified(name string) (string, string, bool) {
+	i := strings.LastIndex(name, "/")
+	if i <= 0 || i == len(name)-1 {
+		return "", name, false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// Namespace returns the current namespace that code is compiled in, or
+// the empty string if there is none.
+func (env *Glisp) Namespace() string {
+	return env.curns.name
+}
+
+// SetModulePath sets the directories that require searches for modules.
+// The module my.lib is read from my/lib.glisp in the first directory that
+// has it.
+func (env *Glisp) SetModulePath(dirs ...string) {
+	env.modulePath = dirs
+}
+
+func (env *Glisp) ModulePath() []string {
+	return env.modulePath
+}
+
+// Require loads a module, compiling it the first time it is required and
+// running it once.
+func (env *Glisp) Require(name string) error {
+	ns, err := env.compileModule(name)
+	if err != nil {
+		return err
+	}
+	if !env.namespaces.startLoad(ns) {
+		return nil
+	}
+
+	// the module defines its names in the global scope, wherever it
+	// was required from
+	curfunc, curpc := env.curfunc, env.pc
+	scopestack := env.scopestack
+	env.scopestack = NewStack(ScopeStackSize)
+	env.scopestack.Push(scopestack.elements[0])
+	env.curfunc = *env.namespaces.compiled(ns)
+	env.pc = 0
+
+	_, err = env.Run()
+
+	env.curfunc, env.pc = curfunc, curpc
+	env.scopestack = scopestack
+	if err != nil {
+		env.namespaces.failLoad(ns)
+		return fmt.Errorf("loading %s: %w", name, err)
+	}
+	return nil
+}
+
+// compileModule compiles the module with the given name from the module
+// path, unless it has been compiled already.
+func (env *Glisp) compileModule(name string) (*namespace, error) {
+	if ns, ok := env.namespaces.get(name); ok {
+		if env.namespaces.isCompiling(ns) {
+			return nil, fmt.Errorf("%s requires itself", name)
+		}
+		if env.namespaces.compiled(ns) != nil {
+			return ns, nil
+		}
+	}
+
+	var expressions []Sexp
+	err := errors.New("module " + name + " not found")
+	file := strings.Replace(name, ".", "/", -1) + ".glisp"
+	for _, dir := range env.modulePath {
+		fname := path.Join(dir, file)
+		in, operr := env.OpenFile(fname)
+		if operr != nil {
+			continue
+		}
+		expressions, err = env.parseStream(in, fname)
+		in.Close()
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ns := env.namespaces.intern(name)
+	curns := env.curns
+	env.curns = ns
+	env.namespaces.setCompiling(ns, true)
+	defer func() {
+		env.curns = curns
+		env.namespaces.setCompiling(ns, false)
+	}()
+
+	gen := NewGenerator(env)
+	if len(expressions) == 0 {
+		expressions = []Sexp{SexpNull}
+	}
+	err = gen.GenerateBegin(expressions)
+	if err != nil {
+		return nil, err
+	}
+	code := MakeFunction("__module "+name, 0, false, gen.instructions)
+	code.lines = gen.lines
+	env.namespaces.setCompiled(ns, &code)
+	return ns, nil
+}
+
+// GlobalPrefix qualifies the definitions made outside any namespace, so
+// global/helper is the global helper even where a local shadows it.
+const GlobalPrefix = "global"
+
+// qualifyDef returns the symbol a top-level definition binds: name
+// qualified by the current namespace, if there is one. The name may
+// already be qualified by it, as when a macro expands to the definition.
+func (env *Glisp) qualifyDef(sym SexpSymbol, public bool) SexpSymbol {
+	if prefix, name, ok := SplitQualified(sym.name); ok {
+		if prefix == env.curns.name ||
+			(env.curns.name == "" && prefix == GlobalPrefix) {
+			sym = env.MakeSymbol(name)
+		}
+	}
+	env.curns.define(sym.name, public)
+	if env.curns.name == "" {
+		return sym
+	}
+	return env.MakeSymbol(env.curns.name + "/" + sym.name)
+}
+
+// resolveSymbol finds what a symbol refers to in the current namespace.
+// A qualified symbol like o/fn resolves to the definition of fn in the
+// namespace aliased as o, which must be public. An unqualified one
+// resolves to a local binding, a definition in the current namespace or
+// a global, in that order, so the definition is returned as the second
+// symbol to look up when there is no local binding.
+func (env *Glisp) resolveSymbol(sym SexpSymbol) (SexpSymbol, SexpSymbol, error) {
+	if IsKeyword(sym) {
+		return sym, SexpSymbol{}, nil
+	}
+
+	if prefix, name, ok := SplitQualified(sym.name); ok {
+		if prefix == GlobalPrefix {
+			return sym, env.MakeSymbol(name), nil
+		}
+		target, known := env.namespaces.get(env.curns.resolveAlias(prefix))
+		if !known {
+			// just a name with a slash in it
+			return sym, SexpSymbol{}, nil
+		}
+		if target != env.curns && target.isPrivate(name) {
+			return sym, SexpSymbol{}, fmt.Errorf("%s is private to %s",
+				name, target.name)
+		}
+		return env.MakeSymbol(target.name + "/" + name), SexpSymbol{}, nil
+	}
+
+	if env.curns.name == "" {
+		return sym, SexpSymbol{}, nil
+	}
+	return sym, env.MakeSymbol(env.curns.name + "/" + sym.name), nil
+}
+
+// resolveDefined resolves the name of a struct type or protocol, which is
+// the definition in the current namespace if there is one, and global
+// otherwise. Unlike variables, these are looked up when compiling.
+func (env *Glisp) resolveDefined(sym SexpSymbol) (SexpSymbol, error) {
+	resolved, qualified, err := env.resolveSymbol(sym)
+	if err != nil {
+		return sym, err
+	}
+	if qualified.number != 0 && env.curns.defines(sym.name) {
+		return qualified, nil
+	}
+	return resolved, nil
+}
+
+// lookupNamespaced finds sym in the local scopes, or else the namespace
+// definition qualified.
+func (env *Glisp) lookupNamespaced(sym SexpSymbol, qualified SexpSymbol) (Sexp, bool) {
+	if qualified.number == 0 {
+		return SexpNull, false
+	}
+	if expr, err := env.scopestack.LookupSymbolNonGlobal(sym); err == nil {
+		return expr, true
+	}
+	return scopeLookup(env.scopestack.elements[0], qualified)
+}
+
+// lookupMacro finds the macro a symbol refers to, as resolveSymbol would.
+func (env *Glisp) lookupMacro(sym SexpSymbol) (SexpFunction, bool, error) {
+	resolved, qualified, err := env.resolveSymbol(sym)
+	if err != nil {
+		return MissingFunction, false, err
+	}
+	if qualified.number != 0 {
+		if macro, ok := env.macros.get(qualified); ok {
+			return macro, true, nil
+		}
+	}
+	macro, ok := env.macros.get(resolved)
+	return macro, ok, nil
+}
+
+// qualifyQuoted qualifies a symbol in a syntax-quote that names a
+// definition of ns, so a macro expanding to it works in any namespace,
+// and can't be captured by a local of the same name. It runs when the
+// macro expands, so definitions made after the macro count too.
+func (env *Glisp) qualifyQuoted(ns *namespace, sym SexpSymbol) SexpSymbol {
+	if !ns.defines(sym.name) {
+		return sym
+	}
+	if ns.name == "" {
+		return env.MakeSymbol(GlobalPrefix + "/" + sym.name)
+	}
+	return env.MakeSymbol(ns.name + "/" + sym.name)
+}
@@ -2,6 +2,7 @@ package glisp
 
 import (
 	"errors"
+	"math/big"
 )
 
 type IntegerOp int
@@ -17,6 +18,7 @@ const (
 )
 
 var WrongType error = errors.New("operands have invalid type")
+var DivideByZero error = errors.New("division by zero")
 
 func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	var ia SexpInt
@@ -28,7 +30,7 @@ func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	case SexpChar:
 		ia = SexpInt(i)
 	default:
-		return SexpNull, WrongType
+		return BigIntegerDo(op, a, b)
 	}
 
 	switch i := b.(type) {
@@ -37,17 +39,26 @@ func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	case SexpChar:
 		ib = SexpInt(i)
 	default:
-		return SexpNull, WrongType
+		return BigIntegerDo(op, a, b)
 	}
 
 	switch op {
 	case ShiftLeft:
-		return ia << uint(ib), nil
+		if ib < 0 {
+			return SexpNull, errors.New("negative shift amount")
+		}
+		if ib < SexpInt(SexpIntSize) && (ia<<uint(ib))>>uint(ib) == ia {
+			return ia << uint(ib), nil
+		}
+		return BigIntegerDo(op, ia, ib)
 	case ShiftRightArith:
 		return ia >> uint(ib), nil
 	case ShiftRightLog:
 		return SexpInt(uint(ia) >> uint(ib)), nil
 	case Modulo:
+		if ib == 0 {
+			return SexpNull, DivideByZero
+		}
 		return ia % ib, nil
 	case BitAnd:
 		return ia & ib, nil
@@ -59,6 +70,60 @@ func IntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
 	return SexpNull, errors.New("unrecognized shift operation")
 }
 
+// BigIntegerDo is IntegerDo for operands that may be big integers.
+func BigIntegerDo(op IntegerOp, a, b Sexp) (Sexp, error) {
+	ia, ok := ToBigInt(a)
+	if !ok {
+		return SexpNull, typeError("integer", a)
+	}
+	ib, ok := ToBigInt(b)
+	if !ok {
+		return SexpNull, typeError("integer", b)
+	}
+
+	res := new(big.Int)
+	switch op {
+	case ShiftLeft, ShiftRightArith, ShiftRightLog:
+		if ib.Sign() < 0 {
+			return SexpNull, errors.New("negative shift amount")
+		}
+		if !ib.IsInt64() || ib.Int64() > maxShift {
+			return SexpNull, errors.New("shift amount too large")
+		}
+		shift := uint(ib.Int64())
+		switch op {
+		case ShiftLeft:
+			res.Lsh(ia, shift)
+		case ShiftRightArith:
+			res.Rsh(ia, shift)
+		case ShiftRightLog:
+			if ia.Sign() < 0 {
+				return SexpNull, errors.New(
+					"cannot do a logical shift of a negative big integer")
+			}
+			res.Rsh(ia, shift)
+		}
+	case Modulo:
+		if ib.Sign() == 0 {
+			return SexpNull, DivideByZero
+		}
+		res.Rem(ia, ib)
+	case BitAnd:
+		res.And(ia, ib)
+	case BitOr:
+		res.Or(ia, ib)
+	case BitXor:
+		res.Xor(ia, ib)
+	default:
+		return SexpNull, errors.New("unrecognized shift operation")
+	}
+	return MakeBigInt(res), nil
+}
+
+// the largest shift done on a big integer, to keep a typo from
+// allocating all of memory
+const maxShift = 1 << 20
+
 type NumericOp int
 
 const (
@@ -82,80 +147,146 @@ func NumericFloatDo(op NumericOp, a, b SexpFloat) Sexp {
 	return SexpNull
 }
 
-func NumericIntDo(op NumericOp, a, b SexpInt) Sexp {
+// NumericIntDo promotes the result to a big integer if it overflows, and
+// returns a ratio when dividing integers that don't divide evenly.
+func NumericIntDo(op NumericOp, a, b SexpInt) (Sexp, error) {
 	switch op {
 	case Add:
-		return a + b
+		if c, ok := addInt(a, b); ok {
+			return c, nil
+		}
 	case Sub:
-		return a - b
+		if c, ok := subInt(a, b); ok {
+			return c, nil
+		}
 	case Mult:
-		return a * b
+		if c, ok := mulInt(a, b); ok {
+			return c, nil
+		}
+	case Div:
+		if b == 0 {
+			return SexpNull, DivideByZero
+		}
+		if a%b == 0 && !(a == minInt && b == -1) {
+			return a / b, nil
+		}
+	}
+	return NumericRatDo(op, big.NewRat(int64(a), 1), big.NewRat(int64(b), 1))
+}
+
+// NumericRatDo does exact arithmetic on integers and ratios.
+func NumericRatDo(op NumericOp, a, b *big.Rat) (Sexp, error) {
+	res := new(big.Rat)
+	switch op {
+	case Add:
+		res.Add(a, b)
+	case Sub:
+		res.Sub(a, b)
+	case Mult:
+		res.Mul(a, b)
 	case Div:
-		if a%b == 0 {
-			return a / b
-		} else {
-			return SexpFloat(a) / SexpFloat(b)
+		if b.Sign() == 0 {
+			return SexpNull, DivideByZero
 		}
+		res.Quo(a, b)
 	}
-	return SexpNull
+	return MakeRatio(res), nil
 }
 
 func NumericMatchFloat(op NumericOp, a SexpFloat, b Sexp) (Sexp, error) {
-	var fb SexpFloat
-	switch tb := b.(type) {
-	case SexpFloat:
-		fb = tb
-	case SexpInt:
-		fb = SexpFloat(tb)
-	case SexpChar:
-		fb = SexpFloat(tb)
-	default:
-		return SexpNull, WrongType
+	fb, ok := ToFloat(b)
+	if !ok {
+		return SexpNull, typeError("number", b)
 	}
 	return NumericFloatDo(op, a, fb), nil
 }
 
-func NumericMatchInt(op NumericOp, a SexpInt, b Sexp) (Sexp, error) {
+func NumericMatchInt(op NumericOp, a SexpInt, b Sexp,
+	ctx DecimalContext) (Sexp, error) {
 	switch tb := b.(type) {
 	case SexpFloat:
 		return NumericFloatDo(op, SexpFloat(a), tb), nil
 	case SexpInt:
-		return NumericIntDo(op, a, tb), nil
+		return NumericIntDo(op, a, tb)
 	case SexpChar:
-		return NumericIntDo(op, a, SexpInt(tb)), nil
+		return NumericIntDo(op, a, SexpInt(tb))
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return NumericMatchExact(op, a, b, ctx)
 	}
-	return SexpNull, WrongType
+	return SexpNull, typeError("number", b)
 }
 
-func NumericMatchChar(op NumericOp, a SexpChar, b Sexp) (Sexp, error) {
+func NumericMatchChar(op NumericOp, a SexpChar, b Sexp,
+	ctx DecimalContext) (Sexp, error) {
 	var res Sexp
+	var err error
 	switch tb := b.(type) {
 	case SexpFloat:
 		res = NumericFloatDo(op, SexpFloat(a), tb)
 	case SexpInt:
-		res = NumericIntDo(op, SexpInt(a), tb)
+		res, err = NumericIntDo(op, SexpInt(a), tb)
 	case SexpChar:
-		res = NumericIntDo(op, SexpInt(a), SexpInt(tb))
+		res, err = NumericIntDo(op, SexpInt(a), SexpInt(tb))
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return NumericMatchExact(op, a, b, ctx)
 	default:
-		return SexpNull, WrongType
+		return SexpNull, typeError("number", b)
 	}
-	switch tres := res.(type) {
-	case SexpFloat:
-		return tres, nil
-	case SexpInt:
+	if err != nil {
+		return SexpNull, err
+	}
+	if tres, ok := res.(SexpInt); ok {
 		return SexpChar(tres), nil
 	}
-	return SexpNull, errors.New("unexpected result")
+	return res, nil
 }
 
+// NumericMatchExact handles operations where a is a big integer, ratio or
+// decimal, or b is while a is a smaller integer. Decimals mixed with
+// integers stay decimals, but mixed with ratios become ratios.
+func NumericMatchExact(op NumericOp, a Sexp, b Sexp,
+	ctx DecimalContext) (Sexp, error) {
+	if fb, ok := b.(SexpFloat); ok {
+		fa, _ := ToFloat(a)
+		return NumericFloatDo(op, fa, fb), nil
+	}
+	if IsDecimal(a) || IsDecimal(b) {
+		da, oka := toDecimal(a)
+		db, okb := toDecimal(b)
+		if oka && okb {
+			return NumericDecimalDo(op, da, db, ctx)
+		}
+	}
+	ra, ok := ToRat(a)
+	if !ok {
+		return SexpNull, typeError("number", a)
+	}
+	rb, ok := ToRat(b)
+	if !ok {
+		return SexpNull, typeError("number", b)
+	}
+	return NumericRatDo(op, ra, rb)
+}
+
+// NumericDo does arithmetic on any two numbers, keeping the products and
+// quotients of decimals exact.
 func NumericDo(op NumericOp, a, b Sexp) (Sexp, error) {
+	return NumericDoContext(op, a, b, ExactDecimals)
+}
+
+// NumericDoContext is like NumericDo, but rounds the products and
+// quotients of decimals as ctx says.
+func NumericDoContext(op NumericOp, a, b Sexp,
+	ctx DecimalContext) (Sexp, error) {
 	switch ta := a.(type) {
 	case SexpFloat:
 		return NumericMatchFloat(op, ta, b)
 	case SexpInt:
-		return NumericMatchInt(op, ta, b)
+		return NumericMatchInt(op, ta, b, ctx)
 	case SexpChar:
-		return NumericMatchChar(op, ta, b)
+		return NumericMatchChar(op, ta, b, ctx)
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return NumericMatchExact(op, a, b, ctx)
 	}
-	return SexpNull, WrongType
+	return SexpNull, typeError("number", a)
 }
@@ -0,0 +1,117 @@
+package glisp
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// Options controls what a new environment makes available to scripts.
+type Options struct {
+	// Builtins names the entries of BuiltinFunctions to install. A nil
+	// slice installs all of them.
+	Builtins []string
+	// SpecialForms names the special forms scripts may use. A nil slice
+	// allows all of them.
+	SpecialForms []string
+	// Imports install extension packages into the new environment, such
+	// as (*Glisp).ImportEval or glispext.ImportRegex.
+	Imports []func(*Glisp)
+	// FS, if set, confines include, source-file, require and the io
+	// extension to reading from it instead of the host file system.
+	// Paths that leave it, like ../x or absolute ones, can't be opened.
+	FS fs.FS
+	// PersistentLiterals makes [] and {} literals persistent vectors and
+	// maps instead of arrays and hashes.
+	PersistentLiterals bool
+	// ModulePath lists the directories require searches for modules,
+	// instead of the current directory.
+	ModulePath []string
+}
+
+// SpecialForms lists every special form understood by the generator.
+var SpecialForms = []string{
+	"and", "or", "cond", "quote", "def", "set!", "fn", "defn", "begin",
+	"let", "let*", "assert", "defmac", "macexpand", "syntax-quote",
+	"include", "try", "while", "for", "dotimes", "doseq", "break",
+	"continue", "with-output-to-string", "defstruct", "defprotocol",
+	"extend-type", "ns", "require", "def-", "defn-",
+}
+
+func NewGlispWithOptions(opts Options) (*Glisp, error) {
+	builtins := BuiltinFunctions
+	if opts.Builtins != nil {
+		builtins = make(map[string]GlispUserFunction)
+		for _, name := range opts.Builtins {
+			function, ok := BuiltinFunctions[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown builtin %q", name)
+			}
+			builtins[name] = function
+		}
+	}
+
+	var forms map[string]bool
+	if opts.SpecialForms != nil {
+		forms = make(map[string]bool)
+		for _, name := range opts.SpecialForms {
+			if !isSpecialForm(name) {
+				return nil, fmt.Errorf("unknown special form %q", name)
+			}
+			forms[name] = true
+		}
+	}
+
+	env := newGlisp(builtins)
+	env.forms = forms
+	env.fs = opts.FS
+	env.persistent = opts.PersistentLiterals
+	if opts.ModulePath != nil {
+		env.modulePath = opts.ModulePath
+	}
+
+	for _, importfn := range opts.Imports {
+		importfn(env)
+	}
+	return env, nil
+}
+
+func isSpecialForm(name string) bool {
+	for _, form := range SpecialForms {
+		if form == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsForm reports whether scripts in this environment may use the
+// named special form.
+func (env *Glisp) allowsForm(name string) bool {
+	return env.forms == nil || env.forms[name]
+}
+
+// SetPersistentLiterals chooses whether [] and {} literals read from now
+// on make persistent vectors and maps, or arrays and hashes. Syntax-quote
+// builds the same, and the vectors and maps it builds still compile as
+// literals when a macro expands to them or they are given to eval.
+func (env *Glisp) SetPersistentLiterals(on bool) {
+	env.persistent = on
+}
+
+// FileSystem returns the FS scripts are confined to, or nil if they use
+// the host file system.
+func (env *Glisp) FileSystem() fs.FS {
+	return env.fs
+}
+
+// OpenFile opens a file for include or source-file, through the
+// environment's FS if one was given.
+func (env *Glisp) OpenFile(name string) (io.ReadCloser, error) {
+	if env.fs == nil {
+		return os.Open(name)
+	}
+	return env.fs.Open(path.Clean(name))
+}
@@ -3,6 +3,7 @@ package glisp
 import (
 	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
 )
 
@@ -11,6 +12,12 @@ type Parser struct {
 	env   *Glisp
 }
 
+// NewParser returns a parser reading expressions from lexer, for use
+// with ParseExpression.
+func NewParser(env *Glisp, lexer *Lexer) *Parser {
+	return &Parser{lexer, env}
+}
+
 var UnexpectedEnd error = errors.New("Unexpected end of input")
 
 const SliceDefaultCap = 10
@@ -130,13 +137,31 @@ func ParseHash(parser *Parser) (Sexp, error) {
 		arr = append(arr, expr)
 	}
 
+	constructor := "hash"
+	if parser.env.persistent {
+		constructor = "hash-map"
+	}
+
 	var list SexpPair
-	list.head = parser.env.MakeSymbol("hash")
+	list.head = parser.env.MakeSymbol(constructor)
 	list.tail = MakeList(arr)
 
 	return list, nil
 }
 
+// withPosition records where a list or symbol was read
+func withPosition(expr Sexp, pos Position) Sexp {
+	switch e := expr.(type) {
+	case SexpPair:
+		e.pos = &pos
+		return e
+	case SexpSymbol:
+		e.pos = &pos
+		return e
+	}
+	return expr
+}
+
 func ParseExpression(parser *Parser) (Sexp, error) {
 	lexer := parser.lexer
 	env := parser.env
@@ -144,70 +169,69 @@ func ParseExpression(parser *Parser) (Sexp, error) {
 	if err != nil {
 		return SexpEnd, err
 	}
+	pos := lexer.LastPosition()
 
 	switch tok.typ {
 	case TokenLParen:
-		return ParseList(parser)
+		expr, err := ParseList(parser)
+		return withPosition(expr, pos), err
 	case TokenLSquare:
 		return ParseArray(parser)
 	case TokenLCurly:
-		return ParseHash(parser)
+		expr, err := ParseHash(parser)
+		return withPosition(expr, pos), err
 	case TokenQuote:
 		expr, err := ParseExpression(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("quote"), expr}), nil
+		return withPosition(MakeList(
+			[]Sexp{env.MakeSymbol("quote"), expr}), pos), nil
 	case TokenBacktick:
 		expr, err := ParseExpression(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("syntax-quote"), expr}), nil
+		return withPosition(MakeList(
+			[]Sexp{env.MakeSymbol("syntax-quote"), expr}), pos), nil
 	case TokenTilde:
 		expr, err := ParseExpression(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("unquote"), expr}), nil
+		return withPosition(MakeList(
+			[]Sexp{env.MakeSymbol("unquote"), expr}), pos), nil
 	case TokenTildeAt:
 		expr, err := ParseExpression(parser)
 		if err != nil {
 			return SexpNull, err
 		}
-		return MakeList([]Sexp{env.MakeSymbol("unquote-splicing"), expr}), nil
+		return withPosition(MakeList(
+			[]Sexp{env.MakeSymbol("unquote-splicing"), expr}), pos), nil
 	case TokenSymbol:
-		return env.MakeSymbol(tok.str), nil
+		return withPosition(env.MakeSymbol(tok.str), pos), nil
 	case TokenBool:
 		return SexpBool(tok.str == "true"), nil
 	case TokenDecimal:
-		i, err := strconv.ParseInt(tok.str, 10, SexpIntSize)
-		if err != nil {
-			return SexpNull, err
-		}
-		return SexpInt(i), nil
+		return parseInteger(tok.str, 10)
 	case TokenHex:
-		i, err := strconv.ParseInt(tok.str, 16, SexpIntSize)
-		if err != nil {
-			return SexpNull, err
-		}
-		return SexpInt(i), nil
+		return parseInteger(tok.str, 16)
 	case TokenOct:
-		i, err := strconv.ParseInt(tok.str, 8, SexpIntSize)
-		if err != nil {
-			return SexpNull, err
-		}
-		return SexpInt(i), nil
+		return parseInteger(tok.str, 8)
 	case TokenBinary:
-		i, err := strconv.ParseInt(tok.str, 2, SexpIntSize)
-		if err != nil {
-			return SexpNull, err
-		}
-		return SexpInt(i), nil
+		return parseInteger(tok.str, 2)
 	case TokenChar:
 		return SexpChar(tok.str[0]), nil
 	case TokenString:
 		return SexpStr(tok.str), nil
+	case TokenRatio:
+		r, ok := new(big.Rat).SetString(tok.str)
+		if !ok {
+			return SexpNull, fmt.Errorf("invalid ratio %s", tok.str)
+		}
+		return MakeRatio(r), nil
+	case TokenBigDecimal:
+		return ParseDecimal(tok.str)
 	case TokenFloat:
 		f, err := strconv.ParseFloat(tok.str, SexpFloatSize)
 		if err != nil {
@@ -220,6 +244,24 @@ func ParseExpression(parser *Parser) (Sexp, error) {
 	return SexpNull, errors.New(fmt.Sprint("Invalid syntax, didn't know what to do with ", tok.typ, " ", tok))
 }
 
+// parseInteger parses an integer literal, making it a big integer if it
+// is too large for SexpInt.
+func parseInteger(str string, base int) (Sexp, error) {
+	i, err := strconv.ParseInt(str, base, SexpIntSize)
+	if err == nil {
+		return SexpInt(i), nil
+	}
+	if numerr, ok := err.(*strconv.NumError); !ok ||
+		numerr.Err != strconv.ErrRange {
+		return SexpNull, err
+	}
+	bi, ok := new(big.Int).SetString(str, base)
+	if !ok {
+		return SexpNull, err
+	}
+	return MakeBigInt(bi), nil
+}
+
 func ParseTokens(env *Glisp, lexer *Lexer) ([]Sexp, error) {
 	expressions := make([]Sexp, 0, SliceDefaultCap)
 	parser := Parser{lexer, env}
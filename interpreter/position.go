@@ -0,0 +1,31 @@
+package glisp
+
+import (
+	"fmt"
+)
+
+// Position is a location in glisp source code.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (pos Position) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
+}
+
+// SexpPosition returns the position at which a list or symbol was read,
+// or nil if the expression did not come from the parser.
+func SexpPosition(expr Sexp) *Position {
+	switch e := expr.(type) {
+	case SexpPair:
+		return e.pos
+	case SexpSymbol:
+		return e.pos
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package glisp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultType names the type whose methods handle values of any type
+// the protocol was not extended to.
+const DefaultType = "default"
+
+// SexpProtocol is a named set of methods, declared with defprotocol and
+// implemented per type with extend-type or AddMethod.
+type SexpProtocol struct {
+	Name    string
+	Methods []string
+}
+
+func (p SexpProtocol) SexpString() string {
+	return "protocol " + p.Name
+}
+
+// DefineProtocol declares a protocol and binds it along with a generic
+// function for each method. A generic function calls the method for the
+// type of its first argument, as named by TypeName. Defining a protocol
+// again keeps the implementations of the methods it still has, and a
+// method can't belong to two protocols.
+func (env *Glisp) DefineProtocol(name string, methods ...string) error {
+	proto := SexpProtocol{Name: name, Methods: methods}
+	if err := env.protocols.define(proto); err != nil {
+		return err
+	}
+
+	err := env.scopestack.BindSymbol(env.MakeSymbol(name), proto)
+	if err != nil {
+		return err
+	}
+	for _, method := range methods {
+		method := method
+		generic := func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+			if len(args) < 1 {
+				return SexpNull, WrongNargs
+			}
+			fun, ok := env.protocols.lookup(method, args[0])
+			if !ok {
+				return SexpNull, fmt.Errorf("no method %s for type %s",
+					method, TypeName(args[0]))
+			}
+			return env.Apply(fun, args)
+		}
+		err = env.scopestack.BindSymbol(env.MakeSymbol(method),
+			MakeUserFunction(method, generic))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtendType implements a method of a protocol for the values whose
+// TypeName is typename, or for any value if typename is DefaultType.
+// Struct instances fall back to the methods for "hash".
+func (env *Glisp) ExtendType(typename string, method string,
+	fun SexpFunction) error {
+	return env.protocols.extend(typename, method, fun)
+}
+
+// AddMethod implements a method in Go, usually for a Sexp type defined
+// by the embedder, as in
+//
+//	env.AddMethod(glisp.TypeName(&SexpWidget{}), "draw", drawWidget)
+func (env *Glisp) AddMethod(typename string, method string,
+	function GlispUserFunction) error {
+	return env.ExtendType(typename, method,
+		MakeUserFunction(method, function))
+}
+
+// Satisfies reports whether expr has an implementation of every method
+// of the protocol.
+func (env *Glisp) Satisfies(proto SexpProtocol, expr Sexp) bool {
+	for _, method := range proto.Methods {
+		if _, ok := env.protocols.lookup(method, expr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func SatisfiesFunction(env *Glisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	proto, ok := args[0].(SexpProtocol)
+	if !ok {
+		return SexpNull, typeError("protocol", args[0])
+	}
+	return SexpBool(env.Satisfies(proto, args[1])), nil
+}
+
+// protocolTable holds the protocols defined in an environment and its
+// duplicates, and the methods implementing them for each type.
+type protocolTable struct {
+	mu      sync.RWMutex
+	owners  map[string]string // method name to protocol name
+	methods map[string]map[string]SexpFunction
+}
+
+func newProtocolTable() *protocolTable {
+	return &protocolTable{
+		owners:  make(map[string]string),
+		methods: make(map[string]map[string]SexpFunction),
+	}
+}
+
+// define records the methods of proto, failing if another protocol
+// already has one of them. The methods of an earlier definition of proto
+// keep their implementations, unless proto no longer has them.
+func (table *protocolTable) define(proto SexpProtocol) error {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	kept := make(map[string]bool)
+	for _, method := range proto.Methods {
+		owner, ok := table.owners[method]
+		if ok && owner != proto.Name {
+			return fmt.Errorf("%s is already a method of %s", method, owner)
+		}
+		kept[method] = true
+	}
+
+	for method, owner := range table.owners {
+		if owner == proto.Name && !kept[method] {
+			delete(table.owners, method)
+			delete(table.methods, method)
+		}
+	}
+	for _, method := range proto.Methods {
+		if _, ok := table.owners[method]; !ok {
+			table.owners[method] = proto.Name
+			table.methods[method] = make(map[string]SexpFunction)
+		}
+	}
+	return nil
+}
+
+func (table *protocolTable) extend(typename string, method string,
+	fun SexpFunction) error {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	impls, ok := table.methods[method]
+	if !ok {
+		return errors.New("no protocol has a method " + method)
+	}
+	impls[typename] = fun
+	return nil
+}
+
+// owner names the protocol that declared method.
+func (table *protocolTable) owner(method string) (string, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	name, ok := table.owners[method]
+	return name, ok
+}
+
+func (table *protocolTable) lookup(method string, expr Sexp) (SexpFunction, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	impls := table.methods[method]
+	typename := TypeName(expr)
+	if fun, ok := impls[typename]; ok {
+		return fun, true
+	}
+	if _, ok := expr.(SexpHash); ok && typename != "hash" {
+		if fun, ok := impls["hash"]; ok {
+			return fun, true
+		}
+	}
+	fun, ok := impls[DefaultType]
+	return fun, ok
+}
+
+// protocolMethod names a method of proto as the protocol does: in the
+// namespace the protocol was defined in, unless it is qualified already.
+func (env *Glisp) protocolMethod(proto SexpSymbol,
+	method SexpSymbol) (SexpSymbol, error) {
+	if _, _, qualified := SplitQualified(method.name); qualified {
+		resolved, _, err := env.resolveSymbol(method)
+		return resolved, err
+	}
+	prefix, _, ok := SplitQualified(proto.name)
+	if !ok {
+		return method, nil
+	}
+	return env.MakeSymbol(prefix + "/" + method.name), nil
+}
+
+// checkMethod makes sure a method named in an extend-type belongs to the
+// protocol it is listed under.
+func (env *Glisp) checkMethod(proto string, method string) error {
+	owner, ok := env.protocols.owner(method)
+	if !ok || owner != proto {
+		return fmt.Errorf("%s is not a method of %s", method, proto)
+	}
+	return nil
+}
@@ -3,12 +3,79 @@ package glisp
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 type Scope map[int]Sexp
 
 func (s Scope) IsStackElem() {}
 
+// sharedScope holds bindings that code running on several goroutines
+// may use at once (see the go macro), so all access to it is
+// synchronized. The top-level bindings of an environment, shared with its
+// duplicates, are one, and so are the variables captured by a closure,
+// shared by every call to it.
+type sharedScope struct {
+	mu   sync.RWMutex
+	vars Scope
+}
+
+func newSharedScope() *sharedScope {
+	return &sharedScope{vars: make(Scope)}
+}
+
+func (s *sharedScope) IsStackElem() {}
+
+func (s *sharedScope) lookup(sym SexpSymbol) (Sexp, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	expr, ok := s.vars[sym.number]
+	return expr, ok
+}
+
+func (s *sharedScope) bind(sym SexpSymbol, expr Sexp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vars[sym.number] = expr
+}
+
+// set rebinds sym only if it is already bound, reporting whether it was.
+func (s *sharedScope) set(sym SexpSymbol, expr Sexp) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vars[sym.number]; !ok {
+		return false
+	}
+	s.vars[sym.number] = expr
+	return true
+}
+
+func scopeLookup(elem StackElem, sym SexpSymbol) (Sexp, bool) {
+	switch scope := elem.(type) {
+	case Scope:
+		expr, ok := scope[sym.number]
+		return expr, ok
+	case *sharedScope:
+		return scope.lookup(sym)
+	}
+	return SexpNull, false
+}
+
+// scopeSet rebinds sym in elem only if it is already bound there,
+// reporting whether it was.
+func scopeSet(elem StackElem, sym SexpSymbol, expr Sexp) bool {
+	switch scope := elem.(type) {
+	case Scope:
+		if _, ok := scope[sym.number]; ok {
+			scope[sym.number] = expr
+			return true
+		}
+	case *sharedScope:
+		return scope.set(sym, expr)
+	}
+	return false
+}
+
 func (stack *Stack) PushScope() {
 	stack.Push(Scope(make(map[int]Sexp)))
 }
@@ -25,14 +92,13 @@ func (stack *Stack) lookupSymbol(sym SexpSymbol, minFrame int) (Sexp, error) {
 			if err != nil {
 				return SexpNull, err
 			}
-			scope := map[int]Sexp(elem.(Scope))
-			expr, ok := scope[sym.number]
+			expr, ok := scopeLookup(elem, sym)
 			if ok {
 				return expr, nil
 			}
 		}
 	}
-	return SexpNull, errors.New(fmt.Sprint("symbol ", sym, " not found"))
+	return SexpNull, UnboundSymbolError{sym.name}
 }
 
 func (stack *Stack) LookupSymbol(sym SexpSymbol) (Sexp, error) {
@@ -44,10 +110,34 @@ func (stack *Stack) LookupSymbolNonGlobal(sym SexpSymbol) (Sexp, error) {
 	return stack.lookupSymbol(sym, 1)
 }
 
+// SetSymbol updates the binding of sym in the innermost scope that
+// defines it, failing if no scope does.
+func (stack *Stack) SetSymbol(sym SexpSymbol, expr Sexp) error {
+	for i := stack.tos; i >= 0; i-- {
+		switch scope := stack.elements[i].(type) {
+		case Scope:
+			if _, ok := scope[sym.number]; ok {
+				scope[sym.number] = expr
+				return nil
+			}
+		case *sharedScope:
+			if scope.set(sym, expr) {
+				return nil
+			}
+		}
+	}
+	return errors.New(fmt.Sprint("symbol ", sym.name, " not bound"))
+}
+
 func (stack *Stack) BindSymbol(sym SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		return errors.New("no scope available")
 	}
-	stack.elements[stack.tos].(Scope)[sym.number] = expr
+	switch scope := stack.elements[stack.tos].(type) {
+	case Scope:
+		scope[sym.number] = expr
+	case *sharedScope:
+		scope.bind(sym, expr)
+	}
 	return nil
 }
@@ -0,0 +1,217 @@
+package glisp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// StructType is a record type declared with defstruct. Its instances are
+// hashes whose TypeName is the name of the type, holding exactly its
+// fields.
+type StructType struct {
+	Name   string
+	Fields []SexpSymbol
+	// Defaults holds a function of no arguments for each field, which
+	// the constructor calls for the field's value each time it isn't
+	// given one, or nil if the field is required.
+	Defaults []Sexp
+}
+
+// IsKeyword reports whether sym is a keyword like x:, which evaluates to
+// itself and names the field x in a struct constructor.
+func IsKeyword(sym SexpSymbol) bool {
+	return len(sym.name) > 1 && strings.HasSuffix(sym.name, ":")
+}
+
+func (st *StructType) fieldIndex(key Sexp) int {
+	sym, ok := key.(SexpSymbol)
+	if !ok {
+		return -1
+	}
+	for i, field := range st.Fields {
+		if field.number == sym.number {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasField reports whether key is the name of one of the fields.
+func (st *StructType) HasField(key Sexp) bool {
+	return st.fieldIndex(key) >= 0
+}
+
+// IsInstance reports whether expr was made by the constructor of st.
+func (st *StructType) IsInstance(expr Sexp) bool {
+	hash, ok := expr.(SexpHash)
+	return ok && hash.TypeName != nil && *hash.TypeName == st.Name
+}
+
+// Construct makes an instance from keyword arguments, as in
+// (Point x: 1 y: 2), filling in the defaults of fields not given.
+func (env *Glisp) Construct(st *StructType, args []Sexp) (SexpHash, error) {
+	if len(args)%2 != 0 {
+		return SexpHash{}, fmt.Errorf(
+			"%s requires keyword and value pairs", st.Name)
+	}
+	if err := env.CheckCollectionSize(len(st.Fields)); err != nil {
+		return SexpHash{}, err
+	}
+
+	vals := make([]Sexp, len(st.Fields))
+	for i := 0; i < len(args); i += 2 {
+		sym, ok := args[i].(SexpSymbol)
+		if !ok {
+			return SexpHash{}, typeError("keyword", args[i])
+		}
+		field := env.MakeSymbol(strings.TrimSuffix(sym.name, ":"))
+		idx := st.fieldIndex(field)
+		if idx < 0 {
+			return SexpHash{}, fmt.Errorf("%s has no field %s",
+				st.Name, field.name)
+		}
+		vals[idx] = args[i+1]
+	}
+
+	hash, err := MakeHash(nil, st.Name)
+	if err != nil {
+		return hash, err
+	}
+	for i, field := range st.Fields {
+		val := vals[i]
+		if val == nil {
+			var err error
+			if val, err = env.fieldDefault(st, i); err != nil {
+				return hash, err
+			}
+		}
+		if err := hash.HashSet(field, val); err != nil {
+			return hash, err
+		}
+	}
+	return hash, nil
+}
+
+// fieldDefault makes the default value of the field at index i.
+func (env *Glisp) fieldDefault(st *StructType, i int) (Sexp, error) {
+	switch fun := st.Defaults[i].(type) {
+	case nil:
+		return SexpNull, fmt.Errorf("%s requires field %s",
+			st.Name, st.Fields[i].name)
+	case SexpFunction:
+		return env.Apply(fun, nil)
+	}
+	return SexpNull, fmt.Errorf("default of %s field %s is not a function",
+		st.Name, st.Fields[i].name)
+}
+
+// DefineStruct registers st and binds its constructor, type predicate
+// and field accessors, named like Point, Point? and Point-x.
+func (env *Glisp) DefineStruct(st *StructType) error {
+	env.structs.set(st)
+
+	constructor := func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+		return env.Construct(st, args)
+	}
+	err := env.scopestack.BindSymbol(env.MakeSymbol(st.Name),
+		MakeUserFunction(st.Name, constructor))
+	if err != nil {
+		return err
+	}
+
+	predicate := func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+		if len(args) != 1 {
+			return SexpNull, WrongNargs
+		}
+		return SexpBool(st.IsInstance(args[0])), nil
+	}
+	err = env.scopestack.BindSymbol(env.MakeSymbol(st.Name+"?"),
+		MakeUserFunction(st.Name+"?", predicate))
+	if err != nil {
+		return err
+	}
+
+	for _, field := range st.Fields {
+		field := field
+		accessor := func(env *Glisp, name string, args []Sexp) (Sexp, error) {
+			if len(args) != 1 {
+				return SexpNull, WrongNargs
+			}
+			if !st.IsInstance(args[0]) {
+				return SexpNull, typeError(st.Name, args[0])
+			}
+			hash := args[0].(SexpHash)
+			return hash.HashGet(field)
+		}
+		accname := st.Name + "-" + field.name
+		err = env.scopestack.BindSymbol(env.MakeSymbol(accname),
+			MakeUserFunction(accname, accessor))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupStruct finds the struct type with the given name.
+func (env *Glisp) LookupStruct(name string) (*StructType, bool) {
+	return env.structs.get(name)
+}
+
+// checkStructKey makes sure that a key set in a hash is a field, if the
+// hash is a struct instance.
+func (env *Glisp) checkStructKey(hash SexpHash, key Sexp) error {
+	st, ok := env.structs.get(*hash.TypeName)
+	if ok && !st.HasField(key) {
+		return fmt.Errorf("%s has no field %s", st.Name, key.SexpString())
+	}
+	return nil
+}
+
+// asInstance returns expr, a hash made from entries of a struct instance
+// by hmerge, hfilter or hmap, as a plain hash if it no longer holds
+// exactly the fields of its type.
+func (env *Glisp) asInstance(expr Sexp) Sexp {
+	hash, ok := expr.(SexpHash)
+	if !ok {
+		return expr
+	}
+	st, ok := env.structs.get(*hash.TypeName)
+	if !ok {
+		return expr
+	}
+	valid := *hash.NumKeys == len(st.Fields)
+	for _, pair := range hash.Pairs() {
+		valid = valid && st.HasField(pair.head)
+	}
+	if !valid {
+		typename := "hash"
+		hash.TypeName = &typename
+	}
+	return hash
+}
+
+// structTable holds the struct types defined in an environment and its
+// duplicates.
+type structTable struct {
+	mu    sync.RWMutex
+	types map[string]*StructType
+}
+
+func newStructTable() *structTable {
+	return &structTable{types: make(map[string]*StructType)}
+}
+
+func (table *structTable) get(name string) (*StructType, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	st, ok := table.types[name]
+	return st, ok
+}
+
+func (table *structTable) set(st *StructType) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.types[st.Name] = st
+}
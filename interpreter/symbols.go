@@ -0,0 +1,87 @@
+package glisp
+
+import (
+	"strconv"
+	"sync"
+)
+
+// symbolTable interns symbol names. Like the global scope, it is shared
+// by an environment and all of its duplicates.
+type symbolTable struct {
+	mu      sync.RWMutex
+	numbers map[string]int
+	names   map[int]string
+	next    int
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		numbers: make(map[string]int),
+		names:   make(map[int]string),
+		next:    1,
+	}
+}
+
+func (table *symbolTable) intern(name string) SexpSymbol {
+	table.mu.RLock()
+	symnum, ok := table.numbers[name]
+	table.mu.RUnlock()
+	if ok {
+		return SexpSymbol{name: name, number: symnum}
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return table.internLocked(name)
+}
+
+func (table *symbolTable) internLocked(name string) SexpSymbol {
+	// another goroutine may have interned it since we checked
+	if symnum, ok := table.numbers[name]; ok {
+		return SexpSymbol{name: name, number: symnum}
+	}
+	symbol := SexpSymbol{name: name, number: table.next}
+	table.numbers[name] = symbol.number
+	table.names[symbol.number] = name
+	table.next++
+	return symbol
+}
+
+// gensym interns a new symbol named prefix followed by a number. Names
+// already in use, such as gensyms loaded from a compiled image, are
+// skipped, so the symbol is always a fresh one.
+func (table *symbolTable) gensym(prefix string) SexpSymbol {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for {
+		name := prefix + strconv.Itoa(table.next)
+		if _, ok := table.numbers[name]; !ok {
+			return table.internLocked(name)
+		}
+		table.next++
+	}
+}
+
+// macroTable holds the macros defined in an environment and its
+// duplicates.
+type macroTable struct {
+	mu     sync.RWMutex
+	macros map[int]SexpFunction
+}
+
+func newMacroTable() *macroTable {
+	return &macroTable{macros: make(map[int]SexpFunction)}
+}
+
+func (table *macroTable) get(sym SexpSymbol) (SexpFunction, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	macro, ok := table.macros[sym.number]
+	return macro, ok
+}
+
+func (table *macroTable) set(sym SexpSymbol, macro SexpFunction) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.macros[sym.number] = macro
+}
@@ -1,5 +1,10 @@
 package glisp
 
+import (
+	"fmt"
+	"strings"
+)
+
 func IsArray(expr Sexp) bool {
 	switch expr.(type) {
 	case SexpArray:
@@ -29,7 +34,23 @@ func IsFloat(expr Sexp) bool {
 
 func IsInt(expr Sexp) bool {
 	switch expr.(type) {
-	case SexpInt:
+	case SexpInt, SexpBigInt:
+		return true
+	}
+	return false
+}
+
+func IsRatio(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpRatio:
+		return true
+	}
+	return false
+}
+
+func IsDecimal(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpDecimal:
 		return true
 	}
 	return false
@@ -59,6 +80,8 @@ func IsNumber(expr Sexp) bool {
 		return true
 	case SexpChar:
 		return true
+	case SexpBigInt, SexpRatio, SexpDecimal:
+		return true
 	}
 	return false
 }
@@ -79,6 +102,30 @@ func IsHash(expr Sexp) bool {
 	return false
 }
 
+func IsVector(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpVector:
+		return true
+	}
+	return false
+}
+
+func IsMap(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpMap:
+		return true
+	}
+	return false
+}
+
+func IsError(expr Sexp) bool {
+	switch expr.(type) {
+	case SexpError:
+		return true
+	}
+	return false
+}
+
 func IsZero(expr Sexp) bool {
 	switch e := expr.(type) {
 	case SexpInt:
@@ -87,6 +134,8 @@ func IsZero(expr Sexp) bool {
 		return int(e) == 0
 	case SexpFloat:
 		return float64(e) == 0.0
+	case SexpDecimal:
+		return e.unscaled.Sign() == 0
 	}
 	return false
 }
@@ -101,7 +150,57 @@ func IsEmpty(expr Sexp) bool {
 		return len(e) == 0
 	case SexpHash:
 		return HashIsEmpty(e)
+	case SexpVector:
+		return e.Len() == 0
+	case SexpMap:
+		return e.Len() == 0
 	}
 
 	return false
 }
+
+// TypeName names the type of expr for error messages. Struct instances
+// are named after their struct type, and types defined elsewhere after
+// their Go type, without the Sexp prefix.
+func TypeName(expr Sexp) string {
+	switch e := expr.(type) {
+	case SexpSentinel:
+		if e == SexpNull {
+			return "null"
+		}
+		return "sentinel"
+	case SexpPair:
+		return "list"
+	case SexpArray:
+		return "array"
+	case SexpHash:
+		return typeTag(e)
+	case SexpVector:
+		return "vector"
+	case SexpMap:
+		return "map"
+	case SexpInt, SexpBigInt:
+		return "int"
+	case SexpRatio:
+		return "ratio"
+	case SexpDecimal:
+		return "decimal"
+	case SexpFloat:
+		return "float"
+	case SexpChar:
+		return "char"
+	case SexpStr:
+		return "string"
+	case SexpSymbol:
+		return "symbol"
+	case SexpBool:
+		return "bool"
+	case SexpFunction:
+		return "function"
+	case SexpError:
+		return "error"
+	}
+	name := fmt.Sprintf("%T", expr)
+	name = name[strings.LastIndex(name, ".")+1:]
+	return strings.ToLower(strings.TrimPrefix(name, "Sexp"))
+}
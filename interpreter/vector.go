@@ -0,0 +1,164 @@
+package glisp
+
+// SexpVector is a persistent vector. Changing one makes a new vector
+// which shares all but the changed path with the old one, so vectors can
+// be handed between goroutines without copying or locking.
+//
+// Elements live in a tree of 32-way nodes, with the last (up to) 32
+// elements kept in a separate tail so appending is cheap.
+type SexpVector struct {
+	count int
+	shift uint
+	root  *vecNode
+	tail  []Sexp
+}
+
+const (
+	vecBits  = 5
+	vecWidth = 1 << vecBits
+	vecMask  = vecWidth - 1
+)
+
+// vecNode is a branch, with children in kids, or a leaf with vecWidth
+// elements in vals. Nodes are never changed once they are in a vector.
+type vecNode struct {
+	kids []*vecNode
+	vals []Sexp
+}
+
+var emptyVecNode = &vecNode{}
+
+// MakeVector makes a vector holding the given elements.
+func MakeVector(items []Sexp) SexpVector {
+	vec := SexpVector{shift: vecBits, root: emptyVecNode}
+	for _, item := range items {
+		vec = vec.Conj(item)
+	}
+	return vec
+}
+
+func (vec SexpVector) Len() int {
+	return vec.count
+}
+
+func (vec SexpVector) tailOffset() int {
+	if vec.count < vecWidth {
+		return 0
+	}
+	return ((vec.count - 1) >> vecBits) << vecBits
+}
+
+// leafFor returns the leaf, or the tail, holding element i.
+func (vec SexpVector) leafFor(i int) []Sexp {
+	if i >= vec.tailOffset() {
+		return vec.tail
+	}
+	node := vec.root
+	for level := vec.shift; level > 0; level -= vecBits {
+		node = node.kids[(i>>level)&vecMask]
+	}
+	return node.vals
+}
+
+// Nth returns element i, which must be in range.
+func (vec SexpVector) Nth(i int) Sexp {
+	return vec.leafFor(i)[i&vecMask]
+}
+
+// Conj returns a vector with item appended.
+func (vec SexpVector) Conj(item Sexp) SexpVector {
+	if vec.root == nil {
+		vec = SexpVector{shift: vecBits, root: emptyVecNode}
+	}
+
+	if vec.count-vec.tailOffset() < vecWidth {
+		tail := make([]Sexp, len(vec.tail)+1)
+		copy(tail, vec.tail)
+		tail[len(vec.tail)] = item
+		vec.tail = tail
+		vec.count++
+		return vec
+	}
+
+	// the tail is full, so it moves into the tree
+	leaf := &vecNode{vals: vec.tail}
+	if (vec.count >> vecBits) > (1 << vec.shift) {
+		vec.root = &vecNode{kids: []*vecNode{
+			vec.root, newVecPath(vec.shift, leaf)}}
+		vec.shift += vecBits
+	} else {
+		vec.root = vec.pushLeaf(vec.shift, vec.root, leaf)
+	}
+	vec.tail = []Sexp{item}
+	vec.count++
+	return vec
+}
+
+func newVecPath(level uint, node *vecNode) *vecNode {
+	if level == 0 {
+		return node
+	}
+	return &vecNode{kids: []*vecNode{newVecPath(level-vecBits, node)}}
+}
+
+func (vec SexpVector) pushLeaf(level uint, parent, leaf *vecNode) *vecNode {
+	sub := ((vec.count - 1) >> level) & vecMask
+	node := &vecNode{kids: make([]*vecNode, len(parent.kids), sub+1)}
+	copy(node.kids, parent.kids)
+
+	child := leaf
+	if level > vecBits {
+		if sub < len(parent.kids) {
+			child = vec.pushLeaf(level-vecBits, parent.kids[sub], leaf)
+		} else {
+			child = newVecPath(level-vecBits, leaf)
+		}
+	}
+	if sub < len(node.kids) {
+		node.kids[sub] = child
+	} else {
+		node.kids = append(node.kids, child)
+	}
+	return node
+}
+
+// Assoc returns a vector with element i replaced by item. i must be in
+// range.
+func (vec SexpVector) Assoc(i int, item Sexp) SexpVector {
+	if i >= vec.tailOffset() {
+		tail := make([]Sexp, len(vec.tail))
+		copy(tail, vec.tail)
+		tail[i&vecMask] = item
+		vec.tail = tail
+		return vec
+	}
+	vec.root = assocVecNode(vec.shift, vec.root, i, item)
+	return vec
+}
+
+func assocVecNode(level uint, node *vecNode, i int, item Sexp) *vecNode {
+	if level == 0 {
+		vals := make([]Sexp, len(node.vals))
+		copy(vals, node.vals)
+		vals[i&vecMask] = item
+		return &vecNode{vals: vals}
+	}
+	kids := make([]*vecNode, len(node.kids))
+	copy(kids, node.kids)
+	sub := (i >> level) & vecMask
+	kids[sub] = assocVecNode(level-vecBits, kids[sub], i, item)
+	return &vecNode{kids: kids}
+}
+
+// Slice copies the elements of the vector into a new slice.
+func (vec SexpVector) Slice() []Sexp {
+	items := make([]Sexp, 0, vec.count)
+	for i := 0; i < vec.count; i += vecWidth {
+		items = append(items, vec.leafFor(i)...)
+	}
+	return items
+}
+
+func (vec SexpVector) SexpString() string {
+	return SexpArray(vec.Slice()).SexpString()
+}
@@ -1,6 +1,7 @@
 package glisp
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 )
@@ -84,7 +85,8 @@ func (p PushInstrClosure) Execute(env *Glisp) error {
 	if p.expr.fun != nil {
 		p.expr.closeScope = NewStack(ScopeStackSize)
 
-		p.expr.closeScope.PushScope()
+		// calls to the closure on other goroutines share its variables
+		p.expr.closeScope.Push(newSharedScope())
 
 		var sym SexpSymbol
 		var exp Sexp
@@ -96,6 +98,8 @@ func (p PushInstrClosure) Execute(env *Glisp) error {
 				sym = it.sym
 			case PutInstr:
 				sym = it.sym
+			case SetInstr:
+				sym = it.sym
 			case CallInstr:
 				sym = it.sym
 			default:
@@ -158,8 +162,11 @@ func (d DupInstr) Execute(env *Glisp) error {
 	return nil
 }
 
+// GetInstr pushes the value of sym. In a namespace, qualified is the
+// namespace's definition of sym, used when there is no local binding.
 type GetInstr struct {
-	sym SexpSymbol
+	sym       SexpSymbol
+	qualified SexpSymbol
 }
 
 func (g GetInstr) InstrString() string {
@@ -167,9 +174,14 @@ func (g GetInstr) InstrString() string {
 }
 
 func (g GetInstr) Execute(env *Glisp) error {
+	if expr, ok := env.lookupNamespaced(g.sym, g.qualified); ok {
+		env.datastack.PushExpr(expr)
+		env.pc++
+		return nil
+	}
 	expr, err := env.scopestack.LookupSymbol(g.sym)
 	if err != nil {
-		return err
+		return env.positionError(err)
 	}
 	env.datastack.PushExpr(expr)
 	env.pc++
@@ -193,9 +205,41 @@ func (p PutInstr) Execute(env *Glisp) error {
 	return env.scopestack.BindSymbol(p.sym, expr)
 }
 
+type SetInstr struct {
+	sym       SexpSymbol
+	qualified SexpSymbol
+}
+
+func (s SetInstr) InstrString() string {
+	return fmt.Sprintf("set %s", s.sym.name)
+}
+
+func (s SetInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	if s.qualified.number != 0 {
+		// the definition is global, and a local may shadow its name
+		_, err := env.scopestack.LookupSymbolNonGlobal(s.sym)
+		if err != nil &&
+			scopeSet(env.scopestack.elements[0], s.qualified, expr) {
+			env.pc++
+			return nil
+		}
+	}
+	err = env.scopestack.SetSymbol(s.sym, expr)
+	if err != nil {
+		return env.positionError(err)
+	}
+	env.pc++
+	return nil
+}
+
 type CallInstr struct {
-	sym   SexpSymbol
-	nargs int
+	sym       SexpSymbol
+	qualified SexpSymbol
+	nargs     int
 }
 
 func (c CallInstr) InstrString() string {
@@ -203,14 +247,26 @@ func (c CallInstr) InstrString() string {
 }
 
 func (c CallInstr) Execute(env *Glisp) error {
-	f, ok := env.builtins[c.sym.number]
-	if ok {
-		return env.CallUserFunction(f, c.sym.name, c.nargs)
+	// locals come first, then the namespace's own definitions, then
+	// the builtins and last the globals, in and out of a namespace
+	var funcobj Sexp
+	var ok bool
+	if c.qualified.number != 0 {
+		funcobj, ok = env.lookupNamespaced(c.sym, c.qualified)
+	} else if expr, err := env.scopestack.LookupSymbolNonGlobal(c.sym); err == nil {
+		funcobj, ok = expr, true
 	}
+	if !ok {
+		f, ok := env.builtins[c.sym.number]
+		if ok {
+			return env.CallUserFunction(f, c.sym.name, c.nargs)
+		}
 
-	funcobj, err := env.scopestack.LookupSymbol(c.sym)
-	if err != nil {
-		return err
+		var err error
+		funcobj, err = env.scopestack.LookupSymbol(c.sym)
+		if err != nil {
+			return env.positionError(err)
+		}
 	}
 	switch f := funcobj.(type) {
 	case SexpFunction:
@@ -264,6 +320,327 @@ func (r ReturnInstr) InstrString() string {
 	return "ret \"" + r.err.Error() + "\""
 }
 
+type TryInstr struct {
+	location int
+	raw      bool
+}
+
+func (t TryInstr) InstrString() string {
+	return fmt.Sprintf("try %d", t.location)
+}
+
+func (t TryInstr) Execute(env *Glisp) error {
+	newpc := env.pc + t.location
+	if newpc < 0 || newpc > env.CurrentFunctionSize() {
+		return OutOfBounds
+	}
+	env.trystack.PushHandler(Handler{
+		function:   env.curfunc,
+		position:   newpc,
+		raw:        t.raw,
+		scopestack: env.scopestack,
+		scopetop:   env.scopestack.tos,
+		datatop:    env.datastack.tos,
+		addrtop:    env.addrstack.tos,
+		stacktop:   env.stackstack.tos,
+		capturetop: len(env.captures),
+	})
+	env.pc++
+	return nil
+}
+
+type EndTryInstr int
+
+func (e EndTryInstr) InstrString() string {
+	return "end try"
+}
+
+func (e EndTryInstr) Execute(env *Glisp) error {
+	_, err := env.trystack.PopHandler()
+	env.pc++
+	return err
+}
+
+type RethrowInstr int
+
+func (r RethrowInstr) InstrString() string {
+	return "rethrow"
+}
+
+func (r RethrowInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	switch t := expr.(type) {
+	case pendingError:
+		return t.err
+	}
+	return UserError{Data: expr}
+}
+
+// pops values off the data stack down to the most recent stackmark,
+// which is left in place
+type PopStackmarkInstr struct {
+	sym SexpSymbol
+}
+
+func (p PopStackmarkInstr) InstrString() string {
+	return fmt.Sprintf("pop to stackmark %s", p.sym.name)
+}
+
+func (p PopStackmarkInstr) Execute(env *Glisp) error {
+	for {
+		expr, err := env.datastack.GetExpr(0)
+		if err != nil {
+			return err
+		}
+		if _, ok := expr.(SexpStackmark); ok {
+			break
+		}
+		env.datastack.PopExpr()
+	}
+	env.pc++
+	return nil
+}
+
+// placeholder for break and continue, replaced by a jump once the
+// enclosing loop has been generated
+type loopJumpInstr struct {
+	loop *Loop
+	brk  bool
+}
+
+func (l loopJumpInstr) InstrString() string {
+	if l.brk {
+		return "break"
+	}
+	return "continue"
+}
+
+func (l loopJumpInstr) Execute(env *Glisp) error {
+	return errors.New("unresolved " + l.InstrString())
+}
+
+// replaces the list, array or hash at the top of the stack with an
+// array of its elements, hash entries becoming [key value] arrays
+type SequenceInstr int
+
+func (s SequenceInstr) InstrString() string {
+	return "seq"
+}
+
+func (s SequenceInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	var arr SexpArray
+	switch t := expr.(type) {
+	case SexpArray:
+		arr = t
+	case SexpVector:
+		arr = t.Slice()
+	case SexpMap:
+		for _, pair := range t.Pairs() {
+			arr = append(arr, MakeVector([]Sexp{pair.head, pair.tail}))
+		}
+	case SexpHash:
+		for _, pair := range t.Pairs() {
+			arr = append(arr, SexpArray{pair.head, pair.tail})
+		}
+	default:
+		arr, err = ListToArray(expr)
+		if err != nil {
+			return errors.New("cannot iterate over " + expr.SexpString())
+		}
+	}
+
+	env.datastack.PushExpr(arr)
+	env.pc++
+	return nil
+}
+
+// replaces the two values at the top of the stack with whether the
+// lower one is less than the upper one
+type LessInstr int
+
+func (l LessInstr) InstrString() string {
+	return "less"
+}
+
+func (l LessInstr) Execute(env *Glisp) error {
+	b, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	a, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	res, err := Compare(a, b)
+	if err != nil {
+		return err
+	}
+	env.datastack.PushExpr(SexpBool(res < 0))
+	env.pc++
+	return nil
+}
+
+// adds one to the number at the top of the stack
+type IncrementInstr int
+
+func (i IncrementInstr) InstrString() string {
+	return "incr"
+}
+
+func (i IncrementInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	expr, err = NumericDoContext(Add, expr, SexpInt(1), env.decimals)
+	if err != nil {
+		return err
+	}
+	env.datastack.PushExpr(expr)
+	env.pc++
+	return nil
+}
+
+// replaces the array at the top of the stack with its length
+type LenInstr int
+
+func (l LenInstr) InstrString() string {
+	return "len"
+}
+
+func (l LenInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	arr, ok := expr.(SexpArray)
+	if !ok {
+		return typeError("array", expr)
+	}
+	env.datastack.PushExpr(SexpInt(len(arr)))
+	env.pc++
+	return nil
+}
+
+// replaces an array and an index at the top of the stack with the
+// element of the array at that index
+type IndexInstr int
+
+func (i IndexInstr) InstrString() string {
+	return "index"
+}
+
+func (i IndexInstr) Execute(env *Glisp) error {
+	idx, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+
+	arr, ok := expr.(SexpArray)
+	if !ok {
+		return typeError("array", expr)
+	}
+	n, ok := idx.(SexpInt)
+	if !ok {
+		return typeError("integer", idx)
+	}
+	if n < 0 || int(n) >= len(arr) {
+		return OutOfBounds
+	}
+	env.datastack.PushExpr(arr[n])
+	env.pc++
+	return nil
+}
+
+// starts capturing everything printed into a buffer of its own
+type BeginCaptureInstr int
+
+func (b BeginCaptureInstr) InstrString() string {
+	return "begin capture"
+}
+
+func (b BeginCaptureInstr) Execute(env *Glisp) error {
+	buf := new(bytes.Buffer)
+	env.captures = append(env.captures, capture{env.stdout, buf})
+	env.stdout = buf
+	env.pc++
+	return nil
+}
+
+// stops the innermost capture and replaces the value at the top of the
+// stack with everything printed since it began, as a string
+type EndCaptureInstr int
+
+func (e EndCaptureInstr) InstrString() string {
+	return "end capture"
+}
+
+func (e EndCaptureInstr) Execute(env *Glisp) error {
+	if len(env.captures) == 0 {
+		return internalError(ErrStackUnderflow)
+	}
+	buf := env.captures[len(env.captures)-1].buf
+	env.restoreOutput(len(env.captures) - 1)
+
+	_, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	if err := env.CheckCollectionSize(buf.Len()); err != nil {
+		return err
+	}
+	env.datastack.PushExpr(SexpStr(buf.String()))
+	env.pc++
+	return nil
+}
+
+// stops the innermost capture, dropping what it captured, for break
+// and continue leaving it
+type DropCaptureInstr int
+
+func (d DropCaptureInstr) InstrString() string {
+	return "drop capture"
+}
+
+func (d DropCaptureInstr) Execute(env *Glisp) error {
+	if len(env.captures) == 0 {
+		return internalError(ErrStackUnderflow)
+	}
+	env.restoreOutput(len(env.captures) - 1)
+	env.pc++
+	return nil
+}
+
+// pushes a fresh symbol starting with prefix
+type GensymInstr struct {
+	prefix string
+}
+
+func (g GensymInstr) InstrString() string {
+	return "gensym " + g.prefix
+}
+
+func (g GensymInstr) Execute(env *Glisp) error {
+	env.datastack.PushExpr(env.GenSymbol(g.prefix))
+	env.pc++
+	return nil
+}
+
 type AddScopeInstr int
 
 func (a AddScopeInstr) InstrString() string {
@@ -299,9 +676,14 @@ func (e ExplodeInstr) Execute(env *Glisp) error {
 		return err
 	}
 
-	arr, err := ListToArray(expr)
-	if err != nil {
-		return err
+	var arr []Sexp
+	if vec, ok := expr.(SexpVector); ok {
+		arr = vec.Slice()
+	} else {
+		arr, err = ListToArray(expr)
+		if err != nil {
+			return err
+		}
 	}
 
 	for _, val := range arr {
@@ -397,6 +779,65 @@ func (s VectorizeInstr) Execute(env *Glisp) error {
 	return nil
 }
 
+// PersistInstr replaces the array on top of the stack with a persistent
+// vector of its items or, if Map is set, a map of its alternating keys
+// and values. Syntax-quote uses it when literals are persistent.
+type PersistInstr struct {
+	Map bool
+}
+
+func (p PersistInstr) InstrString() string {
+	if p.Map {
+		return "persist map"
+	}
+	return "persist vector"
+}
+
+func (p PersistInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	arr, ok := expr.(SexpArray)
+	if !ok {
+		return fmt.Errorf("persist expects an array, got %s", expr.SexpString())
+	}
+	if p.Map {
+		m, err := MakeMap(arr)
+		if err != nil {
+			return err
+		}
+		expr = m
+	} else {
+		expr = MakeVector(arr)
+	}
+	env.datastack.PushExpr(expr)
+	env.pc++
+	return nil
+}
+
+// QuoteSymbolInstr pushes a symbol from a syntax-quote compiled in the
+// namespace ns, qualified if it names one of the namespace's definitions
+// by the time it runs.
+type QuoteSymbolInstr struct {
+	sym SexpSymbol
+	ns  string
+}
+
+func (q QuoteSymbolInstr) InstrString() string {
+	return "quote " + q.sym.name
+}
+
+func (q QuoteSymbolInstr) Execute(env *Glisp) error {
+	sym := q.sym
+	if ns, ok := env.namespaces.get(q.ns); ok {
+		sym = env.qualifyQuoted(ns, sym)
+	}
+	env.datastack.PushExpr(sym)
+	env.pc++
+	return nil
+}
+
 type HashizeInstr struct {
 	HashLen  int
 	TypeName string
@@ -427,3 +868,101 @@ func (s HashizeInstr) Execute(env *Glisp) error {
 	env.pc++
 	return nil
 }
+
+// DefstructInstr defines a struct type, popping the functions making the
+// default values of the fields that have one.
+type DefstructInstr struct {
+	name     SexpSymbol
+	fields   []SexpSymbol
+	defaults []bool
+}
+
+func (d DefstructInstr) InstrString() string {
+	return fmt.Sprintf("defstruct %s", d.name.name)
+}
+
+func (d DefstructInstr) Execute(env *Glisp) error {
+	st := &StructType{
+		Name:     d.name.name,
+		Fields:   d.fields,
+		Defaults: make([]Sexp, len(d.fields)),
+	}
+	for i := len(d.fields) - 1; i >= 0; i-- {
+		if !d.defaults[i] {
+			continue
+		}
+		expr, err := env.datastack.PopExpr()
+		if err != nil {
+			return err
+		}
+		st.Defaults[i] = expr
+	}
+	env.pc++
+	return env.DefineStruct(st)
+}
+
+type DefprotocolInstr struct {
+	name    SexpSymbol
+	methods []SexpSymbol
+}
+
+func (d DefprotocolInstr) InstrString() string {
+	return fmt.Sprintf("defprotocol %s", d.name.name)
+}
+
+func (d DefprotocolInstr) Execute(env *Glisp) error {
+	methods := make([]string, len(d.methods))
+	for i, method := range d.methods {
+		methods[i] = method.name
+	}
+	env.pc++
+	return env.DefineProtocol(d.name.name, methods...)
+}
+
+// ExtendTypeInstr pops a function and makes it the method of a protocol
+// for a type.
+type ExtendTypeInstr struct {
+	typename SexpSymbol
+	protocol SexpSymbol
+	method   SexpSymbol
+}
+
+func (e ExtendTypeInstr) InstrString() string {
+	return fmt.Sprintf("extend %s %s %s", e.typename.name,
+		e.protocol.name, e.method.name)
+}
+
+func (e ExtendTypeInstr) Execute(env *Glisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	fun, ok := expr.(SexpFunction)
+	if !ok {
+		return typeError("function", expr)
+	}
+	err = env.checkMethod(e.protocol.name, e.method.name)
+	if err != nil {
+		return env.positionError(err)
+	}
+	env.pc++
+	return env.ExtendType(e.typename.name, e.method.name, fun)
+}
+
+// RequireInstr loads a module, unless it has been loaded already.
+type RequireInstr struct {
+	module SexpSymbol
+}
+
+func (r RequireInstr) InstrString() string {
+	return fmt.Sprintf("require %s", r.module.name)
+}
+
+func (r RequireInstr) Execute(env *Glisp) error {
+	err := env.Require(r.module.name)
+	if err != nil {
+		return env.positionError(err)
+	}
+	env.pc++
+	return nil
+}
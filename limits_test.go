@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+func runLimited(t *testing.T, limits glisp.Limits, src string) error {
+	t.Helper()
+	env := newEnvironment()
+	env.SetLimits(limits)
+	env.SetStdin(strings.NewReader(strings.Repeat("x", 100)))
+	if err := env.LoadString(src); err != nil {
+		t.Fatal(err)
+	}
+	_, err := env.Run()
+	return err
+}
+
+func TestLimits(t *testing.T) {
+	loop := `(while true 1)`
+	deep := `(defn deep [n] (+ 1 (deep n))) (deep 0)`
+	cases := []struct {
+		name   string
+		limits glisp.Limits
+		src    string
+		kind   glisp.LimitKind
+	}{
+		{"instructions", glisp.Limits{MaxInstructions: 1000}, loop,
+			glisp.InstructionLimit},
+		{"time", glisp.Limits{MaxDuration: 10 * time.Millisecond}, loop,
+			glisp.TimeLimit},
+		{"stack depth", glisp.Limits{MaxStackDepth: 100}, deep,
+			glisp.StackLimit},
+		{"call depth", glisp.Limits{MaxCallDepth: 50}, deep,
+			glisp.CallDepthLimit},
+		{"array", glisp.Limits{MaxCollectionSize: 10}, `(make-array 11)`,
+			glisp.CollectionLimit},
+		{"list", glisp.Limits{MaxCollectionSize: 3}, `(list 1 2 3 4)`,
+			glisp.CollectionLimit},
+		{"list concat", glisp.Limits{MaxCollectionSize: 3},
+			`(concat '(1 2) '(3 4))`, glisp.CollectionLimit},
+		{"hash", glisp.Limits{MaxCollectionSize: 1},
+			`(def h {'a 1}) (hset! h 'b 2)`, glisp.CollectionLimit},
+		{"read-all", glisp.Limits{MaxCollectionSize: 10}, `(read-all)`,
+			glisp.CollectionLimit},
+		{"repeat", glisp.Limits{MaxCollectionSize: 100},
+			`(repeat "ab" 100000)`, glisp.CollectionLimit},
+		{"pad-left", glisp.Limits{MaxCollectionSize: 100},
+			`(pad-left "x" 100000)`, glisp.CollectionLimit},
+		{"pad-right", glisp.Limits{MaxCollectionSize: 100},
+			`(pad-right "x" 101 "-")`, glisp.CollectionLimit},
+		{"join", glisp.Limits{MaxCollectionSize: 100},
+			`(join (make-array 20 "abcdef") ", ")`, glisp.CollectionLimit},
+		{"replace", glisp.Limits{MaxCollectionSize: 100},
+			`(replace (repeat "a" 50) "a" "bcd")`, glisp.CollectionLimit},
+		{"format", glisp.Limits{MaxCollectionSize: 100},
+			`(format "%200d" 1)`, glisp.CollectionLimit},
+		{"str", glisp.Limits{MaxCollectionSize: 100},
+			`(str (make-array 50 1234567))`, glisp.CollectionLimit},
+		{"string concat", glisp.Limits{MaxCollectionSize: 100},
+			`(concat (repeat "a" 60) (repeat "b" 60))`, glisp.CollectionLimit},
+		{"array concat", glisp.Limits{MaxCollectionSize: 100},
+			`(concat (make-array 60) (make-array 60))`, glisp.CollectionLimit},
+		{"captured output", glisp.Limits{MaxCollectionSize: 100},
+			`(with-output-to-string (dotimes [i 101] (print "x")))`,
+			glisp.CollectionLimit},
+		{"map", glisp.Limits{MaxCollectionSize: 1},
+			`(assoc (hash-map 'a 1) 'b 2)`, glisp.CollectionLimit},
+		{"builder", glisp.Limits{MaxCollectionSize: 100}, `
+			(def b (make-builder))
+			(dotimes [i 10000] (builder-append! b "x"))`,
+			glisp.CollectionLimit},
+		{"caught", glisp.Limits{MaxInstructions: 1000},
+			`(try (while true 1) (catch e 'caught))`,
+			glisp.InstructionLimit},
+		{"finally", glisp.Limits{MaxCollectionSize: 3},
+			`(try (list 1 2 3 4) (finally 'done))`, glisp.CollectionLimit},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := runLimited(t, c.limits, c.src)
+			var lerr glisp.LimitError
+			if !errors.As(err, &lerr) || lerr.Kind != c.kind {
+				t.Errorf("got %v, want a %s limit error", err, c.kind)
+			}
+		})
+	}
+}
+
+func TestWithinLimits(t *testing.T) {
+	limits := glisp.Limits{
+		MaxInstructions:   10000,
+		MaxDuration:       time.Second,
+		MaxStackDepth:     100,
+		MaxCallDepth:      50,
+		MaxCollectionSize: 100,
+	}
+	err := runLimited(t, limits, `
+		(defn count-down [n] (cond (= n 0) 0 (+ 1 (count-down (- n 1)))))
+		(count-down 20)
+		(make-array 100)
+		(read-all)
+		(repeat "ab" 50)
+		(pad-left "x" 100)
+		(join (make-array 10 "abcdefgh") ",")
+		(replace (repeat "a" 25) "a" "bcd")
+		(format "%99d" 1)
+		(def b (make-builder (repeat "x" 99)))
+		(builder-append! b "y")
+		(str (make-array 40 1))
+		(concat (repeat "a" 50) (repeat "b" 50))
+		(with-output-to-string (dotimes [i 100] (print "x")))`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// replacing a key of a map at the limit doesn't grow it
+	err = runLimited(t, glisp.Limits{MaxCollectionSize: 2}, `
+		(def m (assoc (hash-map 'a 1 'b 2) 'a 2))
+		(update m 'a (fn [x] (+ x 1)))
+		(conj m ['a 3])`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	env := newEnvironment()
+	if err := env.LoadString(`(try (while true 1) (catch e 'caught))`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+
+	_, err := env.RunContext(ctx)
+	var lerr glisp.LimitError
+	if !errors.As(err, &lerr) || lerr.Kind != glisp.Cancelled ||
+		!errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the run cancelled", err)
+	}
+
+	env = newEnvironment()
+	if err := env.LoadString(`(defn spin [] (while true 1))`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(); err != nil {
+		t.Fatal(err)
+	}
+	spin, ok := env.FindObject("spin")
+	if !ok {
+		t.Fatal("spin is not defined")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = env.ApplyContext(ctx, spin.(glisp.SexpFunction), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("apply: got %v, want the call cancelled", err)
+	}
+}
+
+// a coroutine would escape the limits of the run that started it
+func TestLimitedCoroutines(t *testing.T) {
+	err := runLimited(t, glisp.Limits{MaxInstructions: 1000},
+		`(go (while true 1))`)
+	if err == nil || !strings.Contains(err.Error(), "limited environment") {
+		t.Errorf("got %v, want go refused", err)
+	}
+}
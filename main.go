@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
 	"strings"
 
 	"github.com/zhemao/glisp/extensions"
+	"github.com/zhemao/glisp/glisptest"
 	"github.com/zhemao/glisp/interpreter"
 )
 
@@ -18,6 +21,14 @@ var exitOnFailure = flag.Bool("exitonfail", false,
 	"exit on failure instead of starting repl")
 var countFuncCalls = flag.Bool("countcalls", false,
 	"count how many times each function is run")
+var compileFile = flag.String("compile", "",
+	"compile a script to a bytecode image instead of running it")
+var outputFile = flag.String("o", "",
+	"where to write the compiled image (default: the script's name with .glc)")
+var persistentLiterals = flag.Bool("persistent", false,
+	"make [] and {} literals persistent vectors and maps")
+var modulePath = flag.String("path", "",
+	"directories to search for required modules, separated like $PATH")
 
 var precounts map[string]int
 var postcounts map[string]int
@@ -132,7 +143,7 @@ func repl(env *glisp.Glisp) {
 	}
 }
 
-func runScript(env *glisp.Glisp, fname string) {
+func compileScript(env *glisp.Glisp, fname string, outname string) {
 	file, err := os.Open(fname)
 	if err != nil {
 		fmt.Println(err)
@@ -146,6 +157,44 @@ func runScript(env *glisp.Glisp, fname string) {
 		os.Exit(-1)
 	}
 
+	if outname == "" {
+		outname = strings.TrimSuffix(fname, filepath.Ext(fname)) + ".glc"
+	}
+	out, err := os.Create(outname)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	err = env.WriteCompiled(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Remove(outname)
+		os.Exit(-1)
+	}
+}
+
+func runScript(env *glisp.Glisp, fname string) {
+	file, err := os.Open(fname)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	defer file.Close()
+
+	if filepath.Ext(fname) == ".glc" {
+		err = env.LoadCompiled(file)
+	} else {
+		err = env.LoadFile(file)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
 	_, err = env.Run()
 	if *countFuncCalls {
 		fmt.Println("Pre:")
@@ -166,7 +215,7 @@ func runScript(env *glisp.Glisp, fname string) {
 	}
 }
 
-func main() {
+func newEnvironment() *glisp.Glisp {
 	env := glisp.NewGlisp()
 	env.ImportEval()
 	glispext.ImportRandom(env)
@@ -174,8 +223,89 @@ func main() {
 	glispext.ImportChannels(env)
 	glispext.ImportCoroutines(env)
 	glispext.ImportRegex(env)
+	glispext.ImportMath(env)
+	glispext.ImportStrings(env)
+	glispext.ImportIO(env)
+	return env
+}
+
+// runTests runs the scripts in dir, or the single script at dir, as tests
+// and reports on them to out. It returns the status to exit with, which
+// is nonzero if any of them failed.
+func runTests(out io.Writer, dir string) int {
+	var results []glisptest.FileResult
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		results = []glisptest.FileResult{
+			glisptest.RunFile(dir, newEnvironment)}
+	} else {
+		results, err = glisptest.RunDir(dir, newEnvironment)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return -1
+		}
+	}
 
+	ntests, nfailed := 0, 0
+	for _, result := range results {
+		ntests += len(result.Tests)
+		if result.Passed() {
+			fmt.Fprintf(out, "ok   %s\n", result.File)
+			continue
+		}
+		nfailed++
+		fmt.Fprintf(out, "FAIL %s\n", result.File)
+		printFailures(out, "", result.Failures)
+		if result.Err != nil {
+			printError(out, "", result.Err, result.Trace)
+		}
+		for _, test := range result.Tests {
+			if test.Passed() {
+				continue
+			}
+			fmt.Fprintf(out, "  FAIL %s\n", test.Name)
+			printFailures(out, "  ", test.Failures)
+			if test.Err != nil {
+				printError(out, "  ", test.Err, test.Trace)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "%d files, %d tests, %d files failed\n",
+		len(results), ntests, nfailed)
+	if nfailed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printFailures(out io.Writer, indent string, failures []glisptest.Failure) {
+	for _, failure := range failures {
+		lines := strings.Split(failure.String(), "\n")
+		fmt.Fprintln(out, indent+"  "+strings.Join(lines, "\n"+indent+"  "))
+	}
+}
+
+func printError(out io.Writer, indent string, err error, trace string) {
+	if trace == "" {
+		trace = err.Error()
+	}
+	lines := strings.Split(strings.TrimSuffix(trace, "\n"), "\n")
+	fmt.Fprintln(out, indent+"  "+strings.Join(lines, "\n"+indent+"  "))
+}
+
+func main() {
 	flag.Parse()
+	args := flag.Args()
+	if len(args) == 2 && args[0] == "test" {
+		os.Exit(runTests(os.Stdout, args[1]))
+	}
+
+	env := newEnvironment()
+	env.SetPersistentLiterals(*persistentLiterals)
+	if *modulePath != "" {
+		env.SetModulePath(filepath.SplitList(*modulePath)...)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -198,8 +328,9 @@ func main() {
 		env.AddPostHook(CountPostHook)
 	}
 
-	args := flag.Args()
-	if len(args) > 0 {
+	if *compileFile != "" {
+		compileScript(env, *compileFile, *outputFile)
+	} else if len(args) > 0 {
 		runScript(env, args[0])
 	} else {
 		repl(env)
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zhemao/glisp/glisptest"
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+func TestScripts(t *testing.T) {
+	glisptest.Test(t, "tests", newEnvironment)
+}
+
+func TestRedirectedStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	env := newEnvironment()
+	env.SetStdout(&stdout)
+	env.SetStderr(&stderr)
+	env.SetStdin(strings.NewReader("first line\n(+ 1 2)\n"))
+
+	err := env.LoadString(`
+		(println (read-line))
+		(print (read stdin))
+		(write-line stderr "oops")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := stdout.String(), "first line\n(+ 1 2)"; got != want {
+		t.Errorf("stdout: got %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "oops\n"; got != want {
+		t.Errorf("stderr: got %q, want %q", got, want)
+	}
+
+	// an error leaving with-output-to-string ends its capture
+	env.Clear()
+	err = env.LoadString(`(with-output-to-string (print "lost") (throw 'oops))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Run(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if env.Stdout() != &stdout {
+		t.Errorf("stdout is still captured after an error")
+	}
+}
+
+func TestInternalErrors(t *testing.T) {
+	env := newEnvironment()
+	if _, err := env.Run(); !errors.Is(err, glisp.ErrStackUnderflow) {
+		t.Errorf("empty run: got %v, want a stack underflow", err)
+	}
+
+	env = newEnvironment()
+	env.AddFunction("explode", func(env *glisp.Glisp, name string,
+		args []glisp.Sexp) (glisp.Sexp, error) {
+		var arr []glisp.Sexp
+		return arr[len(args)], nil
+	})
+	err := env.LoadString(`(try (explode 1) (catch e 'caught))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Run()
+	var ierr *glisp.InternalError
+	if !errors.As(err, &ierr) || !errors.Is(err, glisp.ErrInternal) {
+		t.Fatalf("panicking function: got %v, want an internal error", err)
+	}
+	if ierr.Stack == "" || ierr.State.Function != "explode" {
+		t.Errorf("internal error is missing state: %+v", ierr)
+	}
+
+	// the snapshot prints a hash holding itself without overflowing
+	env.Clear()
+	err = env.LoadString(`(def h {'a 1}) (hset! h 'self h) (list h (explode 1))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Run()
+	if !errors.As(err, &ierr) {
+		t.Fatalf("got %v, want an internal error", err)
+	}
+	if !strings.Contains(strings.Join(ierr.State.Stack, " "), "{a 1 self {...}}") {
+		t.Errorf("got stack %q", ierr.State.Stack)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	run := func(src string) error {
+		env := newEnvironment()
+		if err := env.LoadString(src); err != nil {
+			t.Fatal(err)
+		}
+		_, err := env.Run()
+		return err
+	}
+
+	var aerr glisp.ArityError
+	err := run(`(defn f [a b] a) (f 1)`)
+	if !errors.As(err, &aerr) || aerr.Expected != 2 || aerr.Got != 1 {
+		t.Errorf("arity: got %v", err)
+	}
+	if err := run(`(cons 1)`); !errors.As(err, &aerr) ||
+		!errors.Is(err, glisp.WrongNargs) {
+		t.Errorf("builtin arity: got %v", err)
+	}
+
+	var terr glisp.TypeError
+	err = run(`(+ 1 "a")`)
+	if !errors.As(err, &terr) || terr.Actual != "string" ||
+		!errors.Is(err, glisp.WrongType) {
+		t.Errorf("type: got %v", err)
+	}
+
+	var serr glisp.UnboundSymbolError
+	if err := run(`nowhere`); !errors.As(err, &serr) || serr.Name != "nowhere" {
+		t.Errorf("unbound: got %v", err)
+	}
+
+	var uerr glisp.UserError
+	err = run(`(throw [1 2])`)
+	if !errors.As(err, &uerr) || uerr.Data.SexpString() != "[1 2]" {
+		t.Errorf("throw: got %v", err)
+	}
+
+	// rethrowing a caught error keeps the original
+	err = run(`(try (+ 1 "a") (catch e (throw e)))`)
+	if !errors.As(err, &terr) {
+		t.Errorf("rethrow: got %v", err)
+	}
+}
+
+func TestPersistentLiterals(t *testing.T) {
+	env := newEnvironment()
+	env.SetPersistentLiterals(true)
+	err := env.LoadString(`
+		(def v [1 (+ 1 1)])
+		(def m {'a 1})
+		(list (vector? v) (map? m) (hget (assoc m 'b v) 'b)
+		      (try (aset! v 0 0) (catch e 'immutable)))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := env.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.SexpString(), "(true true [1 2] immutable)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestPersistentScripts(t *testing.T) {
+	glisptest.Test(t, "tests/persistent", func() *glisp.Glisp {
+		env := newEnvironment()
+		env.SetPersistentLiterals(true)
+		return env
+	})
+}
+
+type sexpWidget struct {
+	name string
+}
+
+func (w sexpWidget) SexpString() string {
+	return "widget " + w.name
+}
+
+func TestGoMethods(t *testing.T) {
+	env := newEnvironment()
+	if err := env.DefineProtocol("Drawable", "draw"); err != nil {
+		t.Fatal(err)
+	}
+	err := env.AddMethod(glisp.TypeName(sexpWidget{}), "draw",
+		func(env *glisp.Glisp, name string, args []glisp.Sexp) (glisp.Sexp, error) {
+			return glisp.SexpStr("drawing " + args[0].(sexpWidget).name), nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.AddMethod("int", "erase", nil); err == nil {
+		t.Error("adding a method no protocol declares should fail")
+	}
+
+	env.AddGlobal("button", sexpWidget{"button"})
+	// defining the protocol again keeps the Go method
+	err = env.LoadString(`
+		(extend-type int Drawable (draw [n] "drawing a number"))
+		(defprotocol Drawable (draw [x]))
+		(list (draw button) (draw 1) (satisfies? Drawable button))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := env.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `("drawing button" "drawing a number" true)`
+	if got := res.SexpString(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if err := env.DefineProtocol("Paintable", "draw"); err == nil {
+		t.Error("a method should not belong to two protocols")
+	}
+}
+
+func TestTestCommand(t *testing.T) {
+	var out bytes.Buffer
+	if status := runTests(&out, "glisptest/testdata/failing.glisp"); status != 1 {
+		t.Errorf("failing script: got exit status %d, want 1", status)
+	}
+	for _, want := range []string{
+		"FAIL glisptest/testdata/failing.glisp",
+		"  FAIL failing",
+		"glisptest/testdata/failing.glisp:8:7: (is (< 5 1)) failed",
+		"  FAIL erroring",
+		"1 files, 3 tests, 1 files failed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "FAIL passing") {
+		t.Errorf("passing test reported as failed:\n%s", out.String())
+	}
+
+	out.Reset()
+	if status := runTests(&out, "tests/loops.glisp"); status != 0 {
+		t.Errorf("passing script: got exit status %d, want 0\n%s",
+			status, out.String())
+	}
+	if status := runTests(&out, "no-such-dir"); status == 0 {
+		t.Error("a missing directory should fail")
+	}
+}
+
+// calls must find the same function whether or not the code is in a
+// namespace
+func TestLookupOrder(t *testing.T) {
+	src := `
+		(defn twice [x] (list x x))
+		(list (let [list (fn [a] 'mine)] (list 1))
+		      ((fn [first] (first 2)) (fn [x] 'arg))
+		      (twice 3))`
+	for _, prefix := range []string{"", "(ns my.space)"} {
+		env := newEnvironment()
+		res, err := env.EvalString(prefix + src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.SexpString(), "(mine arg (3 3))"; got != want {
+			t.Errorf("%q: got %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	env := newEnvironment()
+	if err := env.LoadString("(defn f [] x)\n(f)"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := env.Run()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	trace := env.GetStackTrace(err)
+	want := "error in f: symbol x not found at 1:12\nin __main at 2:1\n"
+	if trace != want {
+		t.Errorf("got %q, want %q", trace, want)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+func newGoEnvironment(t *testing.T) *glisp.Glisp {
+	t.Helper()
+	env := newEnvironment()
+	functions := map[string]interface{}{
+		"sum": func(xs ...int) int {
+			total := 0
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		},
+		"greet": func(greeting string, names ...string) string {
+			return greeting + " " + strings.Join(names, " and ")
+		},
+		"parse":  strconv.Atoi,
+		"octet":  func(b uint8) uint8 { return b },
+		"small":  func(n int8) int8 { return n },
+		"huge":   func(n uint64) uint64 { return n },
+		"divmod": func(a, b int) (int, int) { return a / b, a % b },
+		"twice": func(f func(int) (int, error), x int) (int, error) {
+			y, err := f(x)
+			if err != nil {
+				return 0, err
+			}
+			return f(y)
+		},
+		"each": func(f func(...string) error, items []string) error {
+			return f(items...)
+		},
+		"namespace": func(env *glisp.Glisp) string {
+			return "in " + env.Namespace()
+		},
+		"nothing": func() {},
+	}
+	for name, function := range functions {
+		if err := env.AddGoFunction(name, function); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env
+}
+
+func TestGoFunctions(t *testing.T) {
+	env := newGoEnvironment(t)
+	if err := env.AddGoFunction("number", 1); err == nil {
+		t.Error("AddGoFunction should reject a value that isn't a function")
+	}
+
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`(sum)`, `0`},
+		{`(sum 1 2 3)`, `6`},
+		{`(greet "hi")`, `"hi "`},
+		{`(greet "hi" "ann" 'bob)`, `"hi ann and bob"`},
+		{`(parse "42")`, `42`},
+		{`(octet 255)`, `255`},
+		{`(small -128)`, `-128`},
+		{`(huge 9223372036854775807)`, `9223372036854775807`},
+		{`(huge 18446744073709551615)`, `18446744073709551615`},
+		{`(- (huge 9223372036854775808) 1)`, `9223372036854775807`},
+		{`(divmod 7 2)`, `[3 1]`},
+		{`(twice (fn [x] (* x 10)) 3)`, `300`},
+		{`(def seen '())
+		  (each (fn [& xs] (set! seen xs)) ["a" "b"])
+		  seen`, `("a" "b")`},
+		{`(namespace)`, `"in "`},
+		{`(nothing)`, `()`},
+	}
+	for _, c := range cases {
+		res, err := env.EvalString(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if got := res.SexpString(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.src, got, c.want)
+		}
+	}
+
+	failures := []struct {
+		src  string
+		want string
+	}{
+		{`(parse "x")`, `invalid syntax`},
+		{`(octet 256)`, `256 overflows uint8`},
+		{`(octet -1)`, `cannot convert -1 to uint8`},
+		{`(small 128)`, `128 overflows int8`},
+		{`(huge 18446744073709551616)`, `18446744073709551616 overflows uint64`},
+		{`(huge -18446744073709551616)`,
+			`cannot convert -18446744073709551616 to uint64`},
+		{`(sum 1 "2")`, `argument 2: cannot convert "2" to int`},
+		{`(divmod 1)`, `wrong number of arguments`},
+		{`(twice (fn [x] "no") 1)`, `cannot convert "no" to int`},
+		{`(twice (fn [x] (throw "boom")) 1)`, `boom`},
+		{`(twice 1 1)`, `argument 1: cannot convert 1 to func(int) (int, error)`},
+	}
+	for _, c := range failures {
+		_, err := newGoEnvironment(t).EvalString(c.src)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error containing %q",
+				c.src, err, c.want)
+		}
+	}
+
+	// Go functions taking glisp functions must be able to report errors
+	err := env.AddGoFunction("call", func(f func(int) int) int { return f(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.EvalString(`(call (fn [x] x))`); err == nil {
+		t.Error("converting to a function type without an error should fail")
+	}
+}
+
+type account struct {
+	Owner   string         `glisp:"owner"`
+	Balance *big.Rat       `glisp:"balance"`
+	Tags    []string       `glisp:"tags,omitempty"`
+	Limits  map[string]int `glisp:"limits"`
+	Secret  string         `glisp:"-"`
+	Number  *big.Int
+	id      int
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	env := newEnvironment()
+	orig := account{
+		Owner:   "ann",
+		Balance: big.NewRat(1, 3),
+		Tags:    []string{"new"},
+		Limits:  map[string]int{"daily": 100},
+		Secret:  "hunter2",
+		Number:  new(big.Int).Lsh(big.NewInt(1), 100),
+		id:      7,
+	}
+
+	expr, err := env.FromGo(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, ok := expr.(glisp.SexpHash)
+	if !ok || glisp.TypeName(hash) != "account" {
+		t.Fatalf("got %s, want an account hash", expr.SexpString())
+	}
+	want := `(account owner: "ann" balance: 1/3 tags: ["new"] ` +
+		`limits: {"daily" 100} Number: 1267650600228229401496703205376)`
+	if got := hash.SexpString(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	env.AddGlobal("acct", hash)
+	_, err = env.EvalString(`
+		(hset! acct 'owner "bob")
+		(hset! acct 'balance (+ (hget acct 'balance) 1/6))
+		(hset! (hget acct 'limits) "weekly" 500)
+		(hset! acct 'Number (* (hget acct 'Number) 2))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var back account
+	if err := env.ToGo(hash, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Owner != "bob" || back.Balance.Cmp(big.NewRat(1, 2)) != 0 {
+		t.Errorf("fields set in glisp were lost: %+v", back)
+	}
+	if back.Secret != "hunter2" || back.id != 7 {
+		t.Errorf("hidden fields were not kept: %+v", back)
+	}
+	limits := map[string]int{"daily": 100, "weekly": 500}
+	if !reflect.DeepEqual(back.Limits, limits) {
+		t.Errorf("limits: got %v, want %v", back.Limits, limits)
+	}
+	if back.Number.Cmp(new(big.Int).Lsh(big.NewInt(1), 101)) != 0 {
+		t.Errorf("number: got %s", back.Number)
+	}
+
+	// a plain hash fills in a struct by field name or tag, as symbols or
+	// strings
+	plain, err := env.EvalString(`{'owner "cy" "tags" ["a" "b"] 'Secret "no"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fresh account
+	if err := env.ToGo(plain, &fresh); err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Owner != "cy" || !reflect.DeepEqual(fresh.Tags, []string{"a", "b"}) ||
+		fresh.Secret != "" {
+		t.Errorf("got %+v", fresh)
+	}
+}
+
+func TestGoValues(t *testing.T) {
+	env := newEnvironment()
+
+	big100 := new(big.Int).Lsh(big.NewInt(1), 100)
+	expr, err := env.FromGo(big100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := expr.(glisp.SexpBigInt); !ok {
+		t.Errorf("*big.Int: got %T", expr)
+	}
+	// the glisp value doesn't change with the Go one
+	big100.SetInt64(1)
+	if got := expr.SexpString(); got != "1267650600228229401496703205376" {
+		t.Errorf("*big.Int: got %s", got)
+	}
+
+	expr, err = env.FromGo(big.NewRat(2, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := expr.SexpString(); got != "1/3" {
+		t.Errorf("*big.Rat: got %s", got)
+	}
+	var r *big.Rat
+	if err := env.ToGo(expr, &r); err != nil || r.Cmp(big.NewRat(1, 3)) != 0 {
+		t.Errorf("*big.Rat: got %v, %v", r, err)
+	}
+	var i *big.Int
+	if err := env.ToGo(glisp.SexpInt(5), &i); err != nil || i.Int64() != 5 {
+		t.Errorf("*big.Int: got %v, %v", i, err)
+	}
+
+	expr, err = env.FromGo(map[string][]int{"a": {1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := expr.SexpString(); got != `{"a" [1 2]}` {
+		t.Errorf("map: got %s", got)
+	}
+	var m map[string][]int
+	if err := env.ToGo(expr, &m); err != nil ||
+		!reflect.DeepEqual(m, map[string][]int{"a": {1, 2}}) {
+		t.Errorf("map: got %v, %v", m, err)
+	}
+
+	var natural interface{}
+	list, err := env.EvalString(`'(1 "two" 3.5)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.ToGo(list, &natural); err != nil ||
+		!reflect.DeepEqual(natural, []interface{}{1, "two", 3.5}) {
+		t.Errorf("interface: got %#v, %v", natural, err)
+	}
+}
+
+func TestGoMismatches(t *testing.T) {
+	env := newEnvironment()
+	arr, err := env.EvalString(`[1 "a"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	var s string
+	var ints []int
+	var triple [3]int
+	var acct account
+	var m map[string]int
+	var r *big.Rat
+	cases := []struct {
+		expr   glisp.Sexp
+		target interface{}
+		want   string
+	}{
+		{glisp.SexpStr("x"), &n, `cannot convert "x" to int`},
+		{glisp.SexpInt(1), &s, `cannot convert 1 to string`},
+		{arr, &ints, `index 1: cannot convert "a" to int`},
+		{arr, &triple, `expected 3 elements for [3]int, got 2`},
+		{glisp.SexpInt(1), &acct, `cannot convert 1 to main.account`},
+		{arr, &m, `cannot convert [1 "a"] to map[string]int`},
+		{glisp.SexpStr("x"), &r, `cannot convert "x" to big.Rat`},
+		{glisp.SexpInt(1), n, `ToGo target must be a non-nil pointer, got int`},
+	}
+	for _, c := range cases {
+		err := env.ToGo(c.expr, c.target)
+		if err == nil || err.Error() != c.want {
+			t.Errorf("%s into %T: got %v, want %q",
+				c.expr.SexpString(), c.target, err, c.want)
+		}
+	}
+
+	hash, err := env.EvalString(`{'owner 1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.ToGo(hash, &acct)
+	if err == nil || err.Error() != "field owner: cannot convert 1 to string" {
+		t.Errorf("struct field: got %v", err)
+	}
+
+	_, err = env.FromGo(make(chan int))
+	if err == nil || errors.Is(err, glisp.WrongNargs) {
+		t.Errorf("channel: got %v, want a conversion error", err)
+	}
+}
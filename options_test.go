@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/zhemao/glisp/extensions"
+	glisp "github.com/zhemao/glisp/interpreter"
+)
+
+func evalWith(t *testing.T, opts glisp.Options, src string) (glisp.Sexp, error) {
+	t.Helper()
+	env, err := glisp.NewGlispWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env.EvalString(src)
+}
+
+func TestWhitelists(t *testing.T) {
+	opts := glisp.Options{
+		Builtins:     []string{"+", "list"},
+		SpecialForms: []string{"def", "fn", "let", "quote"},
+	}
+
+	res, err := evalWith(t, opts, `(def add (fn [a b] (+ a b))) (list (add 1 2))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.SexpString(); got != "(3)" {
+		t.Errorf("got %s, want (3)", got)
+	}
+
+	rejected := []string{
+		`(- 3 1)`,
+		`(include "tests/inc.g")`,
+		`(defmac twice [x] (list '+ x x))`,
+		`(eval '(+ 1 2))`,
+		`(source-file "tests/inc.g")`,
+		`(begin 1)`,
+	}
+	for _, src := range rejected {
+		if _, err := evalWith(t, opts, src); err == nil {
+			t.Errorf("%s should fail", src)
+		}
+	}
+
+	// builtins a script can't call can't sneak in through eval either
+	opts.Imports = []func(*glisp.Glisp){(*glisp.Glisp).ImportEval}
+	if _, err := evalWith(t, opts, `(eval '(- 3 1))`); err == nil {
+		t.Error("eval should not reach builtins left out")
+	}
+
+	_, err = glisp.NewGlispWithOptions(glisp.Options{Builtins: []string{"nope"}})
+	if err == nil {
+		t.Error("an unknown builtin should be rejected")
+	}
+	_, err = glisp.NewGlispWithOptions(glisp.Options{SpecialForms: []string{"nope"}})
+	if err == nil {
+		t.Error("an unknown special form should be rejected")
+	}
+}
+
+// forms that expand to loops, captures or gensyms must not depend on
+// builtins the environment leaves out, or on local shadowing of them
+func TestWhitelistedForms(t *testing.T) {
+	opts := glisp.Options{
+		Builtins: []string{"print"},
+		SpecialForms: []string{"dotimes", "doseq", "with-output-to-string",
+			"syntax-quote", "quote", "let", "fn"},
+	}
+
+	cases := []struct{ src, want string }{
+		{`(with-output-to-string (dotimes [i 3] (print i)))`, `"012"`},
+		{`(with-output-to-string (doseq [x '(a b c)] (print x)))`, `"abc"`},
+		{`(with-output-to-string (print "out"))`, `"out"`},
+		{`(let [< (fn [a b] false) + (fn [a b] 0) len (fn [a] 0)]
+		   (with-output-to-string
+		     (dotimes [i 2] (print i))
+		     (doseq [x '(a b)] (print x))))`, `"01ab"`},
+	}
+	for _, c := range cases {
+		res, err := evalWith(t, opts, c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if got := res.SexpString(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.src, got, c.want)
+		}
+	}
+
+	res, err := evalWith(t, opts, "(syntax-quote (x# x#))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.SexpString(); !strings.HasPrefix(got, "(x__") {
+		t.Errorf("got %s, want a generated symbol", got)
+	}
+}
+
+func TestFileSystem(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/inc.glisp":   {Data: []byte(`(def included 1)`)},
+		"lib/src.glisp":   {Data: []byte(`(def sourced 2)`)},
+		"my/module.glisp": {Data: []byte(`(ns my.module) (defn answer [] 42)`)},
+		"data.txt":        {Data: []byte("hello\n")},
+	}
+	opts := glisp.Options{
+		FS:         fsys,
+		ModulePath: []string{"."},
+		Imports: []func(*glisp.Glisp){
+			(*glisp.Glisp).ImportEval, glispext.ImportIO,
+		},
+	}
+
+	res, err := evalWith(t, opts, `
+		(include "lib/inc.glisp")
+		(source-file "lib/src.glisp")
+		(require my.module)
+		(list included sourced (my.module/answer)
+		      (with-open-file [f "data.txt"] (read-line f))
+		      (file-exists? "data.txt") (list-dir "lib"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `(1 2 42 "hello" true ["inc.glisp" "src.glisp"])`
+	if got := res.SexpString(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// files on the host are out of reach, as is writing
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.glisp")
+	if err := os.WriteFile(secret, []byte(`(def leaked 1)`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	outside := []string{
+		`(include "` + secret + `")`,
+		`(source-file "` + secret + `")`,
+		`(open "` + secret + `")`,
+		`(open "out.txt" "w")`,
+		`(delete-file "data.txt")`,
+		`(include "tests/inc.g")`,
+	}
+	for _, src := range outside {
+		if _, err := evalWith(t, opts, src); err == nil {
+			t.Errorf("%s should fail", src)
+		}
+	}
+}
+
+func TestFileSystemEscapes(t *testing.T) {
+	root := t.TempDir()
+	sandbox := filepath.Join(root, "sandbox")
+	if err := os.MkdirAll(filepath.Join(sandbox, "lib"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(root, "secret.glisp"),
+		[]byte(`(def leaked 1)`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(sandbox, "lib", "ok.glisp"),
+		[]byte(`(def ok 1)`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := glisp.Options{
+		FS: os.DirFS(sandbox),
+		Imports: []func(*glisp.Glisp){
+			(*glisp.Glisp).ImportEval, glispext.ImportIO,
+		},
+	}
+	if _, err := evalWith(t, opts, `(include "lib/ok.glisp") ok`); err != nil {
+		t.Fatal(err)
+	}
+
+	escapes := []string{
+		`(include "../secret.glisp")`,
+		`(include "lib/../../secret.glisp")`,
+		`(source-file "../secret.glisp")`,
+		`(open "../secret.glisp")`,
+		`(stat "../secret.glisp")`,
+		`(list-dir "..")`,
+	}
+	for _, src := range escapes {
+		_, err := evalWith(t, opts, src)
+		if err == nil {
+			t.Errorf("%s should fail", src)
+		} else if strings.Contains(err.Error(), "leaked") {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+
+	opts.ModulePath = []string{".."}
+	if _, err := evalWith(t, opts, `(require secret)`); err == nil {
+		t.Error("require should not find modules outside the FS")
+	}
+}
@@ -1,8 +1,3 @@
 #!/bin/sh
 
-for lispfile in tests/*.glisp
-do
-    ./glisp -exitonfail "${lispfile}" && \
-        echo "${lispfile} passed" || \
-        echo "${lispfile} failed"
-done
+exec ./glisp test tests